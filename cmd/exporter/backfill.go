@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/backfill"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+)
+
+func registerBackfillCommand(app *kingpin.Application, cfg *cmdsConfig) {
+	cmd := app.Command("backfill", "Write historical device data as OpenMetrics or TSDB blocks.")
+
+	from := cmd.Flag("from", "Start of the time range, as RFC3339 or unix seconds.").Required().String()
+	to := cmd.Flag("to", "End of the time range, as RFC3339 or unix seconds. Defaults to now.").String()
+	macs := cmd.Flag("mac", "MAC of a device to backfill. Can be repeated. Defaults to all supported devices.").Strings()
+	format := cmd.Flag("format", "Output format.").Default("openmetrics").Enum("openmetrics", "tsdb")
+	output := cmd.Flag("output", "Output file for openmetrics (- for stdout) or directory for tsdb blocks.").
+		Default("-").String()
+	blockDuration := cmd.Flag("tsdb.block-duration", "Duration of the TSDB blocks to create.").
+		Default("2h").Duration()
+	legacyNames := cmd.Flag("metrics.legacy-names", "Also write the series under the metric names used before the qingping_ schema, e.g. air_monitor_temperature.").
+		Bool()
+
+	cfg.cmdAction[cmd.FullCommand()] = func(reg *prometheus.Registry, logger log.Logger) error {
+		startTime, err := exporter.ParseTime(*from, time.Time{})
+		if err != nil {
+			return errors.Wrap(err, "parse --from")
+		}
+		endTime, err := exporter.ParseTime(*to, time.Now())
+		if err != nil {
+			return errors.Wrap(err, "parse --to")
+		}
+		if !startTime.Before(endTime) {
+			return errors.Newf("--from (%s) must be before --to (%s)", startTime, endTime)
+		}
+
+		c := client.New(apiConfig, client.WithRegistry(reg))
+
+		devices, err := selectDevices(c, *macs)
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to get device list", "err", err)
+			return err
+		}
+
+		labels, err := fileConfig.ExtraLabels()
+		if err != nil {
+			return err
+		}
+		opts := []backfill.Option{backfill.WithLegacyNames(*legacyNames), backfill.WithExtraLabels(labels, devices)}
+		var w backfill.Writer
+		switch *format {
+		case "tsdb":
+			if *output == "-" {
+				return errors.New("--output must be a directory when writing TSDB blocks")
+			}
+			if err := os.MkdirAll(*output, 0o750); err != nil {
+				return err
+			}
+			w = backfill.NewTSDBWriter(*output, blockDuration.Milliseconds(), logger, opts...)
+		default:
+			out := os.Stdout
+			if *output != "-" {
+				f, err := os.Create(*output)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				out = f
+			}
+			w = backfill.NewOpenMetricsWriter(out, opts...)
+		}
+
+		for _, device := range devices {
+			rows := 0
+			err := c.WalkDataHistory(device.MAC, startTime, endTime, func(data []client.DeviceData) error {
+				rows += len(data)
+				return w.Write(device.MAC, data)
+			})
+			if err != nil {
+				return errors.Wrapf(err, "backfill device %s", device.MAC)
+			}
+			level.Info(logger).Log("msg", "fetched data history", "mac", device.MAC, "rows", rows)
+		}
+
+		return w.Close()
+	}
+}
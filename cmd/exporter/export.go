@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/export"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+)
+
+func registerExportCommand(app *kingpin.Application, cfg *cmdsConfig) {
+	cmd := app.Command("export", "Export historical device data as CSV, JSON Lines or Parquet.")
+
+	from := cmd.Flag("from", "Start of the time range, as RFC3339 or unix seconds.").Required().String()
+	to := cmd.Flag("to", "End of the time range, as RFC3339 or unix seconds. Defaults to now.").String()
+	macs := cmd.Flag("mac", "MAC of a device to export. Can be repeated. Defaults to all supported devices.").Strings()
+	format := cmd.Flag("format", "Output format.").Default(export.FormatCSV).Enum(export.Formats...)
+	output := cmd.Flag("output", "Output file, - for stdout.").Default("-").String()
+	timezone := cmd.Flag("timezone", "IANA timezone used to format timestamps, e.g. Europe/Berlin.").
+		Default("UTC").String()
+
+	cfg.cmdAction[cmd.FullCommand()] = func(reg *prometheus.Registry, logger log.Logger) error {
+		startTime, err := exporter.ParseTime(*from, time.Time{})
+		if err != nil {
+			return errors.Wrap(err, "parse --from")
+		}
+		endTime, err := exporter.ParseTime(*to, time.Now())
+		if err != nil {
+			return errors.Wrap(err, "parse --to")
+		}
+		if !startTime.Before(endTime) {
+			return errors.Newf("--from (%s) must be before --to (%s)", startTime, endTime)
+		}
+		loc, err := time.LoadLocation(*timezone)
+		if err != nil {
+			return errors.Wrap(err, "load --timezone")
+		}
+
+		c := client.New(apiConfig, client.WithRegistry(reg))
+
+		devices, err := selectDevices(c, *macs)
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to get device list", "err", err)
+			return err
+		}
+
+		var out io.Writer = os.Stdout
+		if *output != "-" {
+			f, err := os.Create(*output)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+
+		w, err := export.NewWriter(*format, out, loc)
+		if err != nil {
+			return err
+		}
+
+		for _, device := range devices {
+			rows := 0
+			err := c.WalkDataHistory(device.MAC, startTime, endTime, func(data []client.DeviceData) error {
+				rows += len(data)
+				return w.Write(device, data)
+			})
+			if err != nil {
+				return errors.Wrapf(err, "export device %s", device.MAC)
+			}
+			level.Info(logger).Log("msg", "exported data history", "mac", device.MAC, "rows", rows)
+		}
+
+		return w.Close()
+	}
+}
+
+// selectDevices returns the devices with the given MACs, or all supported
+// devices of the account when no MAC is given.
+func selectDevices(c *client.Client, macs []string) ([]client.DeviceInfo, error) {
+	devices, err := c.GetDeviceList()
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []client.DeviceInfo
+	for _, device := range devices.Devices {
+		if len(macs) == 0 && device.Info.Product.Code != exporter.DeviceModel {
+			continue
+		}
+		if len(macs) > 0 && !slices.Contains(macs, device.Info.MAC) {
+			continue
+		}
+		selected = append(selected, device.Info)
+	}
+
+	for _, mac := range macs {
+		if !slices.ContainsFunc(selected, func(d client.DeviceInfo) bool { return d.MAC == mac }) {
+			return nil, errors.Newf("device %s not found", mac)
+		}
+	}
+
+	return selected, nil
+}
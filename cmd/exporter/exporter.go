@@ -7,30 +7,165 @@ import (
 	"syscall"
 
 	"github.com/alecthomas/kingpin"
+	"github.com/efficientgo/core/errors"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/oklog/run"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/thanos-io/thanos/pkg/component"
 	"github.com/thanos-io/thanos/pkg/prober"
-	"github.com/thanos-io/thanos/pkg/server/http"
 
+	"github.com/pedro-stanaka/qingping_exporter/pkg/alert"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/alertmanager"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/aqi"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/battery"
 	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/config"
 	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/homeassistant"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/influx"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/mqtt"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/otlp"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/store"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/web"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/webhook"
+)
+
+// Data collection modes of the run command.
+const (
+	modePoll   = "poll"
+	modePush   = "push"
+	modeHybrid = "hybrid"
 )
 
 func registerRunCommand(app *kingpin.Application, cfg *cmdsConfig) {
 	cmd := app.Command("run", "Run the air monitor lite exporter.")
 
-	listenAddr := cmd.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").
-		Default(":10803").String()
+	webConfig := &web.Config{}
+	webConfig.BindFlags(cmd)
+
+	mode := cmd.Flag("mode", "How device data is collected: poll the API, receive pushes on "+webhook.Path+", or both.").
+		Default(modePoll).Enum(modePoll, modePush, modeHybrid)
+	comfortMetrics := cmd.Flag("metrics.comfort", "Expose comfort metrics derived from temperature and humidity: dew point, absolute humidity, heat index, humidex and VPD.").
+		Bool()
+	units := cmd.Flag("metrics.unit", "Also expose the gauges in this unit, as separate metrics with the unit suffix replaced, e.g. qingping_temperature_fahrenheit. Can be repeated.").
+		Enums(exporter.ConversionNames()...)
+	legacyNames := cmd.Flag("metrics.legacy-names", "Also expose the metrics under the names used before the qingping_ schema, e.g. air_monitor_temperature, while migrating dashboards and alerts.").
+		Bool()
+	calibrationFile := cmd.Flag("calibration.file", "YAML file with per-device corrections of the readings.").
+		ExistingFile()
+	calibrationRaw := cmd.Flag("calibration.export-raw", "Also expose the uncalibrated values of corrected fields, with the raw=\"true\" label.").
+		Bool()
+
+	mqttConfig := &mqtt.Config{}
+	mqttConfig.BindFlags(cmd)
+
+	haConfig := &homeassistant.Config{}
+	haConfig.BindFlags(cmd)
+
+	otlpConfig := &otlp.Config{}
+	otlpConfig.BindFlags(cmd)
+
+	influxConfig := &influx.Config{}
+	influxConfig.BindFlags(cmd)
+
+	storeConfig := &store.Config{}
+	storeConfig.BindFlags(cmd)
+
+	aqiConfig := &aqi.Config{}
+	aqiConfig.BindFlags(cmd)
+
+	batteryConfig := &battery.Config{}
+	batteryConfig.BindFlags(cmd)
+
+	amConfig := &alertmanager.Config{}
+	amConfig.BindFlags(cmd)
 
 	cfg.cmdAction[cmd.FullCommand()] = func(reg *prometheus.Registry, logger log.Logger) error {
 		// setup client
 		c := client.New(apiConfig, client.WithRegistry(reg))
 
+		if err := webConfig.Validate(); err != nil {
+			return err
+		}
+		if haConfig.Enabled && !mqttConfig.Enabled() {
+			return errors.New("--homeassistant.enabled requires --mqtt.broker")
+		}
+		if err := batteryConfig.Validate(); err != nil {
+			return err
+		}
+
+		calibration, err := loadCalibration(fileConfig, *calibrationFile)
+		if err != nil {
+			return err
+		}
+		labels, err := fileConfig.ExtraLabels()
+		if err != nil {
+			return err
+		}
+		amConfig.ExtraLabels = labels
+		if err := amConfig.Validate(); err != nil {
+			return err
+		}
+
+		// stream new readings to the clients of the SSE endpoint
+		stream := web.NewStream(webConfig.StreamMaxClients, webConfig.StreamHeartbeat, reg, logger)
+		sinks := []exporter.Sink{stream}
+		// notify the alerting rules of the config file
+		alerts := alert.NewManager(fileConfig.Alerting, reg, logger)
+		sinks = append(sinks, alerts)
+		if aqiConfig.Enabled() {
+			aqiConfig.LegacyNames = *legacyNames
+			aqiConfig.ExtraLabels = labels
+			sinks = append(sinks, aqi.NewSink(*aqiConfig, reg))
+		}
+		batteryConfig.ExtraLabels = labels
+		sinks = append(sinks, battery.NewSink(*batteryConfig, reg))
+		var haPublisher *homeassistant.Publisher
+		if haConfig.Enabled {
+			haPublisher = homeassistant.NewPublisher(*mqttConfig, *haConfig, reg, logger)
+			sinks = append(sinks, haPublisher)
+		}
+		var otlpExporter *otlp.Exporter
+		if otlpConfig.Enabled() {
+			otlpExporter = otlp.NewExporter(*otlpConfig, reg, logger)
+			sinks = append(sinks, otlpExporter)
+		}
+		var influxWriter *influx.Writer
+		if influxConfig.Enabled() {
+			if err := influxConfig.Validate(); err != nil {
+				return err
+			}
+			influxWriter = influx.NewWriter(*influxConfig, reg, logger)
+			sinks = append(sinks, influxWriter)
+		}
+		var st *store.Store
+		if storeConfig.Enabled() {
+			st, err = store.Open(*storeConfig, reg, logger)
+			if err != nil {
+				return err
+			}
+			sinks = append(sinks, st)
+		}
+
 		// create exporter
-		exp := exporter.NewAirMonitorLiteExporter(c, reg, logger)
+		exp := exporter.NewAirMonitorLiteExporter(c, reg, logger,
+			exporter.WithSinks(sinks...),
+			exporter.WithPolling(*mode != modePush),
+			exporter.WithComfortMetrics(*comfortMetrics),
+			exporter.WithCalibration(calibration, *calibrationRaw),
+			exporter.WithUnitConversions(*units...),
+			exporter.WithLegacyNames(*legacyNames),
+			exporter.WithSyncInterval(fileConfig.Sync.Interval),
+			exporter.WithHistoryWindow(fileConfig.Sync.History),
+			exporter.WithDeviceFilter(&fileConfig.Selectors),
+			exporter.WithExtraLabels(labels),
+		)
+		if st != nil {
+			// serve the last known values until the devices report again
+			for _, r := range st.Last() {
+				exp.Restore(r.Readings())
+			}
+		}
 
 		g := &run.Group{}
 
@@ -54,11 +189,121 @@ func registerRunCommand(app *kingpin.Application, cfg *cmdsConfig) {
 			cancel()
 		})
 
+		// send alert notifications
+		g.Add(func() error {
+			return alerts.Run(ctx)
+		}, func(_ error) {
+			cancel()
+		})
+
+		// push device alerts to Alertmanager
+		if amConfig.Enabled() {
+			pusher := alertmanager.NewPusher(*amConfig, exp, reg, logger)
+			g.Add(func() error {
+				return pusher.Run(ctx)
+			}, func(_ error) {
+				cancel()
+			})
+		}
+
+		// ingest device reports from a private MQTT broker
+		if mqttConfig.Enabled() {
+			sub := mqtt.NewSubscriber(*mqttConfig, exp.Device, exp.ObserveMQTT, reg, logger)
+			g.Add(func() error {
+				return sub.Run(ctx)
+			}, func(_ error) {
+				cancel()
+			})
+		}
+
+		// republish readings to Home Assistant
+		if haPublisher != nil {
+			g.Add(func() error {
+				return haPublisher.Run(ctx)
+			}, func(_ error) {
+				cancel()
+			})
+		}
+
+		// push readings over OTLP
+		if otlpExporter != nil {
+			g.Add(func() error {
+				return otlpExporter.Run(ctx)
+			}, func(_ error) {
+				cancel()
+			})
+		}
+
+		// write readings to InfluxDB
+		if influxWriter != nil {
+			g.Add(func() error {
+				return influxWriter.Run(ctx)
+			}, func(_ error) {
+				cancel()
+			})
+		}
+
+		// expire old readings from the local store
+		if st != nil {
+			g.Add(func() error {
+				return st.Run(ctx)
+			}, func(_ error) {
+				cancel()
+			})
+		}
+
 		// run prometheus HTTP server
-		// with instrumentation
+		// with instrumentation, optional TLS and basic auth
 		// and using reg as the registry
 		readyProbe := prober.NewHTTP()
-		httpSrv := http.New(logger, reg, component.Debug, readyProbe, http.WithListen(*listenAddr))
+		httpSrv := web.NewServer(*webConfig, reg, readyProbe, logger)
+		web.NewAPI(exp, logger).Register(httpSrv)
+		httpSrv.Handle("GET "+web.StreamPath, stream)
+		var webhookHandler *webhook.Handler
+		if *mode != modePoll {
+			webhookHandler = webhook.NewHandler(apiConfig.AppSecret, exp.ObservePush, reg, logger)
+			httpSrv.Handle(webhook.Path, webhookHandler)
+		}
+		if st != nil {
+			httpSrv.Handle(store.QueryPath, store.NewHandler(st, logger))
+		}
+
+		// reload the config file on SIGHUP or on request, keeping the metrics
+		if configFile != "" {
+			reloader := config.NewReloader(configFile, func(cfg *config.Config) error {
+				calibration, err := loadCalibration(cfg, *calibrationFile)
+				if err != nil {
+					return err
+				}
+				apiConf := cfg.APIConfig(flagAPIConfig)
+				if err := apiConf.Validate(); err != nil {
+					return err
+				}
+				newLabels, err := cfg.ExtraLabels()
+				if err != nil {
+					return err
+				}
+				if err := labels.Update(newLabels); err != nil {
+					return err
+				}
+
+				c.SetAPIConfig(apiConf)
+				if webhookHandler != nil {
+					webhookHandler.SetSecret(apiConf.AppSecret)
+				}
+				exp.SetSync(cfg.Sync.Interval, cfg.Sync.History)
+				exp.SetCalibration(calibration)
+				exp.SetDeviceFilter(&cfg.Selectors)
+				alerts.SetConfig(cfg.Alerting)
+				return nil
+			}, reg, logger)
+			httpSrv.Handle(config.ReloadPath, reloader)
+			g.Add(func() error {
+				return reloader.Run(ctx)
+			}, func(_ error) {
+				cancel()
+			})
+		}
 
 		g.Add(func() error {
 			readyProbe.Ready()
@@ -71,3 +316,17 @@ func registerRunCommand(app *kingpin.Application, cfg *cmdsConfig) {
 		return g.Run()
 	}
 }
+
+// loadCalibration returns the corrections of the config file followed by the
+// ones of the calibration file, if any.
+func loadCalibration(cfg *config.Config, calibrationFile string) (*exporter.Calibration, error) {
+	calibration := cfg.Calibration()
+	if calibrationFile != "" {
+		fromFile, err := exporter.LoadCalibration(calibrationFile)
+		if err != nil {
+			return nil, err
+		}
+		calibration.Devices = append(calibration.Devices, fromFile.Devices...)
+	}
+	return calibration, nil
+}
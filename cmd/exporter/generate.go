@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/mixin"
+)
+
+func registerRulesCommand(app *kingpin.Application, cfg *cmdsConfig) {
+	cmd := app.Command("rules", "Prometheus rules for the exporter metrics.").
+		Command("generate", "Generate Prometheus recording and alerting rules matching the metrics of the exporter.")
+
+	mixinConfig := &mixin.Config{}
+	mixinConfig.BindFlags(cmd)
+	output := cmd.Flag("output", "Output file, - for stdout.").Default("-").String()
+
+	cfg.offline[cmd.FullCommand()] = true
+	cfg.cmdAction[cmd.FullCommand()] = func(_ *prometheus.Registry, _ log.Logger) error {
+		if err := prepareMixinConfig(mixinConfig); err != nil {
+			return err
+		}
+		var b bytes.Buffer
+		enc := yaml.NewEncoder(&b)
+		enc.SetIndent(2)
+		if err := enc.Encode(mixinConfig.Rules()); err != nil {
+			return err
+		}
+		return writeOutput(*output, b.Bytes())
+	}
+}
+
+func registerDashboardCommand(app *kingpin.Application, cfg *cmdsConfig) {
+	cmd := app.Command("dashboard", "Grafana dashboard of the exporter metrics.").
+		Command("generate", "Generate a Grafana dashboard matching the metrics of the exporter.")
+
+	mixinConfig := &mixin.Config{}
+	mixinConfig.BindFlags(cmd)
+	output := cmd.Flag("output", "Output file, - for stdout.").Default("-").String()
+
+	cfg.offline[cmd.FullCommand()] = true
+	cfg.cmdAction[cmd.FullCommand()] = func(_ *prometheus.Registry, _ log.Logger) error {
+		if err := prepareMixinConfig(mixinConfig); err != nil {
+			return err
+		}
+		b, err := json.MarshalIndent(mixinConfig.Dashboard(), "", "  ")
+		if err != nil {
+			return err
+		}
+		return writeOutput(*output, append(b, '\n'))
+	}
+}
+
+// prepareMixinConfig validates the flags and sets the extra labels of the
+// config file.
+func prepareMixinConfig(c *mixin.Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	labels, err := fileConfig.ExtraLabels()
+	if err != nil {
+		return err
+	}
+	c.ExtraLabels = labels.Names()
+	return nil
+}
+
+func writeOutput(path string, b []byte) error {
+	if path == "-" {
+		_, err := os.Stdout.Write(b)
+		return err
+	}
+	return os.WriteFile(path, b, 0o644)
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/alecthomas/kingpin"
 	"github.com/go-kit/log"
@@ -10,10 +13,16 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
 )
 
 func registerListCommand(app *kingpin.Application, cfg *cmdsConfig) {
 	cmd := app.Command("devices", "List all devices.")
+	health := cmd.Flag("health", "Add the reporting health of each device over the health window: the reports received over the ones expected at its report interval, and the gaps between them.").
+		Bool()
+	healthWindow := cmd.Flag("health.window", "Window of data history the reporting health is computed over.").
+		Default("24h").
+		Duration()
 
 	cfg.cmdAction[cmd.FullCommand()] = func(reg *prometheus.Registry, logger log.Logger) error {
 		// setup client
@@ -27,11 +36,45 @@ func registerListCommand(app *kingpin.Application, cfg *cmdsConfig) {
 		}
 
 		fmt.Println("Devices:")
+		filtered := make(map[string]int)
 		for _, device := range devices.Devices {
+			if keep, reason := fileConfig.Selectors.Keep(device.Info); !keep {
+				filtered[reason]++
+				continue
+			}
 			fmt.Print("\t- ")
-			device.PrettyPrint(os.Stdout)
-			fmt.Println()
+			if !*health {
+				device.PrettyPrint(os.Stdout)
+				fmt.Println()
+				continue
+			}
+			var b bytes.Buffer
+			device.PrettyPrint(&b)
+			fmt.Printf("%s - %s\n\n", strings.TrimSuffix(b.String(), "\n"), deviceHealth(c, device.Info, *healthWindow))
 		}
+		for reason, n := range filtered {
+			level.Info(logger).Log("msg", "devices filtered out by the selectors", "reason", reason, "count", n)
+		}
+		return nil
+	}
+}
+
+// deviceHealth describes the reporting health of a device over the window
+// ending now.
+func deviceHealth(c *client.Client, info client.DeviceInfo, window time.Duration) string {
+	end := time.Now().UTC()
+	start := end.Add(-window)
+	var data []client.DeviceData
+	err := c.WalkDataHistory(info.MAC, start, end, func(page []client.DeviceData) error {
+		data = append(data, page...)
 		return nil
+	})
+	if err != nil {
+		return fmt.Sprintf("health unknown: %v", err)
+	}
+	h, ok := exporter.DeviceHealth(info, data, start, end)
+	if !ok {
+		return "health unknown: no report interval"
 	}
+	return h.String()
 }
@@ -8,15 +8,27 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/config"
 )
 
 type actionFunc func(*prometheus.Registry, log.Logger) error
 
 type cmdsConfig struct {
 	cmdAction map[string]actionFunc
+	// offline holds the commands not calling the API, which run without credentials.
+	offline map[string]bool
 }
 
-var apiConfig = &client.APIConfig{}
+var (
+	apiConfig = &client.APIConfig{}
+	// flagAPIConfig holds the API configuration from the flags and environment,
+	// which the credentials of the config file override.
+	flagAPIConfig client.APIConfig
+
+	configFile string
+	// fileConfig holds the content of the config file, or the defaults without one.
+	fileConfig = config.Default()
+)
 
 func main() {
 	app := kingpin.New("qingping_exporter", "A simple CLI application.")
@@ -25,12 +37,19 @@ func main() {
 
 	cfg := &cmdsConfig{
 		cmdAction: make(map[string]actionFunc),
+		offline:   make(map[string]bool),
 	}
 
 	apiConfig.BindFlags(app)
+	app.Flag("config.file", "YAML configuration file with credentials, sync settings and per-device overrides. The run command reloads it on SIGHUP or a POST to "+config.ReloadPath+".").
+		ExistingFileVar(&configFile)
 
 	registerListCommand(app, cfg)
 	registerRunCommand(app, cfg)
+	registerBackfillCommand(app, cfg)
+	registerExportCommand(app, cfg)
+	registerRulesCommand(app, cfg)
+	registerDashboardCommand(app, cfg)
 
 	cmd, err := app.Parse(os.Args[1:])
 
@@ -38,6 +57,18 @@ func main() {
 		kingpin.Fatalf("error: %s", err)
 	}
 
+	flagAPIConfig = *apiConfig
+	if configFile != "" {
+		fileConfig, err = config.Load(configFile)
+		if err != nil {
+			kingpin.Fatalf("error: %s", err)
+		}
+		*apiConfig = fileConfig.APIConfig(flagAPIConfig)
+	}
+	if err := apiConfig.Validate(); err != nil && !cfg.offline[cmd] {
+		kingpin.Fatalf("error: %s", err)
+	}
+
 	logger := log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr))
 	reg := prometheus.NewRegistry()
 
@@ -0,0 +1,355 @@
+// Package alert evaluates threshold rules over the device readings and sends
+// notifications to webhooks, Slack-compatible webhooks or email when they fire
+// and resolve, without the need for Prometheus and Alertmanager.
+package alert
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+)
+
+// Statuses of an alert.
+const (
+	StatusFiring   = "firing"
+	StatusResolved = "resolved"
+)
+
+const (
+	// queueSize is the number of notifications waiting to be sent.
+	queueSize = 256
+	// notifyTimeout bounds the time spent sending a notification.
+	notifyTimeout = 30 * time.Second
+	// replaySlack is how long before the start of the manager readings are
+	// still notified, as they take time to reach the exporter.
+	replaySlack = 5 * time.Minute
+)
+
+// Alert is the content of a notification.
+type Alert struct {
+	Rule       string            `json:"rule"`
+	Status     string            `json:"status"`
+	DeviceMAC  string            `json:"device_mac"`
+	DeviceName string            `json:"device_name,omitempty"`
+	Field      string            `json:"field"`
+	Value      float64           `json:"value"`
+	Threshold  float64           `json:"threshold"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	StartsAt   time.Time         `json:"starts_at"`
+	EndsAt     *time.Time        `json:"ends_at,omitempty"`
+	Summary    string            `json:"summary"`
+}
+
+// Title is a one-line description of the alert, e.g. for an email subject.
+func (a Alert) Title() string {
+	device := a.DeviceName
+	if device == "" {
+		device = a.DeviceMAC
+	}
+	status := "FIRING"
+	if a.Status == StatusResolved {
+		status = "RESOLVED"
+	}
+	return fmt.Sprintf("[%s] %s on %s", status, a.Rule, device)
+}
+
+type alertKey struct {
+	rule, mac string
+}
+
+// state tracks an alert from the first reading crossing the threshold until
+// the value is back to the clear level.
+type state struct {
+	since    time.Time
+	firing   bool
+	notified time.Time
+}
+
+type notification struct {
+	alert     Alert
+	receivers []string
+}
+
+// Manager is a sink evaluating the rules on the readings. The time of the
+// readings, not of their processing, drives the rules and silences, so data
+// received late is evaluated as it happened.
+type Manager struct {
+	logger     log.Logger
+	httpClient *http.Client
+	queue      chan notification
+	// notifyAfter is the time of the oldest reading notified. Older ones, e.g.
+	// the history fetched after a restart, only seed the alert state.
+	notifyAfter time.Time
+
+	mtx       sync.Mutex
+	config    Config
+	notifiers map[string][]Notifier
+	alerts    map[alertKey]*state
+
+	active        *prometheus.GaugeVec
+	notifications *prometheus.CounterVec
+	dropped       prometheus.Counter
+}
+
+type managerOpts struct {
+	notifyAfter time.Time
+}
+
+type Option func(*managerOpts)
+
+// WithNotifyAfter sets the time of the oldest reading notified, by default
+// shortly before the manager is created. Older readings are evaluated without
+// notification, so the excursions they contain are not notified again.
+func WithNotifyAfter(t time.Time) func(*managerOpts) {
+	return func(o *managerOpts) {
+		o.notifyAfter = t
+	}
+}
+
+// NewManager creates a manager from a validated config.
+func NewManager(c Config, reg prometheus.Registerer, logger log.Logger, opts ...Option) *Manager {
+	o := managerOpts{notifyAfter: time.Now().Add(-replaySlack)}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	m := &Manager{
+		logger:      log.With(logger, "component", "alert"),
+		httpClient:  &http.Client{Timeout: notifyTimeout},
+		queue:       make(chan notification, queueSize),
+		notifyAfter: o.notifyAfter,
+		alerts:      make(map[alertKey]*state),
+		active: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_alerts",
+			Help: "Number of active alerts, by rule and state",
+		}, []string{"rule", "state"}),
+		notifications: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "qingping_alert_notifications_total",
+			Help: "Number of alert notifications sent, by receiver, integration and result",
+		}, []string{"receiver", "integration", "result"}),
+		dropped: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "qingping_alert_notifications_dropped_total",
+			Help: "Number of alert notifications dropped because the queue was full",
+		}),
+	}
+	m.SetConfig(c)
+	return m
+}
+
+// SetConfig replaces the rules, receivers and silences, e.g. on a config
+// reload. Alerts of the rules still present keep their state, while the ones of
+// removed rules are forgotten without notification.
+func (m *Manager) SetConfig(c Config) {
+	notifiers := make(map[string][]Notifier, len(c.Receivers))
+	for i := range c.Receivers {
+		notifiers[c.Receivers[i].Name] = c.Receivers[i].notifiers(m.httpClient)
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.config = c
+	m.notifiers = notifiers
+	for key := range m.alerts {
+		if m.rule(key.rule) == nil {
+			delete(m.alerts, key)
+		}
+	}
+	m.updateMetrics()
+}
+
+func (m *Manager) Name() string {
+	return "alert"
+}
+
+// Write evaluates the rules on the readings.
+func (m *Manager) Write(_ context.Context, readings []exporter.Reading) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	for _, row := range exporter.Rows(readings) {
+		for i := range m.config.Rules {
+			r := &m.config.Rules[i]
+			if !r.matches(row.Device) {
+				continue
+			}
+			for _, reading := range row.Readings {
+				if reading.Field == r.Field {
+					m.evaluate(r, row.Device, reading.Value, row.Timestamp)
+				}
+			}
+		}
+	}
+	m.updateMetrics()
+	return nil
+}
+
+// evaluate moves the alert of the rule and device to its next state, notifying
+// the transitions unless the reading predates notifyAfter. It must be called
+// with the lock held.
+func (m *Manager) evaluate(r *Rule, info client.DeviceInfo, value float64, ts time.Time) {
+	replayed := ts.Before(m.notifyAfter)
+	key := alertKey{rule: r.Name, mac: info.MAC}
+	s, ok := m.alerts[key]
+	if !ok {
+		if !r.crossed(value) {
+			return
+		}
+		s = &state{since: ts}
+		m.alerts[key] = s
+	}
+
+	if r.cleared(value) {
+		delete(m.alerts, key)
+		// Only alerts that were notified are resolved, even when silenced, so
+		// receivers are never left with an alert that never ends.
+		if !s.notified.IsZero() && !replayed {
+			m.enqueue(r, m.newAlert(r, info, value, s, StatusResolved, ts))
+		}
+		return
+	}
+
+	if !s.firing && ts.Sub(s.since) >= r.For {
+		s.firing = true
+	}
+	// Alerts still firing when replayed readings end are notified with the
+	// first new reading.
+	if !s.firing || replayed || m.silenced(r.Name, info, ts) {
+		return
+	}
+	if s.notified.IsZero() || m.config.RepeatInterval > 0 && ts.Sub(s.notified) >= m.config.RepeatInterval {
+		s.notified = ts
+		m.enqueue(r, m.newAlert(r, info, value, s, StatusFiring, ts))
+	}
+}
+
+func (m *Manager) newAlert(r *Rule, info client.DeviceInfo, value float64, s *state, status string, ts time.Time) Alert {
+	a := Alert{
+		Rule:       r.Name,
+		Status:     status,
+		DeviceMAC:  info.MAC,
+		DeviceName: info.Name,
+		Field:      r.Field,
+		Value:      value,
+		Threshold:  r.threshold(),
+		Labels:     r.Labels,
+		StartsAt:   s.since.UTC(),
+	}
+	if status == StatusResolved {
+		end := ts.UTC()
+		a.EndsAt = &end
+	}
+
+	unit := ""
+	if f, ok := exporter.FieldByName(r.Field); ok && f.Unit != "" {
+		unit = " " + f.Unit
+	}
+	comparison := "above"
+	if r.Below != nil {
+		comparison = "below"
+	}
+	v := strconv.FormatFloat(value, 'f', -1, 64) + unit
+	threshold := strconv.FormatFloat(a.Threshold, 'f', -1, 64) + unit
+	since := a.StartsAt.Format(time.RFC3339)
+	if status == StatusFiring {
+		a.Summary = fmt.Sprintf("%s is %s, %s %s since %s.", r.Field, v, comparison, threshold, since)
+	} else {
+		a.Summary = fmt.Sprintf("%s is back to %s, after being %s %s since %s.", r.Field, v, comparison, threshold, since)
+	}
+	return a
+}
+
+// silenced reports whether the notifications of the rule and device are
+// silenced at ts. It must be called with the lock held.
+func (m *Manager) silenced(rule string, info client.DeviceInfo, ts time.Time) bool {
+	for i := range m.config.Silences {
+		if m.config.Silences[i].active(rule, info, ts) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Manager) enqueue(r *Rule, a Alert) {
+	select {
+	case m.queue <- notification{alert: a, receivers: r.Receivers}:
+	default:
+		m.dropped.Inc()
+		level.Warn(m.logger).Log("msg", "alert notification queue is full, dropping notification", "rule", a.Rule, "mac", a.DeviceMAC)
+	}
+}
+
+// rule returns the rule with the given name, or nil. It must be called with
+// the lock held.
+func (m *Manager) rule(name string) *Rule {
+	for i := range m.config.Rules {
+		if m.config.Rules[i].Name == name {
+			return &m.config.Rules[i]
+		}
+	}
+	return nil
+}
+
+// updateMetrics sets the number of alerts per rule and state. It must be
+// called with the lock held.
+func (m *Manager) updateMetrics() {
+	m.active.Reset()
+	for _, r := range m.config.Rules {
+		m.active.WithLabelValues(r.Name, "pending")
+		m.active.WithLabelValues(r.Name, StatusFiring)
+	}
+	for key, s := range m.alerts {
+		st := "pending"
+		if s.firing {
+			st = StatusFiring
+		}
+		m.active.WithLabelValues(key.rule, st).Inc()
+	}
+}
+
+// Run sends the notifications until the context is done.
+func (m *Manager) Run(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case n := <-m.queue:
+			m.notify(ctx, n)
+		}
+	}
+}
+
+func (m *Manager) notify(ctx context.Context, n notification) {
+	m.mtx.Lock()
+	targets := make(map[string][]Notifier, len(n.receivers))
+	for _, name := range n.receivers {
+		targets[name] = m.notifiers[name]
+	}
+	m.mtx.Unlock()
+
+	for _, receiver := range n.receivers {
+		for _, notifier := range targets[receiver] {
+			ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+			err := notifier.Notify(ctx, n.alert)
+			cancel()
+
+			result := "success"
+			if err != nil {
+				result = "error"
+				level.Warn(m.logger).Log("msg", "failed to send alert notification", "receiver", receiver,
+					"integration", notifier.Integration(), "rule", n.alert.Rule, "mac", n.alert.DeviceMAC, "err", err)
+			}
+			m.notifications.WithLabelValues(receiver, notifier.Integration(), result).Inc()
+		}
+	}
+}
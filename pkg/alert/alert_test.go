@@ -0,0 +1,428 @@
+package alert_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/alert"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+)
+
+var (
+	meetingRoom = client.DeviceInfo{MAC: "34CE00000000", Name: "Meeting room", Product: client.ProductInfo{Code: exporter.DeviceModel}}
+	office      = client.DeviceInfo{MAC: "34CE00000001", Name: "Office", Product: client.ProductInfo{Code: exporter.DeviceModel}}
+	start       = time.Date(2024, 9, 19, 10, 0, 0, 0, time.UTC)
+)
+
+func co2(info client.DeviceInfo, minutes int, value float64) []exporter.Reading {
+	ts := start.Add(time.Duration(minutes) * time.Minute)
+	return exporter.NewReadings(info, []client.DeviceData{{Timestamp: client.ValueData{Value: float64(ts.Unix())}, CO2: client.ValueData{Value: value}}})
+}
+
+func parseConfig(t *testing.T, content string) alert.Config {
+	t.Helper()
+	var c alert.Config
+	require.NoError(t, yaml.Unmarshal([]byte(content), &c))
+	require.NoError(t, c.Validate())
+	return c
+}
+
+// webhookStub collects the alerts posted to it.
+func webhookStub(t *testing.T) (string, <-chan alert.Alert) {
+	t.Helper()
+	alerts := make(chan alert.Alert, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a alert.Alert
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		alerts <- a
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, alerts
+}
+
+func run(t *testing.T, m *alert.Manager) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = m.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// expect waits for the next alert, or asserts that none is sent when status is empty.
+func expect(t *testing.T, alerts <-chan alert.Alert, status string) alert.Alert {
+	t.Helper()
+	if status == "" {
+		select {
+		case a := <-alerts:
+			t.Fatalf("unexpected alert %s", a.Title())
+		case <-time.After(50 * time.Millisecond):
+		}
+		return alert.Alert{}
+	}
+	select {
+	case a := <-alerts:
+		require.Equal(t, status, a.Status, a.Title())
+		return a
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %s alert", status)
+		return alert.Alert{}
+	}
+}
+
+func TestManager(t *testing.T) {
+	url, alerts := webhookStub(t)
+	c := parseConfig(t, `
+rules:
+  - name: HighCO2
+    field: co2
+    above: 1200
+    clear: 1000
+    for: 10m
+    devices: [{name: Meeting.*}]
+    receivers: [owner]
+    labels: {severity: warning}
+receivers:
+  - name: owner
+    webhook: {url: `+url+`}
+`)
+	m := alert.NewManager(c, prometheus.NewRegistry(), log.NewNopLogger(), alert.WithNotifyAfter(start))
+	run(t, m)
+	write := func(readings []exporter.Reading) {
+		require.NoError(t, m.Write(context.Background(), readings))
+	}
+
+	// Devices not selected by the rule are ignored.
+	write(co2(office, 0, 2000))
+	write(co2(office, 20, 2000))
+
+	// The threshold must be crossed for 10 minutes, including values between
+	// the threshold and the clear level.
+	write(co2(meetingRoom, 0, 1300))
+	write(co2(meetingRoom, 5, 1100))
+	expect(t, alerts, "")
+	write(co2(meetingRoom, 10, 1250))
+	a := expect(t, alerts, alert.StatusFiring)
+	assert.Equal(t, "HighCO2", a.Rule)
+	assert.Equal(t, "34CE00000000", a.DeviceMAC)
+	assert.Equal(t, 1250.0, a.Value)
+	assert.Equal(t, start, a.StartsAt)
+	assert.Equal(t, map[string]string{"severity": "warning"}, a.Labels)
+	assert.Equal(t, "[FIRING] HighCO2 on Meeting room", a.Title())
+	assert.Equal(t, "co2 is 1250 ppm, above 1200 ppm since 2024-09-19T10:00:00Z.", a.Summary)
+
+	// Firing alerts are notified once, and resolve below the clear level.
+	write(co2(meetingRoom, 15, 1400))
+	write(co2(meetingRoom, 20, 1100))
+	expect(t, alerts, "")
+	write(co2(meetingRoom, 25, 900))
+	a = expect(t, alerts, alert.StatusResolved)
+	require.NotNil(t, a.EndsAt)
+	assert.Equal(t, start.Add(25*time.Minute), *a.EndsAt)
+
+	// Pending alerts reset when the value clears.
+	write(co2(meetingRoom, 30, 1300))
+	write(co2(meetingRoom, 35, 900))
+	write(co2(meetingRoom, 45, 1300))
+	write(co2(meetingRoom, 50, 1300))
+	expect(t, alerts, "")
+}
+
+func TestManager_Replay(t *testing.T) {
+	url, alerts := webhookStub(t)
+	c := parseConfig(t, `
+rules:
+  - name: HighCO2
+    field: co2
+    above: 1200
+    for: 5m
+    receivers: [owner]
+receivers:
+  - name: owner
+    webhook: {url: `+url+`}
+`)
+	// The exporter started at 11:00 and replays the history of the last hours.
+	m := alert.NewManager(c, prometheus.NewRegistry(), log.NewNopLogger(), alert.WithNotifyAfter(start.Add(time.Hour)))
+	run(t, m)
+	write := func(readings []exporter.Reading) {
+		require.NoError(t, m.Write(context.Background(), readings))
+	}
+
+	// Excursions over before the start are not notified again.
+	write(co2(meetingRoom, 0, 1300))
+	write(co2(meetingRoom, 10, 1300))
+	write(co2(meetingRoom, 20, 900))
+	// An excursion still going on is notified with the first new reading.
+	write(co2(meetingRoom, 30, 1300))
+	write(co2(meetingRoom, 40, 1300))
+	expect(t, alerts, "")
+	write(co2(meetingRoom, 60, 1300))
+	a := expect(t, alerts, alert.StatusFiring)
+	assert.Equal(t, start.Add(30*time.Minute), a.StartsAt)
+	write(co2(meetingRoom, 70, 900))
+	expect(t, alerts, alert.StatusResolved)
+}
+
+func TestManager_SilenceAndRepeat(t *testing.T) {
+	url, alerts := webhookStub(t)
+	c := parseConfig(t, `
+rules:
+  - name: HighCO2
+    field: co2
+    above: 1200
+    receivers: [owner]
+receivers:
+  - name: owner
+    webhook: {url: `+url+`}
+silences:
+  - rules: [HighCO2]
+    starts_at: 2024-09-19T10:00:00Z
+    ends_at: 2024-09-19T11:00:00Z
+repeat_interval: 2h
+`)
+	m := alert.NewManager(c, prometheus.NewRegistry(), log.NewNopLogger(), alert.WithNotifyAfter(start))
+	run(t, m)
+	write := func(readings []exporter.Reading) {
+		require.NoError(t, m.Write(context.Background(), readings))
+	}
+
+	write(co2(meetingRoom, 0, 1300))
+	write(co2(meetingRoom, 30, 1300))
+	expect(t, alerts, "")
+	// Still firing once the silence ends.
+	write(co2(meetingRoom, 60, 1300))
+	expect(t, alerts, alert.StatusFiring)
+	write(co2(meetingRoom, 120, 1300))
+	expect(t, alerts, "")
+	write(co2(meetingRoom, 180, 1300))
+	expect(t, alerts, alert.StatusFiring)
+}
+
+func TestManager_DailySilence(t *testing.T) {
+	url, alerts := webhookStub(t)
+	c := parseConfig(t, `
+rules:
+  - name: HighCO2
+    field: co2
+    above: 1200
+    receivers: [owner]
+receivers:
+  - name: owner
+    webhook: {url: `+url+`}
+silences:
+  - devices: [{macs: [34CE00000000]}]
+    daily: {from: '22:00', to: '07:00'}
+`)
+	m := alert.NewManager(c, prometheus.NewRegistry(), log.NewNopLogger(), alert.WithNotifyAfter(start))
+	run(t, m)
+	at := func(day, hour, minute int, value float64) []exporter.Reading {
+		ts := time.Date(2024, 9, day, hour, minute, 0, 0, time.Local)
+		return exporter.NewReadings(meetingRoom, []client.DeviceData{{Timestamp: client.ValueData{Value: float64(ts.Unix())}, CO2: client.ValueData{Value: value}}})
+	}
+
+	// The window spans midnight.
+	require.NoError(t, m.Write(context.Background(), at(19, 23, 0, 1300)))
+	require.NoError(t, m.Write(context.Background(), at(20, 6, 59, 1300)))
+	expect(t, alerts, "")
+	require.NoError(t, m.Write(context.Background(), at(20, 7, 0, 1300)))
+	expect(t, alerts, alert.StatusFiring)
+}
+
+// smtpStub accepts a single mail and returns its data.
+func smtpStub(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	mails := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { _, _ = io.WriteString(conn, s+"\r\n") }
+
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch strings.ToUpper(strings.Fields(line)[0]) {
+			case "EHLO", "HELO":
+				reply("250 localhost")
+			case "DATA":
+				reply("354 end data with <CR><LF>.<CR><LF>")
+				var data strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				mails <- data.String()
+				reply("250 OK")
+			case "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+	return l.Addr().String(), mails
+}
+
+func TestManager_SlackAndEmail(t *testing.T) {
+	messages := make(chan string, 1)
+	slack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Text    string `json:"text"`
+			Channel string `json:"channel"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, "#facilities", body.Channel)
+		messages <- body.Text
+	}))
+	defer slack.Close()
+	smarthost, mails := smtpStub(t)
+
+	c := parseConfig(t, `
+rules:
+  - name: LowBattery
+    field: battery
+    below: 20
+    receivers: [facilities]
+receivers:
+  - name: facilities
+    slack: {url: `+slack.URL+`, channel: '#facilities'}
+    email: {to: [facilities@example.com], from: exporter@example.com, smarthost: `+smarthost+`}
+`)
+	reg := prometheus.NewRegistry()
+	m := alert.NewManager(c, reg, log.NewNopLogger(), alert.WithNotifyAfter(start))
+	run(t, m)
+	require.NoError(t, m.Write(context.Background(), exporter.NewReadings(meetingRoom, []client.DeviceData{
+		{Timestamp: client.ValueData{Value: float64(start.Unix())}, Battery: client.ValueData{Value: 15}},
+	})))
+
+	select {
+	case text := <-messages:
+		assert.Equal(t, ":rotating_light: *[FIRING] LowBattery on Meeting room*\nbattery is 15 percent, below 20 percent since 2024-09-19T10:00:00Z.", text)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no slack message")
+	}
+	select {
+	case mail := <-mails:
+		assert.Contains(t, mail, "To: facilities@example.com\r\n")
+		assert.Contains(t, mail, "Subject: [FIRING] LowBattery on Meeting room\r\n")
+		assert.Contains(t, mail, "battery is 15 percent")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email")
+	}
+}
+
+func TestManager_EmailSubject(t *testing.T) {
+	smarthost, mails := smtpStub(t)
+	c := parseConfig(t, `
+rules:
+  - name: LowBattery
+    field: battery
+    below: 20
+    receivers: [facilities]
+receivers:
+  - name: facilities
+    email: {to: [facilities@example.com], from: exporter@example.com, smarthost: `+smarthost+`}
+`)
+	m := alert.NewManager(c, prometheus.NewRegistry(), log.NewNopLogger(), alert.WithNotifyAfter(start))
+	run(t, m)
+	info := client.DeviceInfo{MAC: "34CE00000002", Name: "会议室\r\nBcc: attacker@example.com", Product: client.ProductInfo{Code: exporter.DeviceModel}}
+	require.NoError(t, m.Write(context.Background(), exporter.NewReadings(info, []client.DeviceData{
+		{Timestamp: client.ValueData{Value: float64(start.Unix())}, Battery: client.ValueData{Value: 15}},
+	})))
+
+	select {
+	case mail := <-mails:
+		assert.NotContains(t, mail, "\r\nBcc:")
+		var subject string
+		for _, line := range strings.Split(mail, "\r\n") {
+			if strings.HasPrefix(line, "Subject: ") {
+				subject = strings.TrimPrefix(line, "Subject: ")
+			}
+		}
+		assert.NotContains(t, subject, "会议室")
+		decoded, err := new(mime.WordDecoder).DecodeHeader(subject)
+		require.NoError(t, err)
+		assert.Equal(t, "[FIRING] LowBattery on 会议室  Bcc: attacker@example.com", decoded)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email")
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	receivers := `
+receivers:
+  - name: owner
+    webhook: {url: 'http://localhost/hook'}
+`
+	for _, tc := range []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{name: "unknown field", content: "rules: [{name: a, field: tvoc, above: 1, receivers: [owner]}]", err: `unknown field "tvoc"`},
+		{name: "no threshold", content: "rules: [{name: a, field: co2, receivers: [owner]}]", err: "exactly one of above and below"},
+		{name: "bad clear", content: "rules: [{name: a, field: co2, above: 1000, clear: 1100, receivers: [owner]}]", err: "clear must not be greater"},
+		{name: "unknown receiver", content: "rules: [{name: a, field: co2, above: 1, receivers: [nobody]}]", err: `unknown receiver "nobody"`},
+		{name: "duplicate rule", content: "rules: [{name: a, field: co2, above: 1, receivers: [owner]}, {name: a, field: co2, below: 1, receivers: [owner]}]", err: "duplicate name"},
+		{name: "bad selector", content: "rules: [{name: a, field: co2, above: 1, receivers: [owner], devices: [{}]}]", err: "devices[0]"},
+		{name: "no integration", content: "receivers: [{name: b}]", err: "at least one of webhook, slack and email"},
+		{name: "relative url", content: "receivers: [{name: b, slack: {url: /hook}}]", err: "absolute http or https URL"},
+		{name: "bad smarthost", content: "receivers: [{name: b, email: {to: [a@example.com], from: b@example.com, smarthost: localhost}}]", err: "smarthost"},
+		{name: "silence without window", content: "silences: [{rules: []}]", err: "exactly one of ends_at and daily"},
+		{name: "bad daily window", content: "silences: [{daily: {from: '22:00', to: 7am}}]", err: "invalid time of day"},
+		{name: "unknown silenced rule", content: "silences: [{rules: [a], daily: {from: '22:00', to: '07:00'}}]", err: `unknown rule "a"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var c alert.Config
+			content := tc.content
+			if !strings.HasPrefix(content, "receivers") {
+				content += receivers
+			}
+			require.NoError(t, yaml.Unmarshal([]byte(content), &c))
+			err := c.Validate()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.err)
+		})
+	}
+}
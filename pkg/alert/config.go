@@ -0,0 +1,334 @@
+package alert
+
+import (
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+)
+
+// Config holds the alerting rules, where their notifications are sent and
+// when they are silenced.
+type Config struct {
+	Rules     []Rule     `yaml:"rules,omitempty"`
+	Receivers []Receiver `yaml:"receivers,omitempty"`
+	Silences  []Silence  `yaml:"silences,omitempty"`
+	// RepeatInterval is how often the notification of a firing alert is sent
+	// again. Notifications are only sent once when zero.
+	RepeatInterval time.Duration `yaml:"repeat_interval,omitempty"`
+}
+
+// Rule fires when a field of a device crosses a threshold for a while.
+type Rule struct {
+	Name  string `yaml:"name"`
+	Field string `yaml:"field"`
+	// Exactly one of Above and Below is set.
+	Above *float64 `yaml:"above,omitempty"`
+	Below *float64 `yaml:"below,omitempty"`
+	// Clear is the value the field must get back to for the alert to
+	// resolve, defaulting to the threshold. Setting it further than the
+	// threshold avoids notifications for values oscillating around it.
+	Clear *float64 `yaml:"clear,omitempty"`
+	// For is how long the threshold must be crossed before the alert fires.
+	For time.Duration `yaml:"for,omitempty"`
+	// Devices selects the devices the rule applies to, all when empty.
+	Devices   []exporter.DeviceSelector `yaml:"devices,omitempty"`
+	Receivers []string                  `yaml:"receivers"`
+	// Labels are added to the notifications, e.g. a severity.
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+// Receiver sends notifications to any of its set integrations.
+type Receiver struct {
+	Name    string         `yaml:"name"`
+	Webhook *WebhookConfig `yaml:"webhook,omitempty"`
+	Slack   *SlackConfig   `yaml:"slack,omitempty"`
+	Email   *EmailConfig   `yaml:"email,omitempty"`
+}
+
+// WebhookConfig posts every notification as a JSON Alert.
+type WebhookConfig struct {
+	URL string `yaml:"url"`
+}
+
+// SlackConfig posts notifications to a Slack-compatible incoming webhook.
+type SlackConfig struct {
+	URL      string `yaml:"url"`
+	Channel  string `yaml:"channel,omitempty"`
+	Username string `yaml:"username,omitempty"`
+}
+
+// EmailConfig sends notifications over SMTP. STARTTLS is used when the server
+// supports it.
+type EmailConfig struct {
+	To []string `yaml:"to"`
+	// From is the sender address.
+	From string `yaml:"from"`
+	// Smarthost is the host:port of the SMTP server.
+	Smarthost    string `yaml:"smarthost"`
+	Username     string `yaml:"username,omitempty"`
+	Password     string `yaml:"password,omitempty"`
+	PasswordFile string `yaml:"password_file,omitempty"`
+}
+
+// Silence suppresses the notifications of the matching alerts, either
+// between two times or every day between two times of the day.
+type Silence struct {
+	// Rules are the names of the silenced rules, all when empty.
+	Rules []string `yaml:"rules,omitempty"`
+	// Devices selects the silenced devices, all when empty.
+	Devices  []exporter.DeviceSelector `yaml:"devices,omitempty"`
+	StartsAt time.Time                 `yaml:"starts_at,omitempty"`
+	EndsAt   time.Time                 `yaml:"ends_at,omitempty"`
+	Daily    *DailyWindow              `yaml:"daily,omitempty"`
+}
+
+// DailyWindow is a time range of every day in the local time zone, e.g. from
+// "22:00" to "07:00".
+type DailyWindow struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+}
+
+const timeOfDayLayout = "15:04"
+
+// Validate checks the rules, receivers and silences, and compiles their
+// device selectors.
+func (c *Config) Validate() error {
+	if c.RepeatInterval < 0 {
+		return errors.New("repeat_interval must not be negative")
+	}
+
+	receivers := make(map[string]struct{}, len(c.Receivers))
+	for i := range c.Receivers {
+		r := &c.Receivers[i]
+		if err := r.validate(); err != nil {
+			return errors.Wrapf(err, "receivers[%d]", i)
+		}
+		if _, ok := receivers[r.Name]; ok {
+			return errors.Newf("receivers[%d]: duplicate name %q", i, r.Name)
+		}
+		receivers[r.Name] = struct{}{}
+	}
+
+	rules := make(map[string]struct{}, len(c.Rules))
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		if err := r.validate(receivers); err != nil {
+			return errors.Wrapf(err, "rules[%d]", i)
+		}
+		if _, ok := rules[r.Name]; ok {
+			return errors.Newf("rules[%d]: duplicate name %q", i, r.Name)
+		}
+		rules[r.Name] = struct{}{}
+	}
+
+	for i := range c.Silences {
+		if err := c.Silences[i].validate(rules); err != nil {
+			return errors.Wrapf(err, "silences[%d]", i)
+		}
+	}
+	return nil
+}
+
+// ResolveFiles reads the password files, relative to dir.
+func (c *Config) ResolveFiles(dir string) error {
+	for i, r := range c.Receivers {
+		if r.Email == nil || r.Email.PasswordFile == "" {
+			continue
+		}
+		path := r.Email.PasswordFile
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return errors.Wrapf(err, "receivers[%d]: email: password_file", i)
+		}
+		r.Email.Password = strings.TrimSpace(string(b))
+	}
+	return nil
+}
+
+func (r *Rule) validate(receivers map[string]struct{}) error {
+	if r.Name == "" {
+		return errors.New("name must be set")
+	}
+	if _, ok := exporter.FieldByName(r.Field); !ok {
+		return errors.Newf("unknown field %q", r.Field)
+	}
+	if (r.Above == nil) == (r.Below == nil) {
+		return errors.New("exactly one of above and below must be set")
+	}
+	if r.Clear != nil {
+		if r.Above != nil && *r.Clear > *r.Above {
+			return errors.Newf("clear must not be greater than above, got %g", *r.Clear)
+		}
+		if r.Below != nil && *r.Clear < *r.Below {
+			return errors.Newf("clear must not be less than below, got %g", *r.Clear)
+		}
+	}
+	if r.For < 0 {
+		return errors.New("for must not be negative")
+	}
+	for i := range r.Devices {
+		if err := r.Devices[i].Validate(); err != nil {
+			return errors.Wrapf(err, "devices[%d]", i)
+		}
+	}
+	if len(r.Receivers) == 0 {
+		return errors.New("at least one receiver must be set")
+	}
+	for _, name := range r.Receivers {
+		if _, ok := receivers[name]; !ok {
+			return errors.Newf("unknown receiver %q", name)
+		}
+	}
+	return nil
+}
+
+// threshold returns the value the field must cross for the alert to fire.
+func (r *Rule) threshold() float64 {
+	if r.Above != nil {
+		return *r.Above
+	}
+	return *r.Below
+}
+
+// crossed reports whether the value crosses the threshold.
+func (r *Rule) crossed(v float64) bool {
+	if r.Above != nil {
+		return v > *r.Above
+	}
+	return v < *r.Below
+}
+
+// cleared reports whether the value is back to the clear level.
+func (r *Rule) cleared(v float64) bool {
+	level := r.threshold()
+	if r.Clear != nil {
+		level = *r.Clear
+	}
+	if r.Above != nil {
+		return v <= level
+	}
+	return v >= level
+}
+
+// matches reports whether the rule applies to the device.
+func (r *Rule) matches(info client.DeviceInfo) bool {
+	return matchesAny(r.Devices, info)
+}
+
+func matchesAny(selectors []exporter.DeviceSelector, info client.DeviceInfo) bool {
+	if len(selectors) == 0 {
+		return true
+	}
+	for i := range selectors {
+		if selectors[i].Matches(info) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Receiver) validate() error {
+	if r.Name == "" {
+		return errors.New("name must be set")
+	}
+	if r.Webhook == nil && r.Slack == nil && r.Email == nil {
+		return errors.New("at least one of webhook, slack and email must be set")
+	}
+	if r.Webhook != nil {
+		if err := validateURL(r.Webhook.URL); err != nil {
+			return errors.Wrap(err, "webhook")
+		}
+	}
+	if r.Slack != nil {
+		if err := validateURL(r.Slack.URL); err != nil {
+			return errors.Wrap(err, "slack")
+		}
+	}
+	if e := r.Email; e != nil {
+		if len(e.To) == 0 || e.From == "" {
+			return errors.New("email: to and from must be set")
+		}
+		if _, _, err := net.SplitHostPort(e.Smarthost); err != nil {
+			return errors.Wrap(err, "email: smarthost")
+		}
+		if e.Password != "" && e.PasswordFile != "" {
+			return errors.New("email: at most one of password and password_file can be set")
+		}
+	}
+	return nil
+}
+
+func validateURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return errors.Wrap(err, "url")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return errors.Newf("url must be an absolute http or https URL, got %q", s)
+	}
+	return nil
+}
+
+func (s *Silence) validate(rules map[string]struct{}) error {
+	for _, name := range s.Rules {
+		if _, ok := rules[name]; !ok {
+			return errors.Newf("unknown rule %q", name)
+		}
+	}
+	for i := range s.Devices {
+		if err := s.Devices[i].Validate(); err != nil {
+			return errors.Wrapf(err, "devices[%d]", i)
+		}
+	}
+	if (s.EndsAt.IsZero()) == (s.Daily == nil) {
+		return errors.New("exactly one of ends_at and daily must be set")
+	}
+	if !s.StartsAt.IsZero() && !s.EndsAt.IsZero() && !s.StartsAt.Before(s.EndsAt) {
+		return errors.New("starts_at must be before ends_at")
+	}
+	if s.Daily != nil {
+		for _, v := range []string{s.Daily.From, s.Daily.To} {
+			if _, err := time.Parse(timeOfDayLayout, v); err != nil {
+				return errors.Newf("daily: invalid time of day %q, expected HH:MM", v)
+			}
+		}
+	}
+	return nil
+}
+
+// active reports whether the silence applies to the rule and device at t.
+func (s *Silence) active(rule string, info client.DeviceInfo, t time.Time) bool {
+	if len(s.Rules) > 0 && !slices.Contains(s.Rules, rule) {
+		return false
+	}
+	if !matchesAny(s.Devices, info) {
+		return false
+	}
+	if s.Daily == nil {
+		return (s.StartsAt.IsZero() || !t.Before(s.StartsAt)) && t.Before(s.EndsAt)
+	}
+
+	from, _ := time.Parse(timeOfDayLayout, s.Daily.From)
+	to, _ := time.Parse(timeOfDayLayout, s.Daily.To)
+	local := t.Local()
+	minute := local.Hour()*60 + local.Minute()
+	start, end := from.Hour()*60+from.Minute(), to.Hour()*60+to.Minute()
+	if start <= end {
+		return minute >= start && minute < end
+	}
+	// The window spans midnight.
+	return minute >= start || minute < end
+}
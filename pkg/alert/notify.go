@@ -0,0 +1,175 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+)
+
+// Notifier sends alert notifications to an integration.
+type Notifier interface {
+	// Integration names the kind of notifier in metrics and logs, e.g. "slack".
+	Integration() string
+	Notify(ctx context.Context, a Alert) error
+}
+
+// notifiers returns the notifiers of the receiver's integrations.
+func (r *Receiver) notifiers(httpClient *http.Client) []Notifier {
+	var out []Notifier
+	if r.Webhook != nil {
+		out = append(out, &webhookNotifier{url: r.Webhook.URL, client: httpClient})
+	}
+	if r.Slack != nil {
+		out = append(out, &slackNotifier{config: *r.Slack, client: httpClient})
+	}
+	if r.Email != nil {
+		out = append(out, &emailNotifier{config: *r.Email})
+	}
+	return out
+}
+
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *webhookNotifier) Integration() string { return "webhook" }
+
+func (n *webhookNotifier) Notify(ctx context.Context, a Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return errors.Wrap(err, "encode alert")
+	}
+	return post(ctx, n.client, n.url, body)
+}
+
+type slackNotifier struct {
+	config SlackConfig
+	client *http.Client
+}
+
+func (n *slackNotifier) Integration() string { return "slack" }
+
+func (n *slackNotifier) Notify(ctx context.Context, a Alert) error {
+	emoji := ":rotating_light:"
+	if a.Status == StatusResolved {
+		emoji = ":white_check_mark:"
+	}
+	body, err := json.Marshal(struct {
+		Text     string `json:"text"`
+		Channel  string `json:"channel,omitempty"`
+		Username string `json:"username,omitempty"`
+	}{
+		Text:     emoji + " *" + a.Title() + "*\n" + a.Summary,
+		Channel:  n.config.Channel,
+		Username: n.config.Username,
+	})
+	if err != nil {
+		return errors.Wrap(err, "encode message")
+	}
+	return post(ctx, n.client, n.config.URL, body)
+}
+
+func post(ctx context.Context, client *http.Client, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return errors.Newf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+type emailNotifier struct {
+	config EmailConfig
+}
+
+func (n *emailNotifier) Integration() string { return "email" }
+
+func (n *emailNotifier) Notify(ctx context.Context, a Alert) error {
+	host, _, err := net.SplitHostPort(n.config.Smarthost)
+	if err != nil {
+		return err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", n.config.Smarthost)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return errors.Wrap(err, "starttls")
+		}
+	}
+	if n.config.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", n.config.Username, n.config.Password, host)); err != nil {
+			return errors.Wrap(err, "auth")
+		}
+	}
+	if err := c.Mail(n.config.From); err != nil {
+		return err
+	}
+	for _, to := range n.config.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(n.message(a)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func (n *emailNotifier) message(a Alert) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", n.config.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(n.config.To, ", "))
+	// The title contains the device name set in the Qingping app, which can be
+	// any text: line breaks would inject headers and non-ASCII text must be
+	// encoded.
+	subject := strings.NewReplacer("\r", " ", "\n", " ").Replace(a.Title())
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(a.Summary, "\n", "\r\n"))
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
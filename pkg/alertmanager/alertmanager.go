@@ -0,0 +1,352 @@
+// Package alertmanager pushes alerts on the state of the devices, such as a
+// device being offline, to the API of Alertmanager, for setups running
+// Alertmanager without Prometheus rules.
+package alertmanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+)
+
+// Names of the pushed alerts.
+const (
+	AlertDeviceOffline = "QingpingDeviceOffline"
+	AlertBatteryLow    = "QingpingBatteryLow"
+	AlertDataStale     = "QingpingDataStale"
+)
+
+var alertNames = []string{AlertDeviceOffline, AlertBatteryLow, AlertDataStale}
+
+// AlertsPath is the path of the Alertmanager API receiving alerts.
+const AlertsPath = "/api/v2/alerts"
+
+const (
+	// resolvedRetention is how long resolved alerts keep being pushed, so
+	// Alertmanager gets them despite failed pushes.
+	resolvedRetention = 15 * time.Minute
+	// pushTimeout bounds the time spent pushing to an Alertmanager.
+	pushTimeout = 10 * time.Second
+)
+
+// Config holds the Alertmanager settings.
+type Config struct {
+	URLs     []string
+	Interval time.Duration
+	// Conditions the alerts fire on.
+	Offline      bool
+	BatteryBelow float64
+	StaleAfter   time.Duration
+	// Labels are added to every alert.
+	Labels map[string]string
+	// ExtraLabels are added to the alerts of the devices, set from the config
+	// file before validation.
+	ExtraLabels *exporter.ExtraLabels
+}
+
+func (c *Config) BindFlags(cmd *kingpin.CmdClause) {
+	cmd.Flag("alertmanager.url", "URL of an Alertmanager to push device alerts to, e.g. http://localhost:9093. Can be repeated. Disabled when not set.").
+		StringsVar(&c.URLs)
+
+	cmd.Flag("alertmanager.interval", "Interval between evaluations of the device alerts, which are pushed again every time while firing.").
+		Default("1m").
+		DurationVar(&c.Interval)
+
+	cmd.Flag("alertmanager.offline", "Fire "+AlertDeviceOffline+" for the devices reported offline by the API.").
+		Default("true").
+		BoolVar(&c.Offline)
+
+	cmd.Flag("alertmanager.battery-below", "Fire "+AlertBatteryLow+" when the battery level of a device is below this percentage. Disabled when 0.").
+		Default("20").
+		Float64Var(&c.BatteryBelow)
+
+	cmd.Flag("alertmanager.stale-after", "Fire "+AlertDataStale+" when a device has not reported data for this long. Disabled when 0.").
+		Default("30m").
+		DurationVar(&c.StaleAfter)
+
+	cmd.Flag("alertmanager.label", "Label added to every alert, as key=value, e.g. severity=warning. Can be repeated.").
+		StringMapVar(&c.Labels)
+}
+
+// Enabled reports whether any Alertmanager was configured.
+func (c *Config) Enabled() bool {
+	return len(c.URLs) > 0
+}
+
+func (c *Config) Validate() error {
+	for _, u := range c.URLs {
+		parsed, err := url.Parse(u)
+		if err != nil || parsed.Scheme != "http" && parsed.Scheme != "https" || parsed.Host == "" {
+			return errors.Newf("--alertmanager.url must be an absolute http or https URL, got %q", u)
+		}
+	}
+	if c.Interval <= 0 {
+		return errors.New("--alertmanager.interval must be positive")
+	}
+	if c.BatteryBelow < 0 || c.BatteryBelow > 100 {
+		return errors.Newf("--alertmanager.battery-below must be between 0 and 100, got %g", c.BatteryBelow)
+	}
+	if c.StaleAfter < 0 {
+		return errors.New("--alertmanager.stale-after must not be negative")
+	}
+	// The labels identifying the alerts of a device cannot be overridden, or
+	// the alerts of all devices would share them.
+	for _, n := range append([]string{"alertname", exporter.LabelDeviceMAC, "device_name", "product_name"}, c.ExtraLabels.Names()...) {
+		if _, ok := c.Labels[n]; ok {
+			return errors.Newf("--alertmanager.label must not set the %s label of the device alerts", n)
+		}
+	}
+	return nil
+}
+
+// Alert is an alert as received by the Alertmanager API.
+type Alert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      time.Time         `json:"endsAt"`
+}
+
+// Resolved reports whether the alert ended at t.
+func (a Alert) Resolved(t time.Time) bool {
+	return !a.EndsAt.After(t)
+}
+
+type alertKey struct {
+	name, mac string
+}
+
+// DeviceLister lists the known devices, implemented by
+// exporter.AirMonitorLite.
+type DeviceLister interface {
+	Devices() []exporter.DeviceState
+}
+
+// Pusher evaluates the alert conditions on the devices and pushes the firing
+// and resolved alerts to Alertmanager.
+type Pusher struct {
+	config     Config
+	devices    DeviceLister
+	logger     log.Logger
+	httpClient *http.Client
+
+	mtx    sync.Mutex
+	alerts map[alertKey]*Alert
+
+	firing *prometheus.GaugeVec
+	pushes *prometheus.CounterVec
+}
+
+func NewPusher(c Config, devices DeviceLister, reg prometheus.Registerer, logger log.Logger) *Pusher {
+	p := &Pusher{
+		config:     c,
+		devices:    devices,
+		logger:     log.With(logger, "component", "alertmanager"),
+		httpClient: &http.Client{Timeout: pushTimeout},
+		alerts:     make(map[alertKey]*Alert),
+		firing: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_alertmanager_alerts",
+			Help: "Number of firing alerts pushed to Alertmanager, by alert name",
+		}, []string{"alertname"}),
+		pushes: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "qingping_alertmanager_pushes_total",
+			Help: "Number of pushes of alerts to Alertmanager, by Alertmanager and result",
+		}, []string{"alertmanager", "result"}),
+	}
+	for _, name := range alertNames {
+		p.firing.WithLabelValues(name)
+	}
+	for _, u := range c.URLs {
+		p.pushes.WithLabelValues(u, "success")
+		p.pushes.WithLabelValues(u, "error")
+	}
+	return p
+}
+
+// Run evaluates and pushes the alerts every interval until the context is done.
+func (p *Pusher) Run(ctx context.Context) error {
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+	for {
+		p.Push(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Push evaluates the alerts and pushes them to every Alertmanager. Failures
+// are logged, the alerts being pushed again on the next call.
+func (p *Pusher) Push(ctx context.Context) {
+	alerts := p.evaluate(time.Now())
+	if len(alerts) == 0 {
+		return
+	}
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		level.Error(p.logger).Log("msg", "failed to encode alerts", "err", err)
+		return
+	}
+	for _, u := range p.config.URLs {
+		result := "success"
+		if err := p.post(ctx, u, body); err != nil {
+			result = "error"
+			level.Warn(p.logger).Log("msg", "failed to push alerts", "alertmanager", u, "err", err)
+		}
+		p.pushes.WithLabelValues(u, result).Inc()
+	}
+}
+
+// evaluate updates the alerts from the state of the devices at now, and
+// returns the ones to push: the firing alerts and the recently resolved ones.
+func (p *Pusher) evaluate(now time.Time) []Alert {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	// Firing alerts are valid for a few intervals, so Alertmanager resolves
+	// them if the exporter stops pushing.
+	validUntil := now.Add(4 * p.config.Interval)
+	active := make(map[alertKey]struct{})
+	for _, d := range p.devices.Devices() {
+		for name, annotations := range p.conditions(d, now) {
+			key := alertKey{name: name, mac: d.Info.MAC}
+			active[key] = struct{}{}
+			a, ok := p.alerts[key]
+			if !ok || a.Resolved(now) {
+				a = &Alert{StartsAt: now}
+				p.alerts[key] = a
+			}
+			a.Labels = p.labels(name, d.Info)
+			a.Annotations = annotations
+			a.EndsAt = validUntil
+		}
+	}
+
+	out := make([]Alert, 0, len(p.alerts))
+	p.firing.Reset()
+	for _, name := range alertNames {
+		p.firing.WithLabelValues(name)
+	}
+	for key, a := range p.alerts {
+		if _, ok := active[key]; ok {
+			p.firing.WithLabelValues(key.name).Inc()
+		} else if !a.Resolved(now) {
+			a.EndsAt = now
+		} else if now.Sub(a.EndsAt) > resolvedRetention {
+			delete(p.alerts, key)
+			continue
+		}
+		out = append(out, *a)
+	}
+	return out
+}
+
+// conditions returns the annotations of the alerts firing for the device, by
+// alert name.
+func (p *Pusher) conditions(d exporter.DeviceState, now time.Time) map[string]map[string]string {
+	device := d.Info.Name
+	if device == "" {
+		device = d.Info.MAC
+	}
+	out := make(map[string]map[string]string)
+	if p.config.Offline && d.Info.Status.Offline {
+		out[AlertDeviceOffline] = map[string]string{
+			"summary": fmt.Sprintf("%s is offline", device),
+		}
+	}
+	if d.Last != nil {
+		if battery, ok := d.Last.Values["battery"]; ok && battery < p.config.BatteryBelow {
+			out[AlertBatteryLow] = map[string]string{
+				"summary":     fmt.Sprintf("Battery of %s is low", device),
+				"description": fmt.Sprintf("Battery is at %s%%, below %s%%.", formatFloat(battery), formatFloat(p.config.BatteryBelow)),
+				"value":       formatFloat(battery),
+			}
+		}
+	}
+	// Without a cached reading, e.g. for a device silent since before a
+	// restart, the last report of the device list is used.
+	var last time.Time
+	if d.Last != nil {
+		last = d.Last.Timestamp
+	}
+	if d.Reported != nil && d.Reported.After(last) {
+		last = *d.Reported
+	}
+	if p.config.StaleAfter > 0 && !last.IsZero() && now.Sub(last) > p.config.StaleAfter {
+		out[AlertDataStale] = map[string]string{
+			"summary":     fmt.Sprintf("No data from %s", device),
+			"description": fmt.Sprintf("Last data received at %s.", last.UTC().Format(time.RFC3339)),
+		}
+	}
+	return out
+}
+
+// labels returns the labels of an alert of a device.
+func (p *Pusher) labels(name string, info client.DeviceInfo) map[string]string {
+	labels := map[string]string{
+		"alertname":             name,
+		exporter.LabelDeviceMAC: info.MAC,
+	}
+	if info.Name != "" {
+		labels["device_name"] = info.Name
+	}
+	if info.Product.Name != "" {
+		labels["product_name"] = info.Product.Name
+	}
+	values := p.config.ExtraLabels.Values(info)
+	for i, n := range p.config.ExtraLabels.Names() {
+		if values[i] != "" {
+			labels[n] = values[i]
+		}
+	}
+	for n, v := range p.config.Labels {
+		labels[n] = v
+	}
+	return labels
+}
+
+func (p *Pusher) post(ctx context.Context, baseURL string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, pushTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(baseURL, "/")+AlertsPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return errors.Newf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,214 @@
+package alertmanager_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/alertmanager"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+)
+
+// devices is a mutable alertmanager.DeviceLister.
+type devices struct {
+	mtx    sync.Mutex
+	states []exporter.DeviceState
+}
+
+func (d *devices) Devices() []exporter.DeviceState {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.states
+}
+
+func (d *devices) set(states ...exporter.DeviceState) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.states = states
+}
+
+// alertmanagerStub records the alerts of every push.
+func alertmanagerStub(t *testing.T) (string, <-chan []alertmanager.Alert) {
+	t.Helper()
+	pushes := make(chan []alertmanager.Alert, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != alertmanager.AlertsPath {
+			http.NotFound(w, r)
+			return
+		}
+		var alerts []alertmanager.Alert
+		if err := json.NewDecoder(r.Body).Decode(&alerts); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pushes <- alerts
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, pushes
+}
+
+func byName(alerts []alertmanager.Alert) map[string]alertmanager.Alert {
+	out := make(map[string]alertmanager.Alert, len(alerts))
+	for _, a := range alerts {
+		out[a.Labels["alertname"]] = a
+	}
+	return out
+}
+
+func firing(offline, battery, stale int) string {
+	return fmt.Sprintf(`
+# HELP qingping_alertmanager_alerts Number of firing alerts pushed to Alertmanager, by alert name
+# TYPE qingping_alertmanager_alerts gauge
+qingping_alertmanager_alerts{alertname="QingpingBatteryLow"} %d
+qingping_alertmanager_alerts{alertname="QingpingDataStale"} %d
+qingping_alertmanager_alerts{alertname="QingpingDeviceOffline"} %d
+`, battery, stale, offline)
+}
+
+func TestPusher(t *testing.T) {
+	url, pushes := alertmanagerStub(t)
+	labels, err := exporter.NewExtraLabels(map[string]string{"room": "{{ .GroupName }}"}, nil)
+	require.NoError(t, err)
+
+	info := client.DeviceInfo{MAC: "34CE00000000", Name: "Office", GroupName: "first floor", Product: client.ProductInfo{Name: "Air Monitor Lite"}}
+	d := &devices{}
+	reg := prometheus.NewRegistry()
+	p := alertmanager.NewPusher(alertmanager.Config{
+		URLs:         []string{url + "/"},
+		Interval:     time.Minute,
+		Offline:      true,
+		BatteryBelow: 20,
+		StaleAfter:   30 * time.Minute,
+		Labels:       map[string]string{"severity": "warning"},
+		ExtraLabels:  labels,
+	}, d, reg, log.NewNopLogger())
+
+	// No push without alerts.
+	d.set(exporter.DeviceState{Info: info, Last: &exporter.Snapshot{Timestamp: time.Now(), Values: map[string]float64{"battery": 80}}})
+	p.Push(context.Background())
+	assert.Empty(t, pushes)
+
+	offline := info
+	offline.Status.Offline = true
+	lastSeen := time.Now().Add(-time.Hour)
+	d.set(exporter.DeviceState{Info: offline, Last: &exporter.Snapshot{Timestamp: lastSeen, Values: map[string]float64{"battery": 12}}})
+	p.Push(context.Background())
+	alerts := byName(<-pushes)
+	require.Len(t, alerts, 3)
+	for _, a := range alerts {
+		assert.False(t, a.Resolved(time.Now()))
+		assert.Equal(t, "34CE00000000", a.Labels["device_mac"])
+		assert.Equal(t, "Office", a.Labels["device_name"])
+		assert.Equal(t, "Air Monitor Lite", a.Labels["product_name"])
+		assert.Equal(t, "first floor", a.Labels["room"])
+		assert.Equal(t, "warning", a.Labels["severity"])
+	}
+	assert.Equal(t, "Office is offline", alerts[alertmanager.AlertDeviceOffline].Annotations["summary"])
+	assert.Equal(t, "Battery is at 12%, below 20%.", alerts[alertmanager.AlertBatteryLow].Annotations["description"])
+	assert.Equal(t, "Last data received at "+lastSeen.UTC().Format(time.RFC3339)+".", alerts[alertmanager.AlertDataStale].Annotations["description"])
+	startsAt := alerts[alertmanager.AlertBatteryLow].StartsAt
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(firing(1, 1, 1)), "qingping_alertmanager_alerts"))
+
+	// Firing alerts are pushed again, keeping their start.
+	p.Push(context.Background())
+	alerts = byName(<-pushes)
+	require.Len(t, alerts, 3)
+	assert.True(t, startsAt.Equal(alerts[alertmanager.AlertBatteryLow].StartsAt))
+
+	// Back online with fresh data: the battery alert keeps firing, the other
+	// ones are resolved.
+	d.set(exporter.DeviceState{Info: info, Last: &exporter.Snapshot{Timestamp: time.Now(), Values: map[string]float64{"battery": 12}}})
+	p.Push(context.Background())
+	alerts = byName(<-pushes)
+	require.Len(t, alerts, 3)
+	assert.False(t, alerts[alertmanager.AlertBatteryLow].Resolved(time.Now()))
+	assert.True(t, alerts[alertmanager.AlertDeviceOffline].Resolved(time.Now()))
+	assert.True(t, alerts[alertmanager.AlertDataStale].Resolved(time.Now()))
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(firing(0, 1, 0)), "qingping_alertmanager_alerts"))
+
+	// Resolved alerts are pushed again, still resolved.
+	p.Push(context.Background())
+	alerts = byName(<-pushes)
+	require.Len(t, alerts, 3)
+	assert.True(t, alerts[alertmanager.AlertDeviceOffline].Resolved(time.Now()))
+
+	// The device is removed, e.g. filtered out: its alerts resolve.
+	d.set()
+	p.Push(context.Background())
+	alerts = byName(<-pushes)
+	assert.True(t, alerts[alertmanager.AlertBatteryLow].Resolved(time.Now()))
+}
+
+func TestPusher_NoCachedReading(t *testing.T) {
+	url, pushes := alertmanagerStub(t)
+	d := &devices{}
+	p := alertmanager.NewPusher(alertmanager.Config{URLs: []string{url}, Interval: time.Minute, BatteryBelow: 20, StaleAfter: 30 * time.Minute},
+		d, prometheus.NewRegistry(), log.NewNopLogger())
+
+	// A device silent since before a restart only has its report in the
+	// device list.
+	reported := time.Now().Add(-time.Hour)
+	d.set(exporter.DeviceState{Info: client.DeviceInfo{MAC: "34CE00000000"}, Reported: &reported})
+	p.Push(context.Background())
+	alerts := byName(<-pushes)
+	require.Len(t, alerts, 1)
+	assert.Equal(t, "Last data received at "+reported.UTC().Format(time.RFC3339)+".", alerts[alertmanager.AlertDataStale].Annotations["description"])
+
+	// The newest of the cached reading and the listed report is used.
+	d.set(exporter.DeviceState{
+		Info:     client.DeviceInfo{MAC: "34CE00000000"},
+		Last:     &exporter.Snapshot{Timestamp: time.Now(), Values: map[string]float64{}},
+		Reported: &reported,
+	})
+	p.Push(context.Background())
+	alerts = byName(<-pushes)
+	assert.True(t, alerts[alertmanager.AlertDataStale].Resolved(time.Now()))
+}
+
+func TestPusher_Disabled(t *testing.T) {
+	url, pushes := alertmanagerStub(t)
+	offline := client.DeviceInfo{MAC: "34CE00000000", Status: client.DeviceStatus{Offline: true}}
+	d := &devices{}
+	d.set(exporter.DeviceState{Info: offline, Last: &exporter.Snapshot{Timestamp: time.Now().Add(-time.Hour), Values: map[string]float64{"battery": 5}}})
+
+	p := alertmanager.NewPusher(alertmanager.Config{URLs: []string{url}, Interval: time.Minute}, d, prometheus.NewRegistry(), log.NewNopLogger())
+	p.Push(context.Background())
+	assert.Empty(t, pushes)
+}
+
+func TestConfig_Validate(t *testing.T) {
+	labels, err := exporter.NewExtraLabels(map[string]string{"room": "{{ .GroupName }}"}, nil)
+	require.NoError(t, err)
+	valid := alertmanager.Config{URLs: []string{"http://localhost:9093"}, Interval: time.Minute, BatteryBelow: 20, StaleAfter: time.Hour,
+		Labels: map[string]string{"severity": "warning"}, ExtraLabels: labels}
+	require.NoError(t, valid.Validate())
+
+	for name, mutate := range map[string]func(c *alertmanager.Config){
+		"relative url":     func(c *alertmanager.Config) { c.URLs = []string{"localhost:9093"} },
+		"zero interval":    func(c *alertmanager.Config) { c.Interval = 0 },
+		"battery over 100": func(c *alertmanager.Config) { c.BatteryBelow = 120 },
+		"negative stale":   func(c *alertmanager.Config) { c.StaleAfter = -time.Minute },
+		"alertname label":  func(c *alertmanager.Config) { c.Labels = map[string]string{"alertname": "x"} },
+		"device label":     func(c *alertmanager.Config) { c.Labels = map[string]string{"device_mac": "34CE00000000"} },
+		"extra label":      func(c *alertmanager.Config) { c.Labels = map[string]string{"room": "office"} },
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := valid
+			mutate(&c)
+			assert.Error(t, c.Validate())
+		})
+	}
+}
@@ -0,0 +1,253 @@
+// Package aqi computes air quality indices from particulate matter
+// concentrations, following the breakpoints published by several standards.
+package aqi
+
+import (
+	"math"
+	"sort"
+)
+
+// Pollutants the indices are computed from.
+const (
+	PM25 = "pm25"
+	PM10 = "pm10"
+)
+
+// Names of the supported standards.
+const (
+	StandardUSEPA     = "us_epa"
+	StandardChina     = "china_hj633"
+	StandardEUCAQI    = "eu_caqi"
+	StandardIndiaNAQI = "india_naqi"
+)
+
+// segment maps a concentration range, in µg/m³, to an index range.
+type segment struct {
+	cLo, cHi float64
+	iLo, iHi float64
+}
+
+// category is the name of the index values up to max.
+type category struct {
+	max  float64
+	name string
+}
+
+// Standard defines how concentrations are converted into an index.
+type Standard struct {
+	Name string
+	// segments holds the breakpoints of each pollutant, in ascending order.
+	segments map[string][]segment
+	// precision is the resolution each pollutant concentration is truncated
+	// to before looking up the breakpoints, if any.
+	precision map[string]float64
+	// round is applied to the interpolated sub-indices.
+	round func(float64) float64
+	// categories are in ascending order, the last one being unbounded.
+	categories []category
+}
+
+// Standards holds the supported standards by name.
+var Standards = map[string]Standard{
+	// AQI of the US EPA, with the PM2.5 breakpoints revised in 2024.
+	StandardUSEPA: {
+		Name: StandardUSEPA,
+		segments: map[string][]segment{
+			PM25: {
+				{0, 9.0, 0, 50},
+				{9.1, 35.4, 51, 100},
+				{35.5, 55.4, 101, 150},
+				{55.5, 125.4, 151, 200},
+				{125.5, 225.4, 201, 300},
+				{225.5, 325.4, 301, 500},
+			},
+			PM10: {
+				{0, 54, 0, 50},
+				{55, 154, 51, 100},
+				{155, 254, 101, 150},
+				{255, 354, 151, 200},
+				{355, 424, 201, 300},
+				{425, 604, 301, 500},
+			},
+		},
+		precision: map[string]float64{PM25: 0.1, PM10: 1},
+		round:     math.Round,
+		categories: []category{
+			{50, "good"},
+			{100, "moderate"},
+			{150, "unhealthy_for_sensitive_groups"},
+			{200, "unhealthy"},
+			{300, "very_unhealthy"},
+			{math.Inf(1), "hazardous"},
+		},
+	},
+	// IAQI of the Chinese HJ 633-2012 standard, for 24-hour averages.
+	StandardChina: {
+		Name: StandardChina,
+		segments: map[string][]segment{
+			PM25: {
+				{0, 35, 0, 50},
+				{35, 75, 50, 100},
+				{75, 115, 100, 150},
+				{115, 150, 150, 200},
+				{150, 250, 200, 300},
+				{250, 350, 300, 400},
+				{350, 500, 400, 500},
+			},
+			PM10: {
+				{0, 50, 0, 50},
+				{50, 150, 50, 100},
+				{150, 250, 100, 150},
+				{250, 350, 150, 200},
+				{350, 420, 200, 300},
+				{420, 500, 300, 400},
+				{500, 600, 400, 500},
+			},
+		},
+		precision: map[string]float64{PM25: 1, PM10: 1},
+		round:     math.Ceil,
+		categories: []category{
+			{50, "excellent"},
+			{100, "good"},
+			{150, "lightly_polluted"},
+			{200, "moderately_polluted"},
+			{300, "heavily_polluted"},
+			{math.Inf(1), "severely_polluted"},
+		},
+	},
+	// Common Air Quality Index of the CiteairII project, hourly background grid.
+	StandardEUCAQI: {
+		Name: StandardEUCAQI,
+		segments: map[string][]segment{
+			PM25: {
+				{0, 15, 0, 25},
+				{15, 30, 25, 50},
+				{30, 55, 50, 75},
+				{55, 110, 75, 100},
+			},
+			PM10: {
+				{0, 25, 0, 25},
+				{25, 50, 25, 50},
+				{50, 90, 50, 75},
+				{90, 180, 75, 100},
+			},
+		},
+		round: math.Round,
+		categories: []category{
+			{25, "very_low"},
+			{50, "low"},
+			{75, "medium"},
+			{100, "high"},
+			{math.Inf(1), "very_high"},
+		},
+	},
+	// National AQI of the Indian Central Pollution Control Board. The severe
+	// band is open-ended in the published table; it is interpolated up to
+	// 380 µg/m³ for PM2.5 and 510 µg/m³ for PM10.
+	StandardIndiaNAQI: {
+		Name: StandardIndiaNAQI,
+		segments: map[string][]segment{
+			PM25: {
+				{0, 30, 0, 50},
+				{30, 60, 50, 100},
+				{60, 90, 100, 200},
+				{90, 120, 200, 300},
+				{120, 250, 300, 400},
+				{250, 380, 400, 500},
+			},
+			PM10: {
+				{0, 50, 0, 50},
+				{50, 100, 50, 100},
+				{100, 250, 100, 200},
+				{250, 350, 200, 300},
+				{350, 430, 300, 400},
+				{430, 510, 400, 500},
+			},
+		},
+		round: math.Round,
+		categories: []category{
+			{50, "good"},
+			{100, "satisfactory"},
+			{200, "moderate"},
+			{300, "poor"},
+			{400, "very_poor"},
+			{math.Inf(1), "severe"},
+		},
+	},
+}
+
+// StandardNames returns the names of the supported standards, sorted.
+func StandardNames() []string {
+	names := make([]string, 0, len(Standards))
+	for name := range Standards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Result is the index computed from a set of concentrations.
+type Result struct {
+	// AQI is the highest of the sub-indices.
+	AQI      float64
+	Category string
+	// Dominant is the pollutant with the highest sub-index.
+	Dominant   string
+	SubIndices map[string]float64
+}
+
+// SubIndex returns the index of a single pollutant concentration in µg/m³.
+// Concentrations above the highest breakpoint are extrapolated from the last
+// segment. It returns false for unknown pollutants and negative concentrations.
+func (s Standard) SubIndex(pollutant string, c float64) (float64, bool) {
+	segments, ok := s.segments[pollutant]
+	if !ok || c < 0 || math.IsNaN(c) {
+		return 0, false
+	}
+	if p := s.precision[pollutant]; p > 0 {
+		// Adding a small epsilon avoids truncating e.g. 35.4 to 35.3999.
+		c = math.Floor(c/p+1e-9) * p
+	}
+
+	seg := segments[len(segments)-1]
+	for _, candidate := range segments {
+		if c <= candidate.cHi {
+			seg = candidate
+			break
+		}
+	}
+	return s.round((seg.iHi-seg.iLo)/(seg.cHi-seg.cLo)*(c-seg.cLo) + seg.iLo), true
+}
+
+// Category returns the name of the category of an index value.
+func (s Standard) Category(index float64) string {
+	for _, c := range s.categories {
+		if index <= c.max {
+			return c.name
+		}
+	}
+	return s.categories[len(s.categories)-1].name
+}
+
+// Compute returns the index of the given concentrations by pollutant, in µg/m³.
+func (s Standard) Compute(concentrations map[string]float64) Result {
+	r := Result{SubIndices: make(map[string]float64, len(concentrations))}
+	// Iterate in a fixed order, so ties always resolve to the same pollutant.
+	for _, pollutant := range []string{PM25, PM10} {
+		c, ok := concentrations[pollutant]
+		if !ok {
+			continue
+		}
+		index, ok := s.SubIndex(pollutant, c)
+		if !ok {
+			continue
+		}
+		r.SubIndices[pollutant] = index
+		if r.Dominant == "" || index > r.AQI {
+			r.AQI = index
+			r.Dominant = pollutant
+		}
+	}
+	r.Category = s.Category(r.AQI)
+	return r
+}
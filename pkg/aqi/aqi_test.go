@@ -0,0 +1,177 @@
+package aqi_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/aqi"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+)
+
+func TestSubIndex(t *testing.T) {
+	for _, tc := range []struct {
+		standard      string
+		pollutant     string
+		concentration float64
+		expected      float64
+		category      string
+	}{
+		// US EPA, at the published breakpoints.
+		{aqi.StandardUSEPA, aqi.PM25, 0, 0, "good"},
+		{aqi.StandardUSEPA, aqi.PM25, 9.0, 50, "good"},
+		{aqi.StandardUSEPA, aqi.PM25, 9.04, 50, "good"},
+		{aqi.StandardUSEPA, aqi.PM25, 9.1, 51, "moderate"},
+		{aqi.StandardUSEPA, aqi.PM25, 35.4, 100, "moderate"},
+		{aqi.StandardUSEPA, aqi.PM25, 35.5, 101, "unhealthy_for_sensitive_groups"},
+		{aqi.StandardUSEPA, aqi.PM25, 55.5, 151, "unhealthy"},
+		{aqi.StandardUSEPA, aqi.PM25, 125.5, 201, "very_unhealthy"},
+		{aqi.StandardUSEPA, aqi.PM25, 225.5, 301, "hazardous"},
+		{aqi.StandardUSEPA, aqi.PM25, 325.4, 500, "hazardous"},
+		{aqi.StandardUSEPA, aqi.PM25, 20, 71, "moderate"},
+		{aqi.StandardUSEPA, aqi.PM10, 54, 50, "good"},
+		{aqi.StandardUSEPA, aqi.PM10, 54.9, 50, "good"},
+		{aqi.StandardUSEPA, aqi.PM10, 55, 51, "moderate"},
+		{aqi.StandardUSEPA, aqi.PM10, 154, 100, "moderate"},
+		{aqi.StandardUSEPA, aqi.PM10, 425, 301, "hazardous"},
+		{aqi.StandardUSEPA, aqi.PM10, 604, 500, "hazardous"},
+
+		// China HJ 633-2012.
+		{aqi.StandardChina, aqi.PM25, 35, 50, "excellent"},
+		{aqi.StandardChina, aqi.PM25, 75, 100, "good"},
+		{aqi.StandardChina, aqi.PM25, 115, 150, "lightly_polluted"},
+		{aqi.StandardChina, aqi.PM25, 150, 200, "moderately_polluted"},
+		{aqi.StandardChina, aqi.PM25, 250, 300, "heavily_polluted"},
+		{aqi.StandardChina, aqi.PM25, 350, 400, "severely_polluted"},
+		{aqi.StandardChina, aqi.PM25, 500, 500, "severely_polluted"},
+		{aqi.StandardChina, aqi.PM25, 36, 52, "good"},
+		{aqi.StandardChina, aqi.PM10, 50, 50, "excellent"},
+		{aqi.StandardChina, aqi.PM10, 150, 100, "good"},
+		{aqi.StandardChina, aqi.PM10, 420, 300, "heavily_polluted"},
+		{aqi.StandardChina, aqi.PM10, 600, 500, "severely_polluted"},
+
+		// EU CAQI, hourly grid.
+		{aqi.StandardEUCAQI, aqi.PM25, 15, 25, "very_low"},
+		{aqi.StandardEUCAQI, aqi.PM25, 30, 50, "low"},
+		{aqi.StandardEUCAQI, aqi.PM25, 55, 75, "medium"},
+		{aqi.StandardEUCAQI, aqi.PM25, 110, 100, "high"},
+		{aqi.StandardEUCAQI, aqi.PM25, 165, 125, "very_high"},
+		{aqi.StandardEUCAQI, aqi.PM10, 25, 25, "very_low"},
+		{aqi.StandardEUCAQI, aqi.PM10, 90, 75, "medium"},
+		{aqi.StandardEUCAQI, aqi.PM10, 180, 100, "high"},
+
+		// India NAQI.
+		{aqi.StandardIndiaNAQI, aqi.PM25, 30, 50, "good"},
+		{aqi.StandardIndiaNAQI, aqi.PM25, 60, 100, "satisfactory"},
+		{aqi.StandardIndiaNAQI, aqi.PM25, 90, 200, "moderate"},
+		{aqi.StandardIndiaNAQI, aqi.PM25, 120, 300, "poor"},
+		{aqi.StandardIndiaNAQI, aqi.PM25, 250, 400, "very_poor"},
+		{aqi.StandardIndiaNAQI, aqi.PM25, 380, 500, "severe"},
+		{aqi.StandardIndiaNAQI, aqi.PM10, 100, 100, "satisfactory"},
+		{aqi.StandardIndiaNAQI, aqi.PM10, 250, 200, "moderate"},
+		{aqi.StandardIndiaNAQI, aqi.PM10, 430, 400, "very_poor"},
+		{aqi.StandardIndiaNAQI, aqi.PM10, 175, 150, "moderate"},
+	} {
+		std := aqi.Standards[tc.standard]
+		index, ok := std.SubIndex(tc.pollutant, tc.concentration)
+		require.True(t, ok)
+		assert.Equal(t, tc.expected, index, "%s %s %v", tc.standard, tc.pollutant, tc.concentration)
+		assert.Equal(t, tc.category, std.Category(index), "%s %s %v", tc.standard, tc.pollutant, tc.concentration)
+	}
+}
+
+func TestSubIndex_Invalid(t *testing.T) {
+	std := aqi.Standards[aqi.StandardUSEPA]
+	_, ok := std.SubIndex("co2", 400)
+	assert.False(t, ok)
+	_, ok = std.SubIndex(aqi.PM25, -1)
+	assert.False(t, ok)
+}
+
+func TestCompute(t *testing.T) {
+	r := aqi.Standards[aqi.StandardUSEPA].Compute(map[string]float64{aqi.PM25: 20, aqi.PM10: 200})
+	assert.Equal(t, 123.0, r.AQI)
+	assert.Equal(t, aqi.PM10, r.Dominant)
+	assert.Equal(t, "unhealthy_for_sensitive_groups", r.Category)
+	assert.Equal(t, map[string]float64{aqi.PM25: 71, aqi.PM10: 123}, r.SubIndices)
+}
+
+func TestSink(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	s := aqi.NewSink(aqi.Config{
+		Standards:     []string{aqi.StandardUSEPA, aqi.StandardEUCAQI},
+		AverageWindow: time.Hour,
+	}, reg)
+	info := client.DeviceInfo{MAC: "34CE00000000"}
+	row := func(ts, pm25, pm10 float64) client.DeviceData {
+		return client.DeviceData{Timestamp: client.ValueData{Value: ts}, PM25: client.ValueData{Value: pm25}, PM10: client.ValueData{Value: pm10}}
+	}
+
+	require.NoError(t, s.Write(context.Background(), exporter.NewReadings(info, []client.DeviceData{
+		row(0, 5, 10),
+		row(1800, 15, 10),
+	})))
+	// Averaged to 10 µg/m³ of PM2.5, over half of the window.
+	assert.Equal(t, 53.0, gauge(t, reg, aqi.StandardUSEPA, "moderate"))
+	assert.Equal(t, 17.0, gauge(t, reg, aqi.StandardEUCAQI, "very_low"))
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP qingping_aqi_average_span_seconds Time between the oldest and newest readings averaged into the air quality index
+# TYPE qingping_aqi_average_span_seconds gauge
+qingping_aqi_average_span_seconds{device_mac="34CE00000000"} 1800
+`), aqi.MetricAverageSpan))
+
+	// The first row leaves the window and the category changes.
+	require.NoError(t, s.Write(context.Background(), exporter.NewReadings(info, []client.DeviceData{
+		row(4000, 75, 10),
+	})))
+	assert.Equal(t, 124.0, gauge(t, reg, aqi.StandardUSEPA, "unhealthy_for_sensitive_groups"))
+	// One series per standard, the one of the previous category is gone.
+	count, err := testutil.GatherAndCount(reg, "qingping_aqi")
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// Once the readings of a device stopped for longer than the window, its
+	// next index only averages the new ones.
+	other := client.DeviceInfo{MAC: "34CE00000001"}
+	require.NoError(t, s.Write(context.Background(), exporter.NewReadings(other, []client.DeviceData{row(8000, 5, 10), row(9000, 5, 10)})))
+	require.NoError(t, s.Write(context.Background(), exporter.NewReadings(info, []client.DeviceData{row(9100, 10, 10)})))
+	assert.Equal(t, 53.0, gauge(t, reg, aqi.StandardUSEPA, "moderate"))
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP qingping_aqi_average_span_seconds Time between the oldest and newest readings averaged into the air quality index
+# TYPE qingping_aqi_average_span_seconds gauge
+qingping_aqi_average_span_seconds{device_mac="34CE00000000"} 0
+qingping_aqi_average_span_seconds{device_mac="34CE00000001"} 1000
+`), aqi.MetricAverageSpan))
+}
+
+// gauge returns the AQI of the test device for a standard and category,
+// failing if the series does not exist.
+func gauge(t *testing.T, reg *prometheus.Registry, standard, category string) float64 {
+	t.Helper()
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	for _, mf := range families {
+		if mf.GetName() != "qingping_aqi" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["standard"] == standard && labels["category"] == category {
+				return m.GetGauge().GetValue()
+			}
+		}
+	}
+	require.Failf(t, "missing series", "standard=%s category=%s", standard, category)
+	return 0
+}
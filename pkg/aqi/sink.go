@@ -0,0 +1,211 @@
+package aqi
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+)
+
+// Names of the index gauges.
+const (
+	MetricAQI         = "qingping_aqi"
+	MetricAQISubIndex = "qingping_aqi_subindex"
+	MetricAverageSpan = "qingping_aqi_average_span_seconds"
+)
+
+// Config holds the AQI settings.
+type Config struct {
+	Standards     []string
+	AverageWindow time.Duration
+	// LegacyNames also exposes the index under the air_monitor_ names, set
+	// from --metrics.legacy-names.
+	LegacyNames bool
+	// ExtraLabels are added to the index gauges, set from the config file.
+	ExtraLabels *exporter.ExtraLabels
+}
+
+func (c *Config) BindFlags(cmd *kingpin.CmdClause) {
+	cmd.Flag("aqi.standard", "Standard to compute the air quality index with. Can be repeated. Disabled when not set.").
+		EnumsVar(&c.Standards, StandardNames()...)
+
+	cmd.Flag("aqi.average-window", "Window the concentrations are averaged over before computing the index, e.g. 24h as most standards define. Uses the latest reading when 0.").
+		Default("0s").
+		DurationVar(&c.AverageWindow)
+}
+
+// Enabled reports whether any standard was configured.
+func (c *Config) Enabled() bool {
+	return len(c.Standards) > 0
+}
+
+type sample struct {
+	t      time.Time
+	values map[string]float64
+}
+
+// Sink exposes the air quality index of every device, computed from its PM2.5
+// and PM10 readings. It implements exporter.Sink.
+type Sink struct {
+	standards []Standard
+	window    time.Duration
+	labels    *exporter.ExtraLabels
+
+	// aqi and subIndex hold the gauges by name, more than one in legacy mode.
+	aqi      []*prometheus.GaugeVec
+	subIndex []*prometheus.GaugeVec
+	// span is the time between the oldest and newest samples averaged, shorter
+	// than the window until the exporter received that much data.
+	span *prometheus.GaugeVec
+
+	mtx sync.Mutex
+	// history holds the samples within the averaging window per device MAC.
+	history map[string][]sample
+}
+
+func NewSink(cfg Config, reg prometheus.Registerer) *Sink {
+	s := &Sink{
+		window:  cfg.AverageWindow,
+		labels:  cfg.ExtraLabels,
+		history: make(map[string][]sample),
+		span: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: MetricAverageSpan,
+			Help: "Time between the oldest and newest readings averaged into the air quality index",
+		}, append([]string{exporter.LabelDeviceMAC}, cfg.ExtraLabels.Names()...)),
+	}
+	aqiNames, subIndexNames := []string{MetricAQI}, []string{MetricAQISubIndex}
+	if cfg.LegacyNames {
+		aqiNames = append(aqiNames, "air_monitor_aqi")
+		subIndexNames = append(subIndexNames, "air_monitor_aqi_subindex")
+	}
+	for _, name := range aqiNames {
+		s.aqi = append(s.aqi, promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: name,
+			Help: "Air quality index, the highest of the pollutant sub-indices",
+		}, append([]string{exporter.LabelDeviceMAC, "standard", "category"}, cfg.ExtraLabels.Names()...)))
+	}
+	for _, name := range subIndexNames {
+		s.subIndex = append(s.subIndex, promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: name,
+			Help: "Air quality sub-index of a single pollutant",
+		}, append([]string{exporter.LabelDeviceMAC, "standard", "pollutant"}, cfg.ExtraLabels.Names()...)))
+	}
+	for _, name := range cfg.Standards {
+		s.standards = append(s.standards, Standards[name])
+	}
+	return s
+}
+
+func (s *Sink) Name() string {
+	return "aqi"
+}
+
+func (s *Sink) Write(_ context.Context, readings []exporter.Reading) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	updated := make(map[string]client.DeviceInfo)
+	var newest time.Time
+	for _, row := range exporter.Rows(readings) {
+		values := make(map[string]float64, 2)
+		for _, r := range row.Readings {
+			if r.Field == PM25 || r.Field == PM10 {
+				values[r.Field] = r.Value
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+		mac := row.Device.MAC
+		s.history[mac] = append(s.history[mac], sample{t: row.Timestamp, values: values})
+		updated[mac] = row.Device
+		if row.Timestamp.After(newest) {
+			newest = row.Timestamp
+		}
+	}
+	s.dropSilent(newest)
+
+	for mac, info := range updated {
+		concentrations, span := s.average(mac)
+		extra := s.labels.Values(info)
+		// The extra labels can change, so drop the previous series.
+		s.span.DeletePartialMatch(prometheus.Labels{exporter.LabelDeviceMAC: mac})
+		s.span.WithLabelValues(append([]string{mac}, extra...)...).Set(span.Seconds())
+		for _, std := range s.standards {
+			r := std.Compute(concentrations)
+			// The category and extra labels can change, so drop the previous series.
+			match := prometheus.Labels{exporter.LabelDeviceMAC: mac, "standard": std.Name}
+			for _, g := range s.aqi {
+				g.DeletePartialMatch(match)
+				g.WithLabelValues(append([]string{mac, std.Name, r.Category}, extra...)...).Set(r.AQI)
+			}
+			for _, g := range s.subIndex {
+				g.DeletePartialMatch(match)
+				for pollutant, index := range r.SubIndices {
+					g.WithLabelValues(append([]string{mac, std.Name, pollutant}, extra...)...).Set(index)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// dropSilent forgets the samples of the devices whose latest one left the
+// window ending at now, e.g. removed devices. It must be called with the lock
+// held.
+func (s *Sink) dropSilent(now time.Time) {
+	for mac, samples := range s.history {
+		if now.Sub(latest(samples)) > s.window {
+			delete(s.history, mac)
+		}
+	}
+}
+
+// average returns the mean concentrations of a device within the window ending
+// at its latest sample, and the time span of the samples averaged, dropping
+// older samples. It must be called with the lock held.
+func (s *Sink) average(mac string) (map[string]float64, time.Duration) {
+	samples := s.history[mac]
+	newest := latest(samples)
+
+	kept := samples[:0]
+	oldest := newest
+	sums := make(map[string]float64, 2)
+	counts := make(map[string]int, 2)
+	for _, smp := range samples {
+		if newest.Sub(smp.t) > s.window {
+			continue
+		}
+		if smp.t.Before(oldest) {
+			oldest = smp.t
+		}
+		kept = append(kept, smp)
+		for pollutant, v := range smp.values {
+			sums[pollutant] += v
+			counts[pollutant]++
+		}
+	}
+	s.history[mac] = kept
+
+	for pollutant, sum := range sums {
+		sums[pollutant] = sum / float64(counts[pollutant])
+	}
+	return sums, newest.Sub(oldest)
+}
+
+// latest returns the time of the newest sample.
+func latest(samples []sample) time.Time {
+	var t time.Time
+	for _, smp := range samples {
+		if smp.t.After(t) {
+			t = smp.t
+		}
+	}
+	return t
+}
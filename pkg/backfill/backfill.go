@@ -0,0 +1,146 @@
+// Package backfill writes historical device data in formats that can be
+// imported into Prometheus, using the same series as the live exporter.
+package backfill
+
+import (
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+)
+
+// Writer persists historical device data.
+// Implementations may buffer data until Close is called.
+type Writer interface {
+	// Write records the given rows for the device with the given MAC.
+	// Rows are expected in ascending timestamp order.
+	Write(mac string, data []client.DeviceData) error
+	Close() error
+}
+
+type field struct {
+	metric string
+	value  func(client.DeviceData) float64
+}
+
+type writerOpts struct {
+	legacyNames bool
+	labels      *exporter.ExtraLabels
+	devices     []client.DeviceInfo
+}
+
+type Option func(*writerOpts)
+
+// WithLegacyNames also writes the series under the legacy metric names, as the
+// exporter does with --metrics.legacy-names.
+func WithLegacyNames(legacy bool) func(*writerOpts) {
+	return func(o *writerOpts) {
+		o.legacyNames = legacy
+	}
+}
+
+// WithExtraLabels adds the extra labels to the series of the given devices,
+// as the exporter does with the labels of the config file.
+func WithExtraLabels(l *exporter.ExtraLabels, devices []client.DeviceInfo) func(*writerOpts) {
+	return func(o *writerOpts) {
+		o.labels = l
+		o.devices = devices
+	}
+}
+
+// fields returns the per-device gauges the exporter sets from a data row.
+func fields(legacy bool) []field {
+	timestamp := func(d client.DeviceData) float64 { return d.Timestamp.Value }
+
+	fields := exporter.FieldsFor(exporter.DeviceModel)
+	out := make([]field, 0, 2*len(fields)+2)
+	for _, f := range fields {
+		out = append(out, field{metric: f.Metric, value: f.Value})
+	}
+	out = append(out, field{metric: exporter.MetricLastReportTimestamp, value: timestamp})
+	if !legacy {
+		return out
+	}
+	for _, f := range fields {
+		out = append(out, field{metric: f.LegacyMetric, value: f.Value})
+	}
+	return append(out, field{metric: exporter.LegacyMetricLastReportTimestamp, value: timestamp})
+}
+
+type sample struct {
+	mac string
+	// timestamp in milliseconds.
+	t int64
+	v float64
+}
+
+// series groups the samples of every metric by device, preserving the order
+// in which devices were first written.
+type series struct {
+	fields  []field
+	macs    []string
+	samples map[string]map[string][]sample
+	// labels holds the extra labels of the devices by MAC.
+	labels map[string]labels.Labels
+}
+
+func newSeries(opts []Option) *series {
+	o := writerOpts{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	s := &series{
+		fields:  fields(o.legacyNames),
+		samples: make(map[string]map[string][]sample),
+		labels:  make(map[string]labels.Labels),
+	}
+	names := o.labels.Names()
+	for _, d := range o.devices {
+		b := labels.NewScratchBuilder(len(names))
+		for i, v := range o.labels.Values(d) {
+			// Empty labels are dropped by Prometheus on scrape too.
+			if v != "" {
+				b.Add(names[i], v)
+			}
+		}
+		b.Sort()
+		s.labels[d.MAC] = b.Labels()
+	}
+	return s
+}
+
+// seriesLabels returns the labels of the series of a metric and device.
+func (s *series) seriesLabels(metric, mac string) labels.Labels {
+	b := labels.NewBuilder(s.labels[mac])
+	b.Set(labels.MetricName, metric)
+	b.Set(exporter.LabelDeviceMAC, mac)
+	return b.Labels()
+}
+
+func (s *series) add(mac string, data []client.DeviceData) {
+	if len(data) == 0 {
+		return
+	}
+	if _, ok := s.samples[mac]; !ok {
+		s.macs = append(s.macs, mac)
+		s.samples[mac] = make(map[string][]sample)
+	}
+
+	for _, row := range data {
+		t := int64(row.Timestamp.Value) * 1000
+		for _, f := range s.fields {
+			s.samples[mac][f.metric] = append(s.samples[mac][f.metric], sample{mac: mac, t: t, v: f.value(row)})
+		}
+	}
+}
+
+// byMetric returns the samples of the given metric, grouped by device.
+func (s *series) byMetric(metric string) [][]sample {
+	out := make([][]sample, 0, len(s.macs))
+	for _, mac := range s.macs {
+		if samples := s.samples[mac][metric]; len(samples) > 0 {
+			out = append(out, samples)
+		}
+	}
+	return out
+}
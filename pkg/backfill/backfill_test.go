@@ -0,0 +1,125 @@
+package backfill_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/backfill"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+)
+
+var testRows = []client.DeviceData{
+	{
+		Timestamp:   client.ValueData{Value: 1726749900},
+		Battery:     client.ValueData{Value: 47},
+		Temperature: client.ValueData{Value: 25.6},
+		Humidity:    client.ValueData{Value: 58.3},
+		CO2:         client.ValueData{Value: 454},
+		PM25:        client.ValueData{Value: 12},
+		PM10:        client.ValueData{Value: 12},
+	},
+	{
+		Timestamp:   client.ValueData{Value: 1726750800},
+		Battery:     client.ValueData{Value: 44},
+		Temperature: client.ValueData{Value: 26.1},
+		Humidity:    client.ValueData{Value: 56},
+		CO2:         client.ValueData{Value: 452},
+		PM25:        client.ValueData{Value: 12},
+		PM10:        client.ValueData{Value: 12},
+	},
+}
+
+func TestOpenMetricsWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := backfill.NewOpenMetricsWriter(&buf)
+	require.NoError(t, w.Write("mac1", testRows[:1]))
+	require.NoError(t, w.Write("mac2", testRows))
+	require.NoError(t, w.Write("mac1", testRows[1:]))
+	require.NoError(t, w.Close())
+
+	out := buf.String()
+	assert.Contains(t, out, "# TYPE qingping_temperature_celsius gauge\n"+
+		"qingping_temperature_celsius{device_mac=\"mac1\"} 25.6 1726749900\n"+
+		"qingping_temperature_celsius{device_mac=\"mac1\"} 26.1 1726750800\n"+
+		"qingping_temperature_celsius{device_mac=\"mac2\"} 25.6 1726749900\n"+
+		"qingping_temperature_celsius{device_mac=\"mac2\"} 26.1 1726750800\n"+
+		"# TYPE qingping_relative_humidity_percent gauge\n")
+	assert.Contains(t, out, "qingping_last_report_timestamp_seconds{device_mac=\"mac2\"} 1.7267508e+09 1726750800\n")
+	assert.NotContains(t, out, "air_monitor_temperature")
+	assert.True(t, bytes.HasSuffix(buf.Bytes(), []byte("# EOF\n")))
+}
+
+func TestOpenMetricsWriter_LegacyNames(t *testing.T) {
+	var buf bytes.Buffer
+	w := backfill.NewOpenMetricsWriter(&buf, backfill.WithLegacyNames(true))
+	require.NoError(t, w.Write("mac1", testRows))
+	require.NoError(t, w.Close())
+
+	out := buf.String()
+	assert.Contains(t, out, "qingping_temperature_celsius{device_mac=\"mac1\"} 25.6 1726749900\n")
+	assert.Contains(t, out, "air_monitor_temperature{device_mac=\"mac1\"} 25.6 1726749900\n")
+	assert.Contains(t, out, "device_last_data_timestamp{device_mac=\"mac1\"} 1.7267508e+09 1726750800\n")
+}
+
+func TestOpenMetricsWriter_ExtraLabels(t *testing.T) {
+	l, err := exporter.NewExtraLabels(map[string]string{"room": "{{ .Name }}", "site": "home"}, nil)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	w := backfill.NewOpenMetricsWriter(&buf, backfill.WithExtraLabels(l, []client.DeviceInfo{{MAC: "mac1", Name: "Office"}, {MAC: "mac2"}}))
+	require.NoError(t, w.Write("mac1", testRows[:1]))
+	require.NoError(t, w.Write("mac2", testRows[:1]))
+	require.NoError(t, w.Close())
+
+	out := buf.String()
+	assert.Contains(t, out, "qingping_temperature_celsius{device_mac=\"mac1\",room=\"Office\",site=\"home\"} 25.6 1726749900\n")
+	// Empty labels are omitted.
+	assert.Contains(t, out, "qingping_temperature_celsius{device_mac=\"mac2\",site=\"home\"} 25.6 1726749900\n")
+}
+
+func TestTSDBWriter(t *testing.T) {
+	dir := t.TempDir()
+
+	w := backfill.NewTSDBWriter(dir, 0, log.NewNopLogger())
+	require.NoError(t, w.Write("mac1", testRows))
+	require.NoError(t, w.Write("mac2", []client.DeviceData{{Timestamp: client.ValueData{Value: 1726749900 + 7200}}}))
+	require.NoError(t, w.Close())
+
+	db, err := tsdb.OpenDBReadOnly(dir, "", log.NewNopLogger())
+	require.NoError(t, err)
+	defer db.Close()
+
+	blocks, err := db.Blocks()
+	require.NoError(t, err)
+	// The mac2 sample falls in the next 2h range, so two blocks are expected.
+	require.Len(t, blocks, 2)
+
+	q, err := db.Querier(0, 1726750800*1000)
+	require.NoError(t, err)
+	defer q.Close()
+
+	ss := q.Select(context.Background(), false, nil,
+		labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "qingping_co2_ppm"),
+		labels.MustNewMatcher(labels.MatchEqual, "device_mac", "mac1"),
+	)
+	require.True(t, ss.Next())
+
+	var got []float64
+	it := ss.At().Iterator(nil)
+	for it.Next() == chunkenc.ValFloat {
+		_, v := it.At()
+		got = append(got, v)
+	}
+	require.NoError(t, it.Err())
+	assert.Equal(t, []float64{454, 452}, got)
+	assert.False(t, ss.Next())
+}
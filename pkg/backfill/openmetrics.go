@@ -0,0 +1,71 @@
+package backfill
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+)
+
+// OpenMetricsWriter writes device data as an OpenMetrics text exposition,
+// suitable for `promtool tsdb create-blocks-from openmetrics`.
+// OpenMetrics requires the samples of a metric family to be contiguous, so
+// all data is buffered and written out on Close.
+type OpenMetricsWriter struct {
+	w      io.Writer
+	series *series
+}
+
+func NewOpenMetricsWriter(w io.Writer, opts ...Option) *OpenMetricsWriter {
+	return &OpenMetricsWriter{w: w, series: newSeries(opts)}
+}
+
+func (o *OpenMetricsWriter) Write(mac string, data []client.DeviceData) error {
+	o.series.add(mac, data)
+	return nil
+}
+
+func (o *OpenMetricsWriter) Close() error {
+	bw := bufio.NewWriter(o.w)
+	for _, f := range o.series.fields {
+		groups := o.series.byMetric(f.metric)
+		if len(groups) == 0 {
+			continue
+		}
+
+		_, _ = fmt.Fprintf(bw, "# TYPE %s gauge\n", f.metric)
+		for _, samples := range groups {
+			for _, s := range samples {
+				_, _ = fmt.Fprintf(bw, "%s{%s} %s %s\n",
+					f.metric,
+					o.labels(f.metric, s.mac),
+					strconv.FormatFloat(s.v, 'g', -1, 64),
+					strconv.FormatFloat(float64(s.t)/1000, 'f', -1, 64),
+				)
+			}
+		}
+	}
+	_, _ = fmt.Fprintln(bw, "# EOF")
+
+	return bw.Flush()
+}
+
+// labels formats the labels of the series of a metric and device.
+func (o *OpenMetricsWriter) labels(metric, mac string) string {
+	var b strings.Builder
+	o.series.seriesLabels(metric, mac).Range(func(l labels.Label) {
+		if l.Name == labels.MetricName {
+			return
+		}
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		_, _ = fmt.Fprintf(&b, "%s=%q", l.Name, l.Value)
+	})
+	return b.String()
+}
@@ -0,0 +1,113 @@
+package backfill
+
+import (
+	"context"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+)
+
+// TSDBWriter writes device data as Prometheus TSDB blocks into a directory.
+// Samples are split into blocks aligned to the block duration, the same way
+// promtool does, so the output can be moved straight into a Prometheus data dir.
+type TSDBWriter struct {
+	dir           string
+	blockDuration int64
+	logger        log.Logger
+	series        *series
+}
+
+// NewTSDBWriter creates a writer producing blocks in dir, each covering at most
+// blockDuration milliseconds. A zero duration uses the default Prometheus block size.
+func NewTSDBWriter(dir string, blockDuration int64, logger log.Logger, opts ...Option) *TSDBWriter {
+	if blockDuration <= 0 {
+		blockDuration = tsdb.DefaultBlockDuration
+	}
+
+	return &TSDBWriter{
+		dir:           dir,
+		blockDuration: blockDuration,
+		logger:        logger,
+		series:        newSeries(opts),
+	}
+}
+
+func (t *TSDBWriter) Write(mac string, data []client.DeviceData) error {
+	t.series.add(mac, data)
+	return nil
+}
+
+func (t *TSDBWriter) Close() error {
+	mint, maxt, ok := t.bounds()
+	if !ok {
+		return nil
+	}
+
+	ctx := context.Background()
+	for start := mint - mint%t.blockDuration; start <= maxt; start += t.blockDuration {
+		if err := t.writeBlock(ctx, start, start+t.blockDuration); err != nil {
+			return errors.Wrapf(err, "write block starting at %d", start)
+		}
+	}
+
+	return nil
+}
+
+// writeBlock writes all samples in [mint, maxt) into a single block.
+func (t *TSDBWriter) writeBlock(ctx context.Context, mint, maxt int64) (err error) {
+	w, err := tsdb.NewBlockWriter(t.logger, t.dir, t.blockDuration)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	app := w.Appender(ctx)
+	appended := 0
+	for _, f := range t.series.fields {
+		for _, samples := range t.series.byMetric(f.metric) {
+			lset := t.series.seriesLabels(f.metric, samples[0].mac)
+			for _, s := range samples {
+				if s.t < mint || s.t >= maxt {
+					continue
+				}
+				if _, err := app.Append(0, lset, s.t, s.v); err != nil {
+					return errors.Wrapf(err, "append sample for %s", lset)
+				}
+				appended++
+			}
+		}
+	}
+	if err := app.Commit(); err != nil {
+		return err
+	}
+	if appended == 0 {
+		return nil
+	}
+
+	_, err = w.Flush(ctx)
+	return err
+}
+
+func (t *TSDBWriter) bounds() (mint, maxt int64, ok bool) {
+	for _, mac := range t.series.macs {
+		for _, samples := range t.series.samples[mac] {
+			for _, s := range samples {
+				if !ok || s.t < mint {
+					mint = s.t
+				}
+				if !ok || s.t > maxt {
+					maxt = s.t
+				}
+				ok = true
+			}
+		}
+	}
+	return mint, maxt, ok
+}
@@ -0,0 +1,115 @@
+// Package battery derives the health of the device batteries from their
+// recent levels: how fast they discharge, when they will be empty, whether
+// they are charging and whether they are low.
+package battery
+
+import (
+	"time"
+)
+
+const (
+	// chargingRise is the rise of the level, in percentage points, from the
+	// lowest one of the window for the battery to be considered charging.
+	// Smaller rises are reading noise.
+	chargingRise = 3
+	// noise is the rise of the level, in percentage points, tolerated within
+	// a discharge.
+	noise = 1
+	// minSpan and minSamples are the shortest discharge the rate is derived
+	// from. The level is reported in whole percents and jumps by several
+	// points at times, so shorter discharges give unreliable rates.
+	minSpan    = 3 * time.Hour
+	minSamples = 4
+)
+
+// Sample is the battery level of a device at a time.
+type Sample struct {
+	Time  time.Time
+	Level float64
+}
+
+// Status is the health of a battery derived from its samples.
+type Status struct {
+	Level    float64
+	Charging bool
+	Low      bool
+	// DischargeRate is the decrease of the level in percentage points per
+	// hour since the battery last charged, negative when rising. It is only
+	// known when Known is set, once the discharge spans at least 3 hours and
+	// 4 samples.
+	DischargeRate float64
+	Known         bool
+	// TimeToEmpty is the estimated remaining runtime, zero unless discharging.
+	TimeToEmpty time.Duration
+}
+
+// Estimate returns the status of a battery from its samples sorted by time.
+// The battery is low below the low level.
+func Estimate(samples []Sample, low float64) Status {
+	if len(samples) == 0 {
+		return Status{}
+	}
+	last := samples[len(samples)-1]
+	s := Status{Level: last.Level, Low: last.Level < low}
+
+	// Charging when the level rose enough from the lowest one and has not
+	// dropped since.
+	lowest := 0
+	for i, smp := range samples {
+		if smp.Level <= samples[lowest].Level {
+			lowest = i
+		}
+	}
+	s.Charging = last.Level-samples[lowest].Level >= chargingRise
+	for _, smp := range samples[lowest:] {
+		if smp.Level > last.Level {
+			s.Charging = false
+		}
+	}
+	if s.Charging {
+		return s
+	}
+
+	// The discharge is the trailing run of samples without a rise, apart from
+	// the noise.
+	start := len(samples) - 1
+	for start > 0 && samples[start-1].Level >= samples[start].Level-noise {
+		start--
+	}
+	run := samples[start:]
+	if len(run) < minSamples || run[len(run)-1].Time.Sub(run[0].Time) < minSpan {
+		return s
+	}
+	rate, ok := slope(run)
+	if !ok {
+		return s
+	}
+	s.DischargeRate, s.Known = -rate, true
+	if s.DischargeRate > 0 {
+		s.TimeToEmpty = time.Duration(last.Level / s.DischargeRate * float64(time.Hour))
+	}
+	return s
+}
+
+// slope returns the slope of the least squares line through the samples, in
+// percentage points per hour, and whether the samples span any time.
+func slope(samples []Sample) (float64, bool) {
+	if len(samples) < 2 || !samples[len(samples)-1].Time.After(samples[0].Time) {
+		return 0, false
+	}
+	origin := samples[0].Time
+	var sumX, sumY float64
+	for _, smp := range samples {
+		sumX += smp.Time.Sub(origin).Hours()
+		sumY += smp.Level
+	}
+	n := float64(len(samples))
+	meanX, meanY := sumX/n, sumY/n
+	var num, den float64
+	for _, smp := range samples {
+		dx := smp.Time.Sub(origin).Hours() - meanX
+		num += dx * (smp.Level - meanY)
+		den += dx * dx
+	}
+	return num / den, true
+}
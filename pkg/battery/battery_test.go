@@ -0,0 +1,166 @@
+package battery_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/battery"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+)
+
+var start = time.Date(2024, 9, 19, 12, 0, 0, 0, time.UTC)
+
+// samples returns one sample of each level, every step.
+func samples(step time.Duration, levels ...float64) []battery.Sample {
+	out := make([]battery.Sample, 0, len(levels))
+	for i, l := range levels {
+		out = append(out, battery.Sample{Time: start.Add(time.Duration(i) * step), Level: l})
+	}
+	return out
+}
+
+func TestEstimate(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		samples  []battery.Sample
+		expected battery.Status
+	}{
+		{
+			name:     "no sample",
+			expected: battery.Status{},
+		},
+		{
+			name:     "single sample",
+			samples:  samples(time.Hour, 44),
+			expected: battery.Status{Level: 44},
+		},
+		{
+			// The drop of the history testdata, 3 points in 15 minutes, is too
+			// short to derive a rate from.
+			name:     "short discharge",
+			samples:  samples(15*time.Minute, 47, 44),
+			expected: battery.Status{Level: 44},
+		},
+		{
+			name:     "few samples",
+			samples:  samples(3*time.Hour, 50, 47, 44),
+			expected: battery.Status{Level: 44},
+		},
+		{
+			name:     "discharging",
+			samples:  samples(time.Hour, 50, 49, 48, 47),
+			expected: battery.Status{Level: 47, DischargeRate: 1, Known: true, TimeToEmpty: 47 * time.Hour},
+		},
+		{
+			name:     "discharging with noise",
+			samples:  samples(time.Hour, 50, 49, 50, 48, 47),
+			expected: battery.Status{Level: 47, DischargeRate: 0.7, Known: true, TimeToEmpty: 47 * time.Hour * 10 / 7},
+		},
+		{
+			name:     "charging",
+			samples:  samples(15*time.Minute, 12, 10, 15, 22),
+			expected: battery.Status{Level: 22, Charging: true},
+		},
+		{
+			// Only the samples since the charge are used.
+			name:     "discharging after a charge",
+			samples:  samples(time.Hour, 30, 20, 90, 100, 99, 98, 97, 96),
+			expected: battery.Status{Level: 96, DischargeRate: 1, Known: true, TimeToEmpty: 96 * time.Hour},
+		},
+		{
+			name:     "low",
+			samples:  samples(time.Hour, 10, 10, 10, 10),
+			expected: battery.Status{Level: 10, Low: true, Known: true},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := battery.Estimate(tc.samples, 20)
+			assert.Equal(t, tc.expected.Level, s.Level)
+			assert.Equal(t, tc.expected.Charging, s.Charging)
+			assert.Equal(t, tc.expected.Low, s.Low)
+			assert.Equal(t, tc.expected.Known, s.Known)
+			assert.InDelta(t, tc.expected.DischargeRate, s.DischargeRate, 1e-9)
+			assert.InDelta(t, tc.expected.TimeToEmpty, s.TimeToEmpty, float64(time.Second))
+		})
+	}
+}
+
+func TestSink(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	s := battery.NewSink(battery.Config{Window: 6 * time.Hour, LowThreshold: 20}, reg)
+	info := client.DeviceInfo{MAC: "34CE00000000"}
+	write := func(minutes int, level float64) {
+		t.Helper()
+		ts := start.Add(time.Duration(minutes) * time.Minute)
+		require.NoError(t, s.Write(context.Background(), exporter.NewReadings(info, []client.DeviceData{
+			{Timestamp: client.ValueData{Value: float64(ts.Unix())}, Battery: client.ValueData{Value: level}},
+		})))
+	}
+
+	write(0, 47)
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP qingping_battery_charging Whether the battery is charging, from the rise of its level
+# TYPE qingping_battery_charging gauge
+qingping_battery_charging{device_mac="34CE00000000"} 0
+# HELP qingping_battery_low Whether the battery level is below the low threshold
+# TYPE qingping_battery_low gauge
+qingping_battery_low{device_mac="34CE00000000"} 0
+`), battery.MetricCharging, battery.MetricLow))
+	count, err := testutil.GatherAndCount(reg, battery.MetricTimeToEmpty, battery.MetricDischargeRate)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	// The rate is only exposed once the discharge spans 3 hours.
+	write(60, 46)
+	write(120, 45)
+	count, err = testutil.GatherAndCount(reg, battery.MetricTimeToEmpty, battery.MetricDischargeRate)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	write(180, 44)
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP qingping_battery_discharge_rate_percent_per_hour Decrease of the battery level in percentage points per hour since the battery last charged, negative when rising
+# TYPE qingping_battery_discharge_rate_percent_per_hour gauge
+qingping_battery_discharge_rate_percent_per_hour{device_mac="34CE00000000"} 1
+# HELP qingping_battery_time_to_empty_seconds Estimated remaining runtime of the battery at the current discharge rate, only while discharging
+# TYPE qingping_battery_time_to_empty_seconds gauge
+qingping_battery_time_to_empty_seconds{device_mac="34CE00000000"} 158400
+`), battery.MetricDischargeRate, battery.MetricTimeToEmpty))
+
+	// Plugged in: the remaining runtime is no longer exposed.
+	write(195, 60)
+	assert.Equal(t, 1.0, value(t, reg, battery.MetricCharging))
+	count, err = testutil.GatherAndCount(reg, battery.MetricTimeToEmpty, battery.MetricDischargeRate)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	// The samples before the charge leave the window, the battery drains
+	// again and gets low.
+	write(600, 19)
+	write(660, 18)
+	assert.Equal(t, 0.0, value(t, reg, battery.MetricCharging))
+	assert.Equal(t, 1.0, value(t, reg, battery.MetricLow))
+}
+
+// value returns the value of the single series of a gauge.
+func value(t *testing.T, reg *prometheus.Registry, name string) float64 {
+	t.Helper()
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	for _, mf := range families {
+		if mf.GetName() == name {
+			require.Len(t, mf.GetMetric(), 1)
+			return mf.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	require.Failf(t, "missing metric", name)
+	return 0
+}
@@ -0,0 +1,157 @@
+package battery
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+)
+
+// Names of the battery gauges.
+const (
+	MetricDischargeRate = "qingping_battery_discharge_rate_percent_per_hour"
+	MetricTimeToEmpty   = "qingping_battery_time_to_empty_seconds"
+	MetricCharging      = "qingping_battery_charging"
+	MetricLow           = "qingping_battery_low"
+)
+
+// Config holds the battery health settings.
+type Config struct {
+	Window       time.Duration
+	LowThreshold float64
+	// ExtraLabels are added to the battery gauges, set from the config file.
+	ExtraLabels *exporter.ExtraLabels
+}
+
+func (c *Config) BindFlags(cmd *kingpin.CmdClause) {
+	cmd.Flag("battery.window", "Window of battery levels the discharge rate and charging state are derived from.").
+		Default("24h").
+		DurationVar(&c.Window)
+
+	cmd.Flag("battery.low-threshold", "Battery level percentage below which "+MetricLow+" is 1.").
+		Default("20").
+		Float64Var(&c.LowThreshold)
+}
+
+func (c *Config) Validate() error {
+	if c.Window <= 0 {
+		return errors.New("--battery.window must be positive")
+	}
+	if c.LowThreshold < 0 || c.LowThreshold > 100 {
+		return errors.Newf("--battery.low-threshold must be between 0 and 100, got %g", c.LowThreshold)
+	}
+	return nil
+}
+
+// Sink exposes the battery health of every device, derived from its battery
+// readings within the window. It implements exporter.Sink.
+type Sink struct {
+	window time.Duration
+	low    float64
+	labels *exporter.ExtraLabels
+
+	dischargeRate *prometheus.GaugeVec
+	timeToEmpty   *prometheus.GaugeVec
+	charging      *prometheus.GaugeVec
+	lowBattery    *prometheus.GaugeVec
+
+	mtx sync.Mutex
+	// history holds the samples within the window per device MAC, sorted by time.
+	history map[string][]Sample
+}
+
+func NewSink(cfg Config, reg prometheus.Registerer) *Sink {
+	labels := append([]string{exporter.LabelDeviceMAC}, cfg.ExtraLabels.Names()...)
+	return &Sink{
+		window:  cfg.Window,
+		low:     cfg.LowThreshold,
+		labels:  cfg.ExtraLabels,
+		history: make(map[string][]Sample),
+		dischargeRate: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: MetricDischargeRate,
+			Help: "Decrease of the battery level in percentage points per hour since the battery last charged, negative when rising",
+		}, labels),
+		timeToEmpty: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: MetricTimeToEmpty,
+			Help: "Estimated remaining runtime of the battery at the current discharge rate, only while discharging",
+		}, labels),
+		charging: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: MetricCharging,
+			Help: "Whether the battery is charging, from the rise of its level",
+		}, labels),
+		lowBattery: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: MetricLow,
+			Help: "Whether the battery level is below the low threshold",
+		}, labels),
+	}
+}
+
+func (s *Sink) Name() string {
+	return "battery"
+}
+
+func (s *Sink) Write(_ context.Context, readings []exporter.Reading) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	updated := make(map[string]client.DeviceInfo)
+	for _, r := range readings {
+		if r.Field != "battery" {
+			continue
+		}
+		mac := r.Device.MAC
+		s.history[mac] = append(s.history[mac], Sample{Time: r.Timestamp, Level: r.Value})
+		updated[mac] = r.Device
+	}
+
+	for mac, info := range updated {
+		status := Estimate(s.trim(mac), s.low)
+		labels := append([]string{mac}, s.labels.Values(info)...)
+		// The extra labels can change, so drop the previous series.
+		match := prometheus.Labels{exporter.LabelDeviceMAC: mac}
+		for _, g := range []*prometheus.GaugeVec{s.dischargeRate, s.timeToEmpty, s.charging, s.lowBattery} {
+			g.DeletePartialMatch(match)
+		}
+		if status.Known {
+			s.dischargeRate.WithLabelValues(labels...).Set(status.DischargeRate)
+		}
+		if status.TimeToEmpty > 0 {
+			s.timeToEmpty.WithLabelValues(labels...).Set(status.TimeToEmpty.Seconds())
+		}
+		s.charging.WithLabelValues(labels...).Set(boolValue(status.Charging))
+		s.lowBattery.WithLabelValues(labels...).Set(boolValue(status.Low))
+	}
+	return nil
+}
+
+// trim sorts the samples of a device and drops the ones older than the window
+// ending at the latest one, which it returns. It must be called with the lock
+// held.
+func (s *Sink) trim(mac string) []Sample {
+	samples := s.history[mac]
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Time.Before(samples[j].Time)
+	})
+	oldest := samples[len(samples)-1].Time.Add(-s.window)
+	drop := sort.Search(len(samples), func(i int) bool {
+		return !samples[i].Time.Before(oldest)
+	})
+	samples = append(samples[:0:0], samples[drop:]...)
+	s.history[mac] = samples
+	return samples
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/alecthomas/kingpin"
@@ -35,27 +36,39 @@ func (o *APIConfig) BindFlags(app *kingpin.Application) {
 		Default("https://oauth.cleargrass.com/oauth2/token").
 		StringVar(&o.OAuthURL)
 
-	app.Flag("app-key", "App key of the Qingping API.").
+	app.Flag("app-key", "App key of the Qingping API. Required unless set in the config file.").
 		Envar("QINGPING_APP_KEY").
-		Required().
 		StringVar(&o.AppKey)
 
-	app.Flag("app-secret", "App secret of the Qingping API.").
+	app.Flag("app-secret", "App secret of the Qingping API. Required unless set in the config file.").
 		Envar("QINGPING_APP_SECRET").
-		Required().
 		StringVar(&o.AppSecret)
 }
 
+// Validate checks that the credentials are set.
+func (o *APIConfig) Validate() error {
+	if o.AppKey == "" {
+		return errors.New("app key is required: set --app-key, QINGPING_APP_KEY or credentials.app_key in the config file")
+	}
+	if o.AppSecret == "" {
+		return errors.New("app secret is required: set --app-secret, QINGPING_APP_SECRET or credentials.app_secret in the config file")
+	}
+	return nil
+}
+
 type oauthToken struct {
 	bearer string
 	expiry time.Time
 }
 
 type Client struct {
-	apiConfig  *APIConfig
 	HTTPClient *http.Client
-	Token      oauthToken
 	nowFunc    func() time.Time
+
+	// mtx guards the configuration and the token, which change on reload.
+	mtx       sync.Mutex
+	apiConfig *APIConfig
+	Token     oauthToken
 }
 
 type DeviceListResponse struct {
@@ -124,6 +137,8 @@ type DeviceData struct {
 	CO2         ValueData `json:"co2"`
 	PM25        ValueData `json:"pm25"`
 	PM10        ValueData `json:"pm10"`
+	// CO2Percent is reported instead of CO2 by some models.
+	CO2Percent ValueData `json:"co2_percent"`
 }
 
 type ValueData struct {
@@ -182,7 +197,25 @@ func New(apiConf *APIConfig, opts ...Option) *Client {
 	}
 }
 
+// SetAPIConfig replaces the API configuration, e.g. on a config reload. The
+// current token is dropped, so the next request authenticates again.
+func (c *Client) SetAPIConfig(apiConf APIConfig) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.apiConfig = &apiConf
+	c.Token = oauthToken{}
+}
+
+func (c *Client) config() APIConfig {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return *c.apiConfig
+}
+
 func (c *Client) IsAuthenticated() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
 	return c.Token.bearer != "" && c.nowFunc().Before(c.Token.expiry)
 }
 
@@ -191,11 +224,12 @@ func (c *Client) Authenticate() (string, error) {
 	data.Set("grant_type", "client_credentials")
 	data.Set("scope", "device_full_access")
 
-	req, err := http.NewRequest("POST", c.apiConfig.OAuthURL, bytes.NewBufferString(data.Encode()))
+	apiConfig := c.config()
+	req, err := http.NewRequest("POST", apiConfig.OAuthURL, bytes.NewBufferString(data.Encode()))
 	if err != nil {
 		return "", err
 	}
-	req.SetBasicAuth(c.apiConfig.AppKey, c.apiConfig.AppSecret)
+	req.SetBasicAuth(apiConfig.AppKey, apiConfig.AppSecret)
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
 	resp, err := c.HTTPClient.Do(req)
@@ -216,10 +250,12 @@ func (c *Client) Authenticate() (string, error) {
 	accessToken := result["access_token"].(string)
 	expiresIn := int(result["expires_in"].(float64)) // Convert to int
 
+	c.mtx.Lock()
 	c.Token = oauthToken{
 		bearer: accessToken,
 		expiry: time.Now().Add(time.Duration(expiresIn) * time.Second),
 	}
+	c.mtx.Unlock()
 
 	return accessToken, nil
 }
@@ -241,7 +277,9 @@ func (c *Client) doAuthenticatedReq(req *http.Request) (*http.Response, error) {
 		return nil, errors.Wrap(err, "failed to authenticate")
 	}
 
+	c.mtx.Lock()
 	req.Header.Set("Authorization", "Bearer "+c.Token.bearer)
+	c.mtx.Unlock()
 
 	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
@@ -253,7 +291,7 @@ func (c *Client) doAuthenticatedReq(req *http.Request) (*http.Response, error) {
 
 func (c *Client) GetDeviceList() (*DeviceListResponse, error) {
 	timestamp := strconv.FormatInt(c.nowFunc().Unix(), 10)
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/v1/apis/devices?timestamp=%s", c.apiConfig.BaseURL, timestamp), nil)
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/v1/apis/devices?timestamp=%s", c.config().BaseURL, timestamp), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -289,12 +327,11 @@ func (c *Client) ChangeDeviceSettings(mac []string, reportInterval, collectInter
 		return err
 	}
 
-	req, err := http.NewRequest("PUT", fmt.Sprintf("%s/v1/apis/devices/settings", c.apiConfig.BaseURL), bytes.NewBuffer(bodyBytes))
+	req, err := http.NewRequest("PUT", fmt.Sprintf("%s/v1/apis/devices/settings", c.config().BaseURL), bytes.NewBuffer(bodyBytes))
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+c.Token.bearer)
 
 	resp, err := c.doAuthenticatedReq(req)
 	if err != nil {
@@ -308,15 +345,26 @@ func (c *Client) ChangeDeviceSettings(mac []string, reportInterval, collectInter
 
 	return nil
 }
+
+// maxHistoryPageSize is the largest page size accepted by the data history endpoint.
+const maxHistoryPageSize = 200
+
 func (c *Client) GetDataHistory(mac string, startTime, endTime time.Time) (*DeviceDataResponse, error) {
+	return c.GetDataHistoryPage(mac, startTime, endTime, 0, maxHistoryPageSize)
+}
+
+// GetDataHistoryPage fetches a single page of the device data history,
+// starting at the given offset.
+func (c *Client) GetDataHistoryPage(mac string, startTime, endTime time.Time, offset, limit int) (*DeviceDataResponse, error) {
 	values := url.Values{}
 	values.Set("mac", mac)
 	values.Set("start_time", strconv.FormatInt(startTime.Unix(), 10))
 	values.Set("end_time", strconv.FormatInt(endTime.Unix(), 10))
 	values.Set("timestamp", strconv.FormatInt(c.nowFunc().UnixMilli(), 10))
-	values.Set("limit", "200")
+	values.Set("offset", strconv.Itoa(offset))
+	values.Set("limit", strconv.Itoa(limit))
 
-	url := fmt.Sprintf("%s/v1/apis/devices/data?%s", c.apiConfig.BaseURL, values.Encode())
+	url := fmt.Sprintf("%s/v1/apis/devices/data?%s", c.config().BaseURL, values.Encode())
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
@@ -339,3 +387,26 @@ func (c *Client) GetDataHistory(mac string, startTime, endTime time.Time) (*Devi
 
 	return &result, nil
 }
+
+// WalkDataHistory pages through the device data history between startTime and endTime,
+// calling fn for every non-empty page in order until all rows have been read.
+func (c *Client) WalkDataHistory(mac string, startTime, endTime time.Time, fn func([]DeviceData) error) error {
+	offset := 0
+	for {
+		page, err := c.GetDataHistoryPage(mac, startTime, endTime, offset, maxHistoryPageSize)
+		if err != nil {
+			return errors.Wrapf(err, "fetch data history page at offset %d", offset)
+		}
+		if len(page.Data) == 0 {
+			return nil
+		}
+		if err := fn(page.Data); err != nil {
+			return err
+		}
+
+		offset += len(page.Data)
+		if offset >= page.Total {
+			return nil
+		}
+	}
+}
@@ -163,3 +163,42 @@ func TestGetDataHistory(t *testing.T) {
 	}
 	assert.Equal(t, expectedData, data)
 }
+
+func TestClient_WalkDataHistory(t *testing.T) {
+	authSrv := createTestAuthServer(t, 3600*time.Second)
+	defer authSrv.Close()
+
+	const total = 450
+	var offsets []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/apis/devices/data", r.URL.Path)
+		assert.Equal(t, "200", r.URL.Query().Get("limit"))
+
+		offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+		require.NoError(t, err)
+		offsets = append(offsets, r.URL.Query().Get("offset"))
+
+		resp := client.DeviceDataResponse{Total: total}
+		for i := offset; i < total && i < offset+200; i++ {
+			resp.Data = append(resp.Data, client.DeviceData{Timestamp: client.ValueData{Value: float64(i)}})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(resp))
+	}))
+	defer server.Close()
+
+	qc := client.New(&client.APIConfig{
+		BaseURL:  server.URL,
+		OAuthURL: authSrv.URL,
+	})
+
+	var rows []client.DeviceData
+	err := qc.WalkDataHistory("mac1", time.Unix(0, 0), time.Unix(1000, 0), func(data []client.DeviceData) error {
+		rows = append(rows, data...)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0", "200", "400"}, offsets)
+	require.Len(t, rows, total)
+	assert.Equal(t, float64(total-1), rows[total-1].Timestamp.Value)
+}
@@ -0,0 +1,196 @@
+// Package config loads the YAML file given with --config.file, holding the
+// settings that do not fit in flags, such as per-device overrides.
+package config
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"gopkg.in/yaml.v3"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/alert"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+)
+
+// Config is the content of the config file.
+type Config struct {
+	Credentials Credentials `yaml:"credentials"`
+	Sync        Sync        `yaml:"sync"`
+	// Selectors filter the devices handled by the exporter.
+	Selectors exporter.DeviceFilter `yaml:"selectors"`
+	// Labels are added to every per-device metric, see exporter.ExtraLabels.
+	Labels  map[string]string `yaml:"labels"`
+	Devices []Device          `yaml:"devices"`
+	// Alerting holds the threshold rules notified by the exporter itself.
+	Alerting alert.Config `yaml:"alerting"`
+}
+
+// Credentials of the Qingping API. Set values override the flags and
+// environment variables. Secrets can be read from files instead, e.g. mounted
+// from a secret store.
+type Credentials struct {
+	BaseURL       string `yaml:"base_url,omitempty"`
+	OAuthURL      string `yaml:"oauth_url,omitempty"`
+	AppKey        string `yaml:"app_key,omitempty"`
+	AppKeyFile    string `yaml:"app_key_file,omitempty"`
+	AppSecret     string `yaml:"app_secret,omitempty"`
+	AppSecretFile string `yaml:"app_secret_file,omitempty"`
+}
+
+// Sync holds the settings of the API polling.
+type Sync struct {
+	// Interval between two syncs.
+	Interval time.Duration `yaml:"interval"`
+	// History is how far back the data history is fetched on every sync.
+	History time.Duration `yaml:"history"`
+}
+
+// DefaultSync holds the sync settings used when not set in the file.
+var DefaultSync = Sync{
+	Interval: 30 * time.Second,
+	History:  2 * time.Hour,
+}
+
+// Device overrides the settings of a device, selected by MAC or name.
+type Device struct {
+	MAC  string `yaml:"mac,omitempty"`
+	Name string `yaml:"name,omitempty"`
+	// Calibration holds the corrections of the device fields, see exporter.FieldCalibration.
+	Calibration map[string]exporter.FieldCalibration `yaml:"calibration,omitempty"`
+	// Labels override the common labels for the device.
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+// Default returns the configuration used without a config file.
+func Default() *Config {
+	return &Config{Sync: DefaultSync}
+}
+
+// Load reads, validates and resolves a config file. Secret files are read
+// relative to the directory of the config file.
+func Load(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read config file %s", path)
+	}
+
+	c := Default()
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	// An empty file is a valid configuration.
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, errors.Wrapf(err, "parse config file %s", path)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid config file %s", path)
+	}
+	if err := c.Credentials.resolve(filepath.Dir(path)); err != nil {
+		return nil, errors.Wrapf(err, "invalid config file %s", path)
+	}
+	if err := c.Alerting.ResolveFiles(filepath.Dir(path)); err != nil {
+		return nil, errors.Wrapf(err, "invalid config file %s: alerting", path)
+	}
+	return c, nil
+}
+
+// Validate checks the settings, without reading the secret files.
+func (c *Config) Validate() error {
+	if c.Credentials.AppKey != "" && c.Credentials.AppKeyFile != "" {
+		return errors.New("credentials: at most one of app_key and app_key_file can be set")
+	}
+	if c.Credentials.AppSecret != "" && c.Credentials.AppSecretFile != "" {
+		return errors.New("credentials: at most one of app_secret and app_secret_file can be set")
+	}
+	if c.Sync.Interval <= 0 {
+		return errors.Newf("sync: interval must be positive, got %s", c.Sync.Interval)
+	}
+	if c.Sync.History <= 0 {
+		return errors.Newf("sync: history must be positive, got %s", c.Sync.History)
+	}
+	if err := c.Selectors.Validate(); err != nil {
+		return errors.Wrap(err, "selectors")
+	}
+	for i, d := range c.Devices {
+		if (d.MAC == "") == (d.Name == "") {
+			return errors.Newf("devices[%d]: exactly one of mac or name must be set", i)
+		}
+		if err := exporter.ValidateFields(d.Calibration); err != nil {
+			return errors.Wrapf(err, "devices[%d]: calibration", i)
+		}
+	}
+	if err := c.Alerting.Validate(); err != nil {
+		return errors.Wrap(err, "alerting")
+	}
+	_, err := c.ExtraLabels()
+	return err
+}
+
+// resolve reads the secret files into the credentials.
+func (c *Credentials) resolve(dir string) error {
+	for _, s := range []struct {
+		file  string
+		value *string
+		key   string
+	}{
+		{file: c.AppKeyFile, value: &c.AppKey, key: "app_key_file"},
+		{file: c.AppSecretFile, value: &c.AppSecret, key: "app_secret_file"},
+	} {
+		if s.file == "" {
+			continue
+		}
+		path := s.file
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return errors.Wrapf(err, "credentials: %s", s.key)
+		}
+		*s.value = strings.TrimSpace(string(b))
+		if *s.value == "" {
+			return errors.Newf("credentials: %s: file %s is empty", s.key, path)
+		}
+	}
+	return nil
+}
+
+// APIConfig returns the API configuration from the flags with the
+// credentials of the file applied.
+func (c *Config) APIConfig(flags client.APIConfig) client.APIConfig {
+	override := func(v *string, s string) {
+		if s != "" {
+			*v = s
+		}
+	}
+	override(&flags.BaseURL, c.Credentials.BaseURL)
+	override(&flags.OAuthURL, c.Credentials.OAuthURL)
+	override(&flags.AppKey, c.Credentials.AppKey)
+	override(&flags.AppSecret, c.Credentials.AppSecret)
+	return flags
+}
+
+// Calibration returns the corrections of the devices overriding them.
+func (c *Config) Calibration() *exporter.Calibration {
+	cal := &exporter.Calibration{}
+	for _, d := range c.Devices {
+		if len(d.Calibration) > 0 {
+			cal.Devices = append(cal.Devices, exporter.DeviceCalibration{MAC: d.MAC, Name: d.Name, Fields: d.Calibration})
+		}
+	}
+	return cal
+}
+
+// ExtraLabels returns the labels added to the per-device metrics.
+func (c *Config) ExtraLabels() (*exporter.ExtraLabels, error) {
+	devices := make([]exporter.DeviceLabels, 0, len(c.Devices))
+	for _, d := range c.Devices {
+		devices = append(devices, exporter.DeviceLabels{MAC: d.MAC, Name: d.Name, Labels: d.Labels})
+	}
+	return exporter.NewExtraLabels(c.Labels, devices)
+}
@@ -0,0 +1,129 @@
+package config_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/config"
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "secret", "s3cr3t\n")
+	path := writeFile(t, dir, "config.yaml", `
+credentials:
+  app_key: key
+  app_secret_file: secret
+sync:
+  interval: 1m
+devices:
+  - mac: 34CE00000000
+    calibration:
+      temperature: {offset: -1.5}
+  - name: Office
+`)
+
+	c, err := config.Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, "s3cr3t", c.Credentials.AppSecret)
+	assert.Equal(t, time.Minute, c.Sync.Interval)
+	assert.Equal(t, config.DefaultSync.History, c.Sync.History)
+
+	api := c.APIConfig(client.APIConfig{BaseURL: "https://example.com", AppKey: "flag", AppSecret: "flag"})
+	assert.Equal(t, client.APIConfig{BaseURL: "https://example.com", AppKey: "key", AppSecret: "s3cr3t"}, api)
+
+	calibration := c.Calibration()
+	require.Len(t, calibration.Devices, 1)
+	assert.Equal(t, "34CE00000000", calibration.Devices[0].MAC)
+
+	// An empty file holds the defaults.
+	c, err = config.Load(writeFile(t, dir, "empty.yaml", ""))
+	require.NoError(t, err)
+	assert.Equal(t, config.Default(), c)
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{name: "unknown key", content: "sync: {intervall: 1m}", err: "field intervall not found"},
+		{name: "bad duration", content: "sync: {interval: soon}", err: "parse config file"},
+		{name: "negative interval", content: "sync: {interval: -1m}", err: "sync: interval must be positive"},
+		{name: "secret and secret file", content: "credentials: {app_secret: a, app_secret_file: b}", err: "at most one of app_secret and app_secret_file"},
+		{name: "missing secret file", content: "credentials: {app_key_file: missing}", err: "credentials: app_key_file"},
+		{name: "bad selector", content: "selectors: {exclude: [{name: '('}]}", err: "selectors: exclude[0]: name"},
+		{name: "reserved label", content: "labels: {device_mac: x}", err: `labels: label name "device_mac" is reserved`},
+		{name: "bad device label", content: "devices: [{mac: a, labels: {room: '{{ .Room }}'}}]", err: "devices[0]: labels: label room"},
+		{name: "no selector", content: "devices: [{calibration: {co2: {offset: 1}}}]", err: "devices[0]: exactly one of mac or name"},
+		{name: "unknown field", content: "devices: [{mac: a}, {name: b, calibration: {tvoc: {offset: 1}}}]", err: `devices[1]: calibration: unknown field "tvoc"`},
+		{name: "bad alerting rule", content: "alerting: {rules: [{name: a, field: co2, above: 1}]}", err: "alerting: rules[0]: at least one receiver"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := config.Load(writeFile(t, t.TempDir(), "config.yaml", tc.content))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.err)
+		})
+	}
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "config.yaml", "sync: {interval: 1m}")
+
+	var applied []*config.Config
+	reg := prometheus.NewRegistry()
+	r := config.NewReloader(path, func(c *config.Config) error {
+		applied = append(applied, c)
+		return nil
+	}, reg, log.NewNopLogger())
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	writeFile(t, dir, "config.yaml", "sync: {interval: 2m}")
+	resp, err = http.Post(srv.URL, "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, applied, 1)
+	assert.Equal(t, 2*time.Minute, applied[0].Sync.Interval)
+
+	// An invalid file is not applied.
+	writeFile(t, dir, "config.yaml", "sync: {interval: -2m}")
+	resp, err = http.Post(srv.URL, "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Len(t, applied, 1)
+
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP qingping_config_last_reload_successful Whether the last reload of the config file succeeded
+# TYPE qingping_config_last_reload_successful gauge
+qingping_config_last_reload_successful 0
+`), "qingping_config_last_reload_successful"))
+}
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ReloadPath is where the reload handler is registered.
+const ReloadPath = "/-/reload"
+
+// ApplyFunc applies a loaded configuration. An error leaves the previous one in place.
+type ApplyFunc func(*Config) error
+
+// Reloader reloads the config file on SIGHUP or on a POST to ReloadPath.
+// Only valid configurations are applied, so a broken file keeps the exporter
+// running with the last good one.
+type Reloader struct {
+	path   string
+	apply  ApplyFunc
+	logger log.Logger
+
+	// mtx serializes reloads.
+	mtx       sync.Mutex
+	success   prometheus.Gauge
+	timestamp prometheus.Gauge
+}
+
+// NewReloader creates a reloader of the config file at path, which was
+// already loaded and applied at startup.
+func NewReloader(path string, apply ApplyFunc, reg prometheus.Registerer, logger log.Logger) *Reloader {
+	r := &Reloader{
+		path:   path,
+		apply:  apply,
+		logger: logger,
+		success: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "qingping_config_last_reload_successful",
+			Help: "Whether the last reload of the config file succeeded",
+		}),
+		timestamp: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "qingping_config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful reload of the config file",
+		}),
+	}
+	r.success.Set(1)
+	r.timestamp.SetToCurrentTime()
+	return r
+}
+
+// Reload loads the config file and applies it if valid.
+func (r *Reloader) Reload() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	err := r.reload()
+	if err != nil {
+		r.success.Set(0)
+		level.Error(r.logger).Log("msg", "failed to reload config file", "path", r.path, "err", err)
+		return err
+	}
+	r.success.Set(1)
+	r.timestamp.SetToCurrentTime()
+	level.Info(r.logger).Log("msg", "reloaded config file", "path", r.path)
+	return nil
+}
+
+func (r *Reloader) reload() error {
+	c, err := Load(r.path)
+	if err != nil {
+		return err
+	}
+	return r.apply(c)
+}
+
+// Run reloads the config file on every SIGHUP until the context is done.
+func (r *Reloader) Run(ctx context.Context) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hup:
+			_ = r.Reload()
+		}
+	}
+}
+
+func (r *Reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost && req.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.Reload(); err != nil {
+		http.Error(w, "failed to reload config: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,174 @@
+// Package export writes device data history as tabular files, with one row
+// per device and timestamp and one column per sensor field.
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/parquet-go/parquet-go"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+)
+
+// Formats supported by NewWriter.
+const (
+	FormatCSV     = "csv"
+	FormatJSONL   = "jsonl"
+	FormatParquet = "parquet"
+)
+
+// Formats lists all supported output formats.
+var Formats = []string{FormatCSV, FormatJSONL, FormatParquet}
+
+// Row is a single exported reading.
+type Row struct {
+	Time        string  `json:"time" parquet:"time"`
+	MAC         string  `json:"mac" parquet:"mac,dict"`
+	Name        string  `json:"name" parquet:"name,dict"`
+	Temperature float64 `json:"temperature" parquet:"temperature"`
+	Humidity    float64 `json:"humidity" parquet:"humidity"`
+	CO2         float64 `json:"co2" parquet:"co2"`
+	PM25        float64 `json:"pm25" parquet:"pm25"`
+	PM10        float64 `json:"pm10" parquet:"pm10"`
+	Battery     float64 `json:"battery" parquet:"battery"`
+}
+
+var csvHeader = []string{"time", "mac", "name", "temperature", "humidity", "co2", "pm25", "pm10", "battery"}
+
+func (r Row) csvRecord() []string {
+	return []string{
+		r.Time,
+		r.MAC,
+		r.Name,
+		formatFloat(r.Temperature),
+		formatFloat(r.Humidity),
+		formatFloat(r.CO2),
+		formatFloat(r.PM25),
+		formatFloat(r.PM10),
+		formatFloat(r.Battery),
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// Writer writes device data rows to an output.
+type Writer interface {
+	Write(device client.DeviceInfo, data []client.DeviceData) error
+	// Close flushes any buffered rows. It does not close the underlying output.
+	Close() error
+}
+
+// NewWriter creates a writer for the given format. Timestamps are
+// formatted as RFC3339 in the given location.
+func NewWriter(format string, w io.Writer, loc *time.Location) (Writer, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	switch format {
+	case FormatCSV:
+		return newCSVWriter(w, loc), nil
+	case FormatJSONL:
+		return &jsonlWriter{enc: json.NewEncoder(w), loc: loc}, nil
+	case FormatParquet:
+		return &parquetWriter{w: parquet.NewGenericWriter[Row](w), loc: loc}, nil
+	default:
+		return nil, errors.Newf("unsupported export format %q", format)
+	}
+}
+
+func toRows(device client.DeviceInfo, data []client.DeviceData, loc *time.Location) []Row {
+	rows := make([]Row, 0, len(data))
+	for _, d := range data {
+		rows = append(rows, Row{
+			Time:        time.Unix(int64(d.Timestamp.Value), 0).In(loc).Format(time.RFC3339),
+			MAC:         device.MAC,
+			Name:        device.Name,
+			Temperature: d.Temperature.Value,
+			Humidity:    d.Humidity.Value,
+			CO2:         d.CO2.Value,
+			PM25:        d.PM25.Value,
+			PM10:        d.PM10.Value,
+			Battery:     d.Battery.Value,
+		})
+	}
+	return rows
+}
+
+type csvWriter struct {
+	w             *csv.Writer
+	loc           *time.Location
+	headerWritten bool
+}
+
+func newCSVWriter(w io.Writer, loc *time.Location) *csvWriter {
+	return &csvWriter{w: csv.NewWriter(w), loc: loc}
+}
+
+func (c *csvWriter) writeHeader() error {
+	if c.headerWritten {
+		return nil
+	}
+	c.headerWritten = true
+	return c.w.Write(csvHeader)
+}
+
+func (c *csvWriter) Write(device client.DeviceInfo, data []client.DeviceData) error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	for _, r := range toRows(device, data, c.loc) {
+		if err := c.w.Write(r.csvRecord()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *csvWriter) Close() error {
+	// Always emit a header, even when no data was found.
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type jsonlWriter struct {
+	enc *json.Encoder
+	loc *time.Location
+}
+
+func (j *jsonlWriter) Write(device client.DeviceInfo, data []client.DeviceData) error {
+	for _, r := range toRows(device, data, j.loc) {
+		if err := j.enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *jsonlWriter) Close() error {
+	return nil
+}
+
+type parquetWriter struct {
+	w   *parquet.GenericWriter[Row]
+	loc *time.Location
+}
+
+func (p *parquetWriter) Write(device client.DeviceInfo, data []client.DeviceData) error {
+	_, err := p.w.Write(toRows(device, data, p.loc))
+	return err
+}
+
+func (p *parquetWriter) Close() error {
+	return p.w.Close()
+}
@@ -0,0 +1,99 @@
+package export_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/export"
+)
+
+var (
+	testDevice = client.DeviceInfo{MAC: "34CE00000000", Name: "Office Air Monitor"}
+	testRows   = []client.DeviceData{
+		{
+			Timestamp:   client.ValueData{Value: 1726749900},
+			Battery:     client.ValueData{Value: 47},
+			Temperature: client.ValueData{Value: 25.6},
+			Humidity:    client.ValueData{Value: 58.3},
+			CO2:         client.ValueData{Value: 454},
+			PM25:        client.ValueData{Value: 12},
+			PM10:        client.ValueData{Value: 12},
+		},
+		{
+			Timestamp:   client.ValueData{Value: 1726750800},
+			Battery:     client.ValueData{Value: 44},
+			Temperature: client.ValueData{Value: 26.1},
+			Humidity:    client.ValueData{Value: 56},
+			CO2:         client.ValueData{Value: 452},
+			PM25:        client.ValueData{Value: 12},
+			PM10:        client.ValueData{Value: 12},
+		},
+	}
+)
+
+func TestWriter(t *testing.T) {
+	loc, err := time.LoadLocation("America/Sao_Paulo")
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		format   string
+		loc      *time.Location
+		expected string
+	}{
+		{
+			format: export.FormatCSV,
+			expected: "time,mac,name,temperature,humidity,co2,pm25,pm10,battery\n" +
+				"2024-09-19T12:45:00Z,34CE00000000,Office Air Monitor,25.6,58.3,454,12,12,47\n" +
+				"2024-09-19T13:00:00Z,34CE00000000,Office Air Monitor,26.1,56,452,12,12,44\n",
+		},
+		{
+			format: export.FormatJSONL,
+			loc:    loc,
+			expected: `{"time":"2024-09-19T09:45:00-03:00","mac":"34CE00000000","name":"Office Air Monitor","temperature":25.6,"humidity":58.3,"co2":454,"pm25":12,"pm10":12,"battery":47}` + "\n" +
+				`{"time":"2024-09-19T10:00:00-03:00","mac":"34CE00000000","name":"Office Air Monitor","temperature":26.1,"humidity":56,"co2":452,"pm25":12,"pm10":12,"battery":44}` + "\n",
+		},
+	} {
+		t.Run(tc.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := export.NewWriter(tc.format, &buf, tc.loc)
+			require.NoError(t, err)
+			require.NoError(t, w.Write(testDevice, testRows))
+			require.NoError(t, w.Close())
+			assert.Equal(t, tc.expected, buf.String())
+		})
+	}
+}
+
+func TestWriter_Parquet(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := export.NewWriter(export.FormatParquet, &buf, time.UTC)
+	require.NoError(t, err)
+	require.NoError(t, w.Write(testDevice, testRows))
+	require.NoError(t, w.Close())
+
+	rows, err := parquet.Read[export.Row](bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, export.Row{
+		Time:        "2024-09-19T13:00:00Z",
+		MAC:         "34CE00000000",
+		Name:        "Office Air Monitor",
+		Temperature: 26.1,
+		Humidity:    56,
+		CO2:         452,
+		PM25:        12,
+		PM10:        12,
+		Battery:     44,
+	}, rows[1])
+}
+
+func TestNewWriter_UnsupportedFormat(t *testing.T) {
+	_, err := export.NewWriter("xlsx", &bytes.Buffer{}, nil)
+	assert.Error(t, err)
+}
@@ -2,10 +2,13 @@ package exporter
 
 import (
 	"context"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/efficientgo/core/runutil"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
@@ -16,157 +19,432 @@ import (
 
 const DeviceModel = "CGDN1"
 
+// Names of the per-device metrics, shared with the backfill writers so
+// historical data lines up with what the live exporter exposes.
+const (
+	LabelDeviceMAC = "device_mac"
+
+	MetricTemperature         = "qingping_temperature_celsius"
+	MetricHumidity            = "qingping_relative_humidity_percent"
+	MetricPM25                = "qingping_pm25_micrograms_per_cubic_meter"
+	MetricPM10                = "qingping_pm10_micrograms_per_cubic_meter"
+	MetricCO2                 = "qingping_co2_ppm"
+	MetricBattery             = "qingping_battery_percent"
+	MetricLastReportTimestamp = "qingping_last_report_timestamp_seconds"
+	MetricDeviceInfo          = "qingping_device_info"
+)
+
+// Names of the metrics of the syncs.
+const (
+	MetricSyncDuration = "qingping_sync_duration_seconds"
+	MetricSyncFailures = "qingping_sync_failures_total"
+	MetricReadings     = "qingping_readings_total"
+)
+
+// Phases of a sync, as in the phase label of the sync metrics.
+const (
+	SyncPhaseDeviceList  = "device_list"
+	SyncPhaseDataHistory = "data_history"
+)
+
+// Names of the per-device metrics before they followed the Prometheus naming
+// conventions, still exposed in legacy mode during the migration.
+const (
+	LegacyMetricTemperature         = "air_monitor_temperature"
+	LegacyMetricHumidity            = "air_monitor_humidity"
+	LegacyMetricPM25                = "air_monitor_pm25"
+	LegacyMetricPM10                = "air_monitor_pm10"
+	LegacyMetricCO2                 = "air_monitor_co2"
+	LegacyMetricBattery             = "air_monitor_battery"
+	LegacyMetricLastReportTimestamp = "device_last_data_timestamp"
+)
+
 type metrics struct {
-	temperature *prometheus.GaugeVec
-	humidity    *prometheus.GaugeVec
-	pm25        *prometheus.GaugeVec
-	pm10        *prometheus.GaugeVec
-	battery     *prometheus.GaugeVec
-	deviceInfo  *prometheus.GaugeVec
-	co2         *prometheus.GaugeVec
-
-	syncDuration      *prometheus.HistogramVec
-	lastDataTimestamp *prometheus.GaugeVec
-}
-
-func newMetrics(reg prometheus.Registerer) *metrics {
-	temperature := promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name: "air_monitor_temperature",
-		Help: "Temperature in degrees Celsius",
-	}, []string{"device_mac"})
-
-	humidity := promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name: "air_monitor_humidity",
-		Help: "Humidity percentage",
-	}, []string{"device_mac"})
-
-	pm25 := promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name: "air_monitor_pm25",
-		Help: "PM2.5 concentration in µg/m³",
-	}, []string{"device_mac"})
-
-	pm10 := promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name: "air_monitor_pm10",
-		Help: "PM10 concentration in µg/m³",
-	}, []string{"device_mac"})
-
-	co2 := promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name: "air_monitor_co2",
-		Help: "CO2 concentration in ppm",
-	}, []string{"device_mac"})
-
-	battery := promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name: "air_monitor_battery",
-		Help: "Battery level percentage",
-	}, []string{"device_mac"})
-
-	deviceInfo := promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name: "air_monitor_device_info",
-		Help: "Device information",
-	}, []string{"device_name", "device_mac", "status", "product_name", "product_code", "product_id"})
-
-	lastDataTimestamp := promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
-		Name: "device_last_data_timestamp",
-		Help: "Last data timestamp",
-	}, []string{"device_mac"})
-
-	syncDuration := promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
-		Name:                            "air_monitor_sync_duration_seconds",
-		Help:                            "Duration of the sync request",
-		Buckets:                         prometheus.DefBuckets,
-		NativeHistogramBucketFactor:     1.1,
-		NativeHistogramMaxBucketNumber:  200,
-		NativeHistogramMinResetDuration: 10 * time.Minute,
+	deviceInfo gaugeVecs
+
+	syncDuration        histogramVecs
+	lastReportTimestamp gaugeVecs
+	syncFailures        *prometheus.CounterVec
+	readings            counterVecs
+	calibrationInfo     *prometheus.GaugeVec
+	devicesFiltered     *prometheus.CounterVec
+	reportingGaps       *prometheus.GaugeVec
+	reportingRatio      *prometheus.GaugeVec
+	reportingLongestGap *prometheus.GaugeVec
+}
+
+func newMetrics(reg prometheus.Registerer, legacy bool, extraLabels []string) *metrics {
+	deviceInfo := newGaugeVecs(reg, names(MetricDeviceInfo, "air_monitor_device_info", legacy),
+		"Device information",
+		append([]string{"device_name", "device_mac", "status", "product_name", "product_code", "product_id"}, extraLabels...))
+
+	lastReportTimestamp := newGaugeVecs(reg, names(MetricLastReportTimestamp, LegacyMetricLastReportTimestamp, legacy),
+		"Unix timestamp of the last report of the device",
+		append([]string{LabelDeviceMAC}, extraLabels...))
+
+	syncDuration := newHistogramVecs(reg, names(MetricSyncDuration, "air_monitor_sync_duration_seconds", legacy),
+		prometheus.HistogramOpts{
+			Help:                            "Duration of the sync request",
+			Buckets:                         prometheus.DefBuckets,
+			NativeHistogramBucketFactor:     1.1,
+			NativeHistogramMaxBucketNumber:  200,
+			NativeHistogramMinResetDuration: 10 * time.Minute,
+		}, []string{"phase"})
+
+	syncFailures := promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: MetricSyncFailures,
+		Help: "Number of failed requests of the syncs, by phase",
 	}, []string{"phase"})
+	for _, phase := range []string{SyncPhaseDeviceList, SyncPhaseDataHistory} {
+		syncFailures.WithLabelValues(phase)
+	}
 
-	return &metrics{
-		temperature: temperature,
-		humidity:    humidity,
-		pm25:        pm25,
-		pm10:        pm10,
-		battery:     battery,
-		deviceInfo:  deviceInfo,
-		co2:         co2,
+	readings := newCounterVecs(reg, names(MetricReadings, "air_monitor_readings_total", legacy),
+		"Number of device readings received, by source and whether they were newer than the last one seen",
+		[]string{"source", "result"})
+
+	calibrationInfo := promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qingping_calibration_info",
+		Help: "Calibration applied to a device field, as value*multiplier+offset clamped to [min, max]",
+	}, append([]string{LabelDeviceMAC, "field", "offset", "multiplier", "min", "max"}, extraLabels...))
+
+	devicesFiltered := promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "qingping_devices_filtered_total",
+		Help: "Number of devices skipped by a sync, by reason",
+	}, []string{"reason"})
+	for _, reason := range []string{FilterReasonUnsupportedModel, FilterReasonNotIncluded, FilterReasonExcluded} {
+		devicesFiltered.WithLabelValues(reason)
+	}
+
+	reportingGaps := promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricReportingGaps,
+		Help: "Number of periods longer than 1.5 report intervals without data in the history window of the last sync",
+	}, append([]string{LabelDeviceMAC}, extraLabels...))
 
-		syncDuration:      syncDuration,
-		lastDataTimestamp: lastDataTimestamp,
+	reportingRatio := promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricReportingRatio,
+		Help: "Data rows received over the rows expected at the report interval in the history window of the last sync",
+	}, append([]string{LabelDeviceMAC}, extraLabels...))
+
+	reportingLongestGap := promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricReportingLongestGap,
+		Help: "Longest period without data in the history window of the last sync",
+	}, append([]string{LabelDeviceMAC}, extraLabels...))
+
+	return &metrics{
+		deviceInfo: deviceInfo,
+
+		syncDuration:        syncDuration,
+		syncFailures:        syncFailures,
+		lastReportTimestamp: lastReportTimestamp,
+		readings:            readings,
+		calibrationInfo:     calibrationInfo,
+		devicesFiltered:     devicesFiltered,
+		reportingGaps:       reportingGaps,
+		reportingRatio:      reportingRatio,
+		reportingLongestGap: reportingLongestGap,
 	}
 }
 
+// Sources of device readings passed to Observe.
+const (
+	SourcePoll = "poll"
+	SourcePush = "push"
+	SourceMQTT = "mqtt"
+)
+
 type exporterOpts struct {
-	syncInterval time.Duration
+	syncInterval   time.Duration
+	history        time.Duration
+	cacheRetention time.Duration
+	polling        bool
+	comfort        bool
+	calibration    *Calibration
+	filter         *DeviceFilter
+	labels         *ExtraLabels
+	exportRaw      bool
+	conversions    []string
+	legacyNames    bool
+	sinks          []Sink
 }
 
 var defaultExporterOpts = exporterOpts{
-	syncInterval: 30 * time.Second,
+	syncInterval:   30 * time.Second,
+	history:        2 * time.Hour,
+	cacheRetention: DefaultCacheRetention,
+	polling:        true,
 }
 
 type Option func(*exporterOpts)
 
+// WithSinks adds sinks the readings are written to, besides the Prometheus gauges.
+func WithSinks(sinks ...Sink) func(*exporterOpts) {
+	return func(o *exporterOpts) {
+		o.sinks = append(o.sinks, sinks...)
+	}
+}
+
+// WithPolling sets whether Run polls the API. When disabled, readings only
+// come from Observe, e.g. with pushed data.
+func WithPolling(polling bool) func(*exporterOpts) {
+	return func(o *exporterOpts) {
+		o.polling = polling
+	}
+}
+
+// WithComfortMetrics sets whether comfort fields, e.g. the dew point, are derived
+// for the models reporting both temperature and humidity.
+func WithComfortMetrics(comfort bool) func(*exporterOpts) {
+	return func(o *exporterOpts) {
+		o.comfort = comfort
+	}
+}
+
+// WithCalibration sets the corrections applied to the device readings before
+// they are exported. With exportRaw, the uncalibrated values of the corrected
+// fields are also exposed with the raw="true" label.
+func WithCalibration(c *Calibration, exportRaw bool) func(*exporterOpts) {
+	return func(o *exporterOpts) {
+		o.calibration = c
+		o.exportRaw = exportRaw
+	}
+}
+
+// WithDeviceFilter sets the devices handled by the sync.
+func WithDeviceFilter(f *DeviceFilter) func(*exporterOpts) {
+	return func(o *exporterOpts) {
+		o.filter = f
+	}
+}
+
+// WithExtraLabels adds the extra labels to every per-device metric.
+func WithExtraLabels(l *ExtraLabels) func(*exporterOpts) {
+	return func(o *exporterOpts) {
+		o.labels = l
+	}
+}
+
+// WithUnitConversions also exposes the gauges in other units, as separate
+// metrics suffixed with the unit, e.g. "fahrenheit". See Conversions.
+func WithUnitConversions(suffixes ...string) func(*exporterOpts) {
+	return func(o *exporterOpts) {
+		o.conversions = append(o.conversions, suffixes...)
+	}
+}
+
+// WithLegacyNames also exposes the metrics under the names they had before
+// following the Prometheus naming conventions, e.g. air_monitor_temperature.
+func WithLegacyNames(legacy bool) func(*exporterOpts) {
+	return func(o *exporterOpts) {
+		o.legacyNames = legacy
+	}
+}
+
 func WithSyncInterval(syncInterval time.Duration) func(*exporterOpts) {
 	return func(o *exporterOpts) {
 		o.syncInterval = syncInterval
 	}
 }
 
+// WithHistoryWindow sets how far back the data history is fetched on every sync.
+func WithHistoryWindow(history time.Duration) func(*exporterOpts) {
+	return func(o *exporterOpts) {
+		o.history = history
+	}
+}
+
+// WithCacheRetention sets how long the readings of a device are kept in
+// memory, to serve their recent history.
+func WithCacheRetention(retention time.Duration) func(*exporterOpts) {
+	return func(o *exporterOpts) {
+		o.cacheRetention = retention
+	}
+}
+
 // AirMonitorLite is a Qingping air monitor lite exporter.
 // It reads all data from API for the device model (CGDN1).
+// Readings are exposed as Prometheus gauges and written to any additional sinks.
 type AirMonitorLite struct {
-	client       *client.Client
-	reg          prometheus.Registerer
-	m            *metrics
+	client  *client.Client
+	reg     prometheus.Registerer
+	m       *metrics
+	polling bool
+	comfort bool
+	logger  log.Logger
+	labels  *ExtraLabels
+	// prom is written synchronously, so metrics are up to date after Observe.
+	prom  *PrometheusSink
+	sinks *fanout
+
+	mtx sync.Mutex
+	// syncInterval, history, calibration and filter can change on a config reload.
 	syncInterval time.Duration
-	logger       log.Logger
+	history      time.Duration
+	calibration  *Calibration
+	filter       *DeviceFilter
+	// lastSeen holds the timestamp of the newest reading observed per device MAC.
+	lastSeen map[string]float64
+	// devices holds the cloud inventory of supported devices by MAC.
+	devices map[string]client.Device
+	// labelValues holds the extra label values last exposed per device MAC.
+	labelValues map[string]string
+	// infoLabels holds the device info label values last exposed per device MAC.
+	infoLabels map[string]string
+	// calibrated holds the devices whose corrections are exposed, by MAC.
+	calibrated map[string]client.DeviceInfo
+	// cache holds the recent readings and sync status per device MAC.
+	cache          map[string]*deviceCache
+	cacheRetention time.Duration
+	lastSync       *SyncStatus
 }
 
-func NewAirMonitorLiteExporter(client *client.Client, reg prometheus.Registerer, logger log.Logger, opts ...Option) *AirMonitorLite {
+func NewAirMonitorLiteExporter(c *client.Client, reg prometheus.Registerer, logger log.Logger, opts ...Option) *AirMonitorLite {
 	o := defaultExporterOpts
 	for _, opt := range opts {
 		opt(&o)
 	}
 
 	return &AirMonitorLite{
-		client:       client,
+		client:       c,
 		reg:          reg,
-		m:            newMetrics(reg),
+		m:            newMetrics(reg, o.legacyNames, o.labels.Names()),
 		syncInterval: o.syncInterval,
+		history:      o.history,
+		polling:      o.polling,
+		comfort:      o.comfort,
+		calibration:  o.calibration,
+		filter:       o.filter,
 		logger:       logger,
+		labels:       o.labels,
+		prom: NewPrometheusSink(reg,
+			WithRawLabel(o.exportRaw),
+			WithConversions(o.conversions...),
+			WithLegacyGauges(o.legacyNames),
+			WithGaugeLabels(o.labels),
+		),
+		sinks:          newFanout(o.sinks, reg, logger),
+		lastSeen:       make(map[string]float64),
+		devices:        make(map[string]client.Device),
+		labelValues:    make(map[string]string),
+		infoLabels:     make(map[string]string),
+		calibrated:     make(map[string]client.DeviceInfo),
+		cache:          make(map[string]*deviceCache),
+		cacheRetention: o.cacheRetention,
 	}
 }
 
+// Run writes to the sinks and, unless disabled, polls the API until the context is done.
 func (a *AirMonitorLite) Run(ctx context.Context) error {
-	ticker := time.NewTicker(a.syncInterval)
-	defer ticker.Stop()
-	return runutil.Repeat(a.syncInterval, ctx.Done(), a.sync)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		a.sinks.run(ctx)
+	}()
+	defer wg.Wait()
+
+	if !a.polling {
+		<-ctx.Done()
+		return nil
+	}
+	for {
+		if err := a.sync(); err != nil {
+			return err
+		}
+
+		// The interval is read on every iteration, as it can be reloaded.
+		a.mtx.Lock()
+		t := time.NewTimer(a.syncInterval)
+		a.mtx.Unlock()
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// SetSync replaces the interval between syncs and the window of data history
+// fetched on every sync, e.g. on a config reload. The new interval applies
+// after the next sync.
+func (a *AirMonitorLite) SetSync(interval, history time.Duration) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.syncInterval = interval
+	a.history = history
+}
+
+// SetDeviceFilter replaces the devices handled by the sync, e.g. on a config reload.
+func (a *AirMonitorLite) SetDeviceFilter(f *DeviceFilter) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.filter = f
+}
 
+// SetCalibration replaces the corrections applied to the device readings,
+// e.g. on a config reload. The calibration series and raw values of the
+// devices whose corrections changed are removed, until their next readings.
+func (a *AirMonitorLite) SetCalibration(c *Calibration) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	for mac, info := range a.calibrated {
+		prev, _ := a.calibration.For(info)
+		next, _ := c.For(info)
+		if reflect.DeepEqual(prev, next) {
+			continue
+		}
+		a.m.calibrationInfo.DeletePartialMatch(prometheus.Labels{LabelDeviceMAC: mac})
+		a.prom.DeleteRaw(mac)
+		delete(a.calibrated, mac)
+	}
+	a.calibration = c
 }
 
 func (a *AirMonitorLite) sync() error {
 	level.Info(a.logger).Log("msg", "starting sync loop")
 	defer level.Info(a.logger).Log("msg", "sync loop finished")
 
-	timer := prometheus.NewTimer(a.m.syncDuration.WithLabelValues("total"))
+	timer := prometheus.NewTimer(a.m.syncDuration.observer("total"))
 	defer timer.ObserveDuration()
 
+	start := time.Now()
 	devices, err := a.client.GetDeviceList()
 	if err != nil {
 		level.Error(a.logger).Log("msg", "failed to get device list", "err", err)
+		a.m.syncFailures.WithLabelValues(SyncPhaseDeviceList).Inc()
+		a.setSyncStatus(start, err)
 		return err
 	}
+	defer a.setSyncStatus(start, nil)
+	a.mtx.Lock()
+	history, filter := a.history, a.filter
+	a.mtx.Unlock()
 	endTime := time.Now().UTC()
-	// TODO: make this a flag
-	startTime := endTime.Add(-2 * time.Hour).UTC()
+	startTime := endTime.Add(-history).UTC()
 
+	kept := make(map[string]bool, len(devices.Devices))
+	defer a.pruneDevices(kept)
 	for _, device := range devices.Devices {
 		if device.Info.Product.Code != DeviceModel {
+			a.m.devicesFiltered.WithLabelValues(FilterReasonUnsupportedModel).Inc()
+			continue
+		}
+		if keep, reason := filter.Keep(device.Info); !keep {
+			a.m.devicesFiltered.WithLabelValues(reason).Inc()
 			continue
 		}
+		kept[device.Info.MAC] = true
 		a.updateDeviceInfo(device)
+		fetchStart := time.Now()
 		data, err := a.client.GetDataHistory(device.Info.MAC, startTime, endTime)
+		a.setDeviceSyncStatus(device.Info, fetchStart, err)
 		if err != nil {
 			level.Error(a.logger).Log("msg", "failed to get data history", "mac", device.Info.MAC, "err", err)
+			a.m.syncFailures.WithLabelValues(SyncPhaseDataHistory).Inc()
 			continue
 		}
+		a.observeHealth(device.Info, data, startTime, endTime)
 
 		if len(data.Data) == 0 {
 			level.Warn(a.logger).Log(
@@ -179,38 +457,275 @@ func (a *AirMonitorLite) sync() error {
 			continue
 		}
 
-		latestData := data.Data[len(data.Data)-1]
-		a.m.lastDataTimestamp.WithLabelValues(device.Info.MAC).Set(latestData.Timestamp.Value)
-		a.m.temperature.WithLabelValues(device.Info.MAC).Set(latestData.Temperature.Value)
-		a.m.humidity.WithLabelValues(device.Info.MAC).Set(latestData.Humidity.Value)
-		a.m.co2.WithLabelValues(device.Info.MAC).Set(latestData.CO2.Value)
-		a.m.pm25.WithLabelValues(device.Info.MAC).Set(latestData.PM25.Value)
-		a.m.pm10.WithLabelValues(device.Info.MAC).Set(latestData.PM10.Value)
-		a.m.battery.WithLabelValues(device.Info.MAC).Set(latestData.Battery.Value)
+		a.Observe(SourcePoll, device.Info, data.Data)
 	}
 
 	return nil
 }
 
-func (a *AirMonitorLite) updateDeviceInfo(device client.Device) {
+// observeHealth updates the reporting health metrics of a device from its data
+// history between start and end. When the history does not fit in a page, the
+// gaps cannot be told apart from the missing rows and the metrics are left as is.
+func (a *AirMonitorLite) observeHealth(info client.DeviceInfo, data *client.DeviceDataResponse, start, end time.Time) {
+	if data.Total > len(data.Data) {
+		level.Debug(a.logger).Log("msg", "data history truncated, skipping reporting health", "mac", info.MAC, "total", data.Total)
+		return
+	}
+	h, ok := DeviceHealth(info, data.Data, start, end)
+	if !ok {
+		return
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	labels := a.deviceLabels(info)
+	a.m.reportingGaps.WithLabelValues(labels...).Set(float64(h.Gaps))
+	a.m.reportingRatio.WithLabelValues(labels...).Set(h.Ratio())
+	a.m.reportingLongestGap.WithLabelValues(labels...).Set(h.LongestGap.Seconds())
+}
+
+func newSyncStatus(start time.Time, err error) *SyncStatus {
+	s := &SyncStatus{Time: start.UTC(), Duration: time.Since(start).Seconds()}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	return s
+}
+
+func (a *AirMonitorLite) setSyncStatus(start time.Time, err error) {
+	status := newSyncStatus(start, err)
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.lastSync = status
+}
+
+func (a *AirMonitorLite) setDeviceSyncStatus(info client.DeviceInfo, start time.Time, err error) {
+	status := newSyncStatus(start, err)
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	c := a.deviceCache(info.MAC)
+	c.info = info
+	c.lastSync = status
+}
+
+// Observe updates the device metrics from the given readings, coming either from
+// polling the API or from a push. Readings at most as recent as one already
+// observed for the device are ignored, so polled and pushed data can be combined.
+// All new readings are written to the sinks.
+func (a *AirMonitorLite) Observe(source string, info client.DeviceInfo, data []client.DeviceData) {
+	if len(data) == 0 {
+		return
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	fresh := make([]client.DeviceData, 0, len(data))
+	for _, d := range data {
+		if d.Timestamp.Value > a.lastSeen[info.MAC] {
+			fresh = append(fresh, d)
+		}
+	}
+	if len(fresh) == 0 {
+		a.m.readings.inc(source, "duplicate")
+		return
+	}
+	sort.SliceStable(fresh, func(i, j int) bool {
+		return fresh[i].Timestamp.Value < fresh[j].Timestamp.Value
+	})
+
+	latestData := fresh[len(fresh)-1]
+	a.lastSeen[info.MAC] = latestData.Timestamp.Value
+	a.m.readings.inc(source, "accepted")
+
+	a.m.lastReportTimestamp.set(latestData.Timestamp.Value, a.deviceLabels(info)...)
+
+	raw := fresh
+	corrections, calibrated := a.calibration.For(info)
+	if calibrated {
+		fresh = calibrate(corrections, fresh)
+	}
+
+	readings := NewReadings(info, fresh)
+	if a.comfort && HasComfortFields(info.Product.Code) {
+		readings = append(readings, NewComfortReadings(info, fresh)...)
+	}
+	// The Prometheus sink never fails.
+	_ = a.prom.Write(context.Background(), readings)
+	if calibrated {
+		a.exposeCalibration(info, corrections, raw)
+	}
+	a.cacheReadings(info, source, readings)
+	a.sinks.write(readings)
+}
+
+// exposeCalibration exposes the active corrections of a device and the
+// uncalibrated values of the corrected fields. It must be called with the lock held.
+func (a *AirMonitorLite) exposeCalibration(info client.DeviceInfo, corrections map[string]FieldCalibration, raw []client.DeviceData) {
+	a.calibrated[info.MAC] = info
+	for field, c := range corrections {
+		offset, multiplier, lo, hi := calibrationLabels(c)
+		labels := append([]string{info.MAC, field, offset, multiplier, lo, hi}, a.labels.Values(info)...)
+		a.m.calibrationInfo.WithLabelValues(labels...).Set(1)
+	}
+
+	readings := NewReadings(info, raw)
+	filtered := readings[:0]
+	for _, r := range readings {
+		if _, ok := corrections[r.Field]; ok {
+			filtered = append(filtered, r)
+		}
+	}
+	a.prom.WriteRaw(filtered)
+}
+
+// Restore sets the device metrics from previously persisted readings, e.g. after
+// a restart. Unlike Observe, the readings are not written to the sinks and are
+// ignored if newer readings were already observed or the device filter rejects
+// the device. Only the MAC and name of the devices are persisted, so devices
+// rejected on other criteria are only pruned by the next sync.
+func (a *AirMonitorLite) Restore(readings []Reading) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	latest := make(map[string]float64)
+	infos := make(map[string]client.DeviceInfo)
+	byDevice := make(map[string][]Reading)
+	restored := make([]Reading, 0, len(readings))
+	for _, r := range readings {
+		ts := float64(r.Timestamp.Unix())
+		if ts <= a.lastSeen[r.Device.MAC] || !a.keepRestored(r.Device) {
+			continue
+		}
+		restored = append(restored, r)
+		byDevice[r.Device.MAC] = append(byDevice[r.Device.MAC], r)
+		latest[r.Device.MAC] = max(latest[r.Device.MAC], ts)
+		infos[r.Device.MAC] = r.Device
+	}
+	for mac, ts := range latest {
+		a.lastSeen[mac] = ts
+		a.m.lastReportTimestamp.set(ts, a.deviceLabels(infos[mac])...)
+		a.cacheReadings(infos[mac], SourceStore, byDevice[mac])
+	}
+	_ = a.prom.Write(context.Background(), restored)
+}
+
+// keepRestored reports whether the device filter keeps a device restored from
+// the store, which are all of the supported model. It must be called with the
+// lock held.
+func (a *AirMonitorLite) keepRestored(info client.DeviceInfo) bool {
+	if known, ok := a.devices[info.MAC]; ok {
+		info = known.Info
+	} else if info.Product.Code == "" {
+		info.Product.Code = DeviceModel
+	}
+	keep, _ := a.filter.Keep(info)
+	return keep
+}
+
+// ObservePush updates the device metrics from data pushed by the Qingping cloud.
+func (a *AirMonitorLite) ObservePush(info client.DeviceInfo, data []client.DeviceData) {
+	a.observeExternal(SourcePush, info, data)
+}
+
+// ObserveMQTT updates the device metrics from reports received over MQTT.
+func (a *AirMonitorLite) ObserveMQTT(info client.DeviceInfo, data []client.DeviceData) {
+	a.observeExternal(SourceMQTT, info, data)
+}
+
+// observeExternal handles readings that do not come from polling. Devices of
+// other models than the one handled by the exporter are ignored, while devices
+// of unknown model are accepted.
+func (a *AirMonitorLite) observeExternal(source string, info client.DeviceInfo, data []client.DeviceData) {
+	if info.Product.Code != "" && info.Product.Code != DeviceModel {
+		return
+	}
+	if info.Product.Code != "" {
+		a.UpdateDeviceInfo(info)
+	}
+	a.Observe(source, info, data)
+}
+
+// Device returns the cloud information of a supported device, as of the last sync.
+func (a *AirMonitorLite) Device(mac string) (client.DeviceInfo, bool) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	device, ok := a.devices[mac]
+	return device.Info, ok
+}
+
+// UpdateDeviceInfo updates the device information metric.
+func (a *AirMonitorLite) UpdateDeviceInfo(info client.DeviceInfo) {
 	status := "online"
-	if device.Info.Status.Offline {
+	if info.Status.Offline {
 		status = "offline"
 	}
 
 	value := 1.0
-	if device.Info.Status.Offline {
+	if info.Status.Offline {
 		value = 0.0
 	}
 
-	a.m.deviceInfo.WithLabelValues(
-		device.Info.Name,
-		device.Info.MAC,
+	a.mtx.Lock()
+	labels := append([]string{
+		info.Name,
+		info.MAC,
 		status,
-		device.Info.Product.EnName,
-		device.Info.Product.Code,
-		strconv.FormatInt(int64(device.Info.Product.ID), 10),
-	).Set(value)
+		info.Product.EnName,
+		info.Product.Code,
+		strconv.FormatInt(int64(info.Product.ID), 10),
+	}, a.deviceLabels(info)[1:]...)
+	// The status and name are labels, so drop the series of the previous ones.
+	key := strings.Join(labels, "\xff")
+	if prev, ok := a.infoLabels[info.MAC]; ok && prev != key {
+		a.m.deviceInfo.deletePartialMatch(prometheus.Labels{LabelDeviceMAC: info.MAC})
+	}
+	a.infoLabels[info.MAC] = key
+	a.m.deviceInfo.set(value, labels...)
+	a.mtx.Unlock()
+
+	a.sinks.updateDevice(info)
+}
+
+func (a *AirMonitorLite) updateDeviceInfo(device client.Device) {
+	a.UpdateDeviceInfo(device.Info)
+
+	// Until a reading is exported for the device, fall back to the timestamp
+	// of the data in the device list. The series of a device pruned and listed
+	// again is set back to its last reading.
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.devices[device.Info.MAC] = device
+	ts, ok := a.lastSeen[device.Info.MAC]
+	if !ok {
+		ts = device.Data.Timestamp.Value
+	}
+	a.m.lastReportTimestamp.set(ts, a.deviceLabels(device.Info)...)
+}
+
+// deviceLabels returns the device MAC followed by the extra label values of
+// the device. When the values changed, e.g. after the device was renamed, the
+// series with the previous ones are removed. It must be called with the lock held.
+func (a *AirMonitorLite) deviceLabels(info client.DeviceInfo) []string {
+	values := a.labels.Values(info)
+	key := strings.Join(values, "\xff")
+	if prev, ok := a.labelValues[info.MAC]; ok && prev != key {
+		a.deleteSeries(info.MAC)
+	}
+	a.labelValues[info.MAC] = key
+	return append([]string{info.MAC}, values...)
+}
 
-	a.m.lastDataTimestamp.WithLabelValues(device.Info.MAC).Set(device.Data.Timestamp.Value)
+// deleteSeries removes the series of a device. It must be called with the
+// lock held.
+func (a *AirMonitorLite) deleteSeries(mac string) {
+	a.prom.DeleteDevice(mac)
+	match := prometheus.Labels{LabelDeviceMAC: mac}
+	a.m.lastReportTimestamp.deletePartialMatch(match)
+	a.m.deviceInfo.deletePartialMatch(match)
+	a.m.calibrationInfo.DeletePartialMatch(match)
+	a.m.reportingGaps.DeletePartialMatch(match)
+	a.m.reportingRatio.DeletePartialMatch(match)
+	a.m.reportingLongestGap.DeletePartialMatch(match)
 }
@@ -0,0 +1,182 @@
+package exporter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+)
+
+func TestAirMonitorLite_Observe(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	a := NewAirMonitorLiteExporter(nil, reg, log.NewNopLogger())
+	info := client.DeviceInfo{MAC: "mac1", Product: client.ProductInfo{Code: DeviceModel}}
+
+	a.Observe(SourcePoll, info, []client.DeviceData{
+		{Timestamp: client.ValueData{Value: 100}, CO2: client.ValueData{Value: 400}},
+		{Timestamp: client.ValueData{Value: 200}, CO2: client.ValueData{Value: 450}},
+	})
+	assert.Equal(t, 450.0, testutil.ToFloat64(a.prom.gauges["co2"][0].vec.WithLabelValues("mac1")))
+
+	// A push with the same reading is a duplicate and an older one is ignored.
+	a.ObservePush(info, []client.DeviceData{{Timestamp: client.ValueData{Value: 200}, CO2: client.ValueData{Value: 450}}})
+	a.ObservePush(info, []client.DeviceData{{Timestamp: client.ValueData{Value: 150}, CO2: client.ValueData{Value: 999}}})
+	assert.Equal(t, 450.0, testutil.ToFloat64(a.prom.gauges["co2"][0].vec.WithLabelValues("mac1")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(a.m.readings[0].WithLabelValues(SourcePush, "duplicate")))
+
+	a.ObservePush(info, []client.DeviceData{{Timestamp: client.ValueData{Value: 300}, CO2: client.ValueData{Value: 500}}})
+	assert.Equal(t, 500.0, testutil.ToFloat64(a.prom.gauges["co2"][0].vec.WithLabelValues("mac1")))
+	assert.Equal(t, 300.0, testutil.ToFloat64(a.m.lastReportTimestamp[0].WithLabelValues("mac1")))
+
+	// Pushes for other models are ignored.
+	a.ObservePush(client.DeviceInfo{MAC: "mac2", Product: client.ProductInfo{Code: "CGS1"}},
+		[]client.DeviceData{{Timestamp: client.ValueData{Value: 300}}})
+	assert.Equal(t, 1, testutil.CollectAndCount(a.prom.gauges["co2"][0].vec))
+}
+
+func TestAirMonitorLite_Restore(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	a := NewAirMonitorLiteExporter(nil, reg, log.NewNopLogger())
+	info := client.DeviceInfo{MAC: "mac1", Product: client.ProductInfo{Code: DeviceModel}}
+
+	a.Restore(NewReadings(info, []client.DeviceData{{Timestamp: client.ValueData{Value: 200}, CO2: client.ValueData{Value: 450}}}))
+	assert.Equal(t, 450.0, testutil.ToFloat64(a.prom.gauges["co2"][0].vec.WithLabelValues("mac1")))
+	assert.Equal(t, 200.0, testutil.ToFloat64(a.m.lastReportTimestamp[0].WithLabelValues("mac1")))
+
+	// Readings already restored are duplicates, and restoring never overrides newer readings.
+	a.Observe(SourcePoll, info, []client.DeviceData{{Timestamp: client.ValueData{Value: 200}, CO2: client.ValueData{Value: 450}}})
+	assert.Equal(t, 1.0, testutil.ToFloat64(a.m.readings[0].WithLabelValues(SourcePoll, "duplicate")))
+
+	a.Observe(SourcePoll, info, []client.DeviceData{{Timestamp: client.ValueData{Value: 300}, CO2: client.ValueData{Value: 500}}})
+	a.Restore(NewReadings(info, []client.DeviceData{{Timestamp: client.ValueData{Value: 250}, CO2: client.ValueData{Value: 999}}}))
+	assert.Equal(t, 500.0, testutil.ToFloat64(a.prom.gauges["co2"][0].vec.WithLabelValues("mac1")))
+}
+
+func TestAirMonitorLite_RestoreFilter(t *testing.T) {
+	filter := &DeviceFilter{Include: []DeviceSelector{{ProductCodes: []string{DeviceModel}}}, Exclude: []DeviceSelector{{Name: "Demo"}}}
+	require.NoError(t, filter.Validate())
+	a := NewAirMonitorLiteExporter(nil, prometheus.NewRegistry(), log.NewNopLogger(), WithDeviceFilter(filter))
+
+	// The store only keeps the MAC and name of the devices.
+	for _, info := range []client.DeviceInfo{{MAC: "mac1", Name: "Office"}, {MAC: "mac2", Name: "Demo"}} {
+		a.Restore(NewReadings(info, []client.DeviceData{{Timestamp: client.ValueData{Value: 200}, CO2: client.ValueData{Value: 450}}}))
+	}
+	assert.Equal(t, 1, testutil.CollectAndCount(a.prom.gauges["co2"][0].vec))
+	assert.Equal(t, 1, testutil.CollectAndCount(a.m.lastReportTimestamp[0]))
+	states := a.Devices()
+	require.Len(t, states, 1)
+	assert.Equal(t, "mac1", states[0].Info.MAC)
+}
+
+func TestAirMonitorLite_UnitConversions(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	a := NewAirMonitorLiteExporter(nil, reg, log.NewNopLogger(), WithComfortMetrics(true), WithUnitConversions("fahrenheit", "kelvin", "percent", "hectopascals"))
+	info := client.DeviceInfo{MAC: "mac1", Product: client.ProductInfo{Code: DeviceModel}}
+
+	a.Observe(SourcePoll, info, []client.DeviceData{{
+		Timestamp:   client.ValueData{Value: 100},
+		Temperature: client.ValueData{Value: 25},
+		Humidity:    client.ValueData{Value: 50},
+		CO2:         client.ValueData{Value: 450},
+	}})
+
+	for _, tc := range []struct {
+		metric   string
+		expected float64
+	}{
+		{metric: "qingping_temperature_celsius", expected: 25},
+		{metric: "qingping_temperature_fahrenheit", expected: 77},
+		{metric: "qingping_temperature_kelvin", expected: 298.15},
+		{metric: "qingping_dew_point_fahrenheit", expected: 56.93},
+		{metric: "qingping_co2_ppm", expected: 450},
+		{metric: "qingping_co2_percent", expected: 0.045},
+		{metric: "qingping_vapour_pressure_deficit_hectopascals", expected: 15.80},
+	} {
+		families, err := reg.Gather()
+		require.NoError(t, err)
+		found := false
+		for _, mf := range families {
+			if mf.GetName() == tc.metric {
+				found = true
+				require.Len(t, mf.GetMetric(), 1)
+				assert.InDelta(t, tc.expected, mf.GetMetric()[0].GetGauge().GetValue(), 0.01, tc.metric)
+			}
+		}
+		assert.True(t, found, tc.metric)
+	}
+	// Conversions only apply to the fields of their unit.
+	count, err := testutil.GatherAndCount(reg, "qingping_relative_humidity_percent_percent", "qingping_pm25_fahrenheit")
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestAirMonitorLite_LegacyNames(t *testing.T) {
+	info := client.DeviceInfo{MAC: "mac1", Product: client.ProductInfo{Code: DeviceModel}}
+	data := []client.DeviceData{{Timestamp: client.ValueData{Value: 100}, Temperature: client.ValueData{Value: 25}}}
+
+	reg := prometheus.NewRegistry()
+	a := NewAirMonitorLiteExporter(nil, reg, log.NewNopLogger(), WithLegacyNames(true), WithUnitConversions("fahrenheit"))
+	a.Observe(SourcePoll, info, data)
+	a.UpdateDeviceInfo(info)
+
+	for _, metric := range []string{
+		MetricTemperature, LegacyMetricTemperature,
+		"qingping_temperature_fahrenheit", "air_monitor_temperature_fahrenheit",
+		MetricLastReportTimestamp, LegacyMetricLastReportTimestamp,
+		"qingping_readings_total", "air_monitor_readings_total",
+		"qingping_device_info", "air_monitor_device_info",
+	} {
+		count, err := testutil.GatherAndCount(reg, metric)
+		require.NoError(t, err)
+		assert.Equal(t, 1, count, metric)
+	}
+
+	// Without legacy names, only the new schema is exposed.
+	reg = prometheus.NewRegistry()
+	a = NewAirMonitorLiteExporter(nil, reg, log.NewNopLogger(), WithUnitConversions("fahrenheit"))
+	a.Observe(SourcePoll, info, data)
+	count, err := testutil.GatherAndCount(reg, LegacyMetricTemperature, LegacyMetricLastReportTimestamp, "air_monitor_readings_total")
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+	count, err = testutil.GatherAndCount(reg, MetricTemperature)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestAirMonitorLite_CO2Percent(t *testing.T) {
+	a := NewAirMonitorLiteExporter(nil, prometheus.NewRegistry(), log.NewNopLogger())
+	info := client.DeviceInfo{MAC: "mac1", Product: client.ProductInfo{Code: DeviceModel}}
+
+	a.Observe(SourcePoll, info, []client.DeviceData{{Timestamp: client.ValueData{Value: 100}, CO2Percent: client.ValueData{Value: 0.045}}})
+	assert.InDelta(t, 450.0, testutil.ToFloat64(a.prom.gauges["co2"][0].vec.WithLabelValues("mac1")), 1e-9)
+}
+
+func TestAirMonitorLite_UpdateDeviceInfo(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	a := NewAirMonitorLiteExporter(nil, reg, log.NewNopLogger())
+	info := client.DeviceInfo{MAC: "mac1", Name: "Office", Product: client.ProductInfo{Code: DeviceModel}}
+
+	info.Status.Offline = true
+	a.UpdateDeviceInfo(info)
+	info.Status.Offline = false
+	a.UpdateDeviceInfo(info)
+
+	// The offline series is gone once the device is back online.
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP qingping_device_info Device information
+# TYPE qingping_device_info gauge
+qingping_device_info{device_mac="mac1",device_name="Office",product_code="CGDN1",product_id="0",product_name="",status="online"} 1
+`), MetricDeviceInfo))
+
+	info.Name = "Meeting room"
+	a.UpdateDeviceInfo(info)
+	count, err := testutil.GatherAndCount(reg, MetricDeviceInfo)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
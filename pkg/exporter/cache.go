@@ -0,0 +1,213 @@
+package exporter
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+)
+
+// DefaultCacheRetention is how long the readings of a device are kept in memory.
+const DefaultCacheRetention = 24 * time.Hour
+
+// SourceStore is the source of the cached readings restored from the local store.
+const SourceStore = "store"
+
+// Snapshot holds the readings of a device taken at the same time, by field name.
+type Snapshot struct {
+	Timestamp time.Time          `json:"timestamp"`
+	Values    map[string]float64 `json:"values"`
+}
+
+// SyncStatus describes the outcome of a sync, or of fetching the data of a
+// device during a sync.
+type SyncStatus struct {
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration_seconds,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// DeviceState is the cached state of a device.
+type DeviceState struct {
+	Info client.DeviceInfo `json:"info"`
+	// Last holds the newest readings, and Source where they came from.
+	Last   *Snapshot `json:"last,omitempty"`
+	Source string    `json:"source,omitempty"`
+	// LastSync is the outcome of the last poll of the device data.
+	LastSync *SyncStatus `json:"last_sync,omitempty"`
+	// Reported is the time of the last report of the device in the device
+	// list, known even when none of its readings is cached.
+	Reported *time.Time `json:"reported,omitempty"`
+}
+
+type deviceCache struct {
+	info     client.DeviceInfo
+	source   string
+	lastSync *SyncStatus
+	// history is sorted by timestamp.
+	history []Snapshot
+}
+
+// cacheReadings appends new readings to the history of the device, dropping the
+// ones older than the retention. It must be called with the lock held.
+func (a *AirMonitorLite) cacheReadings(info client.DeviceInfo, source string, readings []Reading) {
+	if len(readings) == 0 {
+		return
+	}
+	byTime := make(map[time.Time]map[string]float64)
+	for _, r := range readings {
+		if byTime[r.Timestamp] == nil {
+			byTime[r.Timestamp] = make(map[string]float64)
+		}
+		byTime[r.Timestamp][r.Field] = r.Value
+	}
+	snapshots := make([]Snapshot, 0, len(byTime))
+	for ts, values := range byTime {
+		snapshots = append(snapshots, Snapshot{Timestamp: ts.UTC(), Values: values})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Timestamp.Before(snapshots[j].Timestamp)
+	})
+
+	c := a.deviceCache(info.MAC)
+	if info.Product.Code != "" || c.info.MAC == "" {
+		c.info = info
+	}
+	c.source = source
+	c.history = append(c.history, snapshots...)
+
+	oldest := c.history[len(c.history)-1].Timestamp.Add(-a.cacheRetention)
+	drop := sort.Search(len(c.history), func(i int) bool {
+		return !c.history[i].Timestamp.Before(oldest)
+	})
+	c.history = append(c.history[:0:0], c.history[drop:]...)
+}
+
+// deviceCache returns the cache of a device, creating it if needed. It must be
+// called with the lock held.
+func (a *AirMonitorLite) deviceCache(mac string) *deviceCache {
+	c, ok := a.cache[mac]
+	if !ok {
+		c = &deviceCache{info: client.DeviceInfo{MAC: mac}}
+		a.cache[mac] = c
+	}
+	return c
+}
+
+// pruneDevices forgets the devices that are not kept, e.g. removed from the
+// account or filtered out, and removes their series. This covers the devices
+// of the inventory and the ones only restored from the store, while devices
+// only known from pushed or MQTT readings are left as is.
+func (a *AirMonitorLite) pruneDevices(kept map[string]bool) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	forget := func(mac string) {
+		a.deleteSeries(mac)
+		delete(a.devices, mac)
+		delete(a.cache, mac)
+		delete(a.labelValues, mac)
+		delete(a.infoLabels, mac)
+		delete(a.calibrated, mac)
+	}
+	for mac := range a.devices {
+		if !kept[mac] {
+			forget(mac)
+		}
+	}
+	for mac, c := range a.cache {
+		if !kept[mac] && c.source == SourceStore {
+			forget(mac)
+		}
+	}
+}
+
+// Devices returns the state of the devices known from the inventory or from
+// their readings, sorted by name and MAC.
+func (a *AirMonitorLite) Devices() []DeviceState {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	states := make(map[string]*DeviceState)
+	for mac, c := range a.cache {
+		s := &DeviceState{Info: c.info, Source: c.source, LastSync: c.lastSync}
+		if len(c.history) > 0 {
+			last := c.history[len(c.history)-1]
+			s.Last = &last
+		}
+		states[mac] = s
+	}
+	for mac, device := range a.devices {
+		s, ok := states[mac]
+		if !ok {
+			s = &DeviceState{}
+			states[mac] = s
+		}
+		s.Info = device.Info
+		if ts := device.Data.Timestamp.Value; ts > 0 {
+			reported := time.Unix(int64(ts), 0).UTC()
+			s.Reported = &reported
+		}
+	}
+
+	out := make([]DeviceState, 0, len(states))
+	for _, s := range states {
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Info.Name != out[j].Info.Name {
+			return out[i].Info.Name < out[j].Info.Name
+		}
+		return out[i].Info.MAC < out[j].Info.MAC
+	})
+	return out
+}
+
+// History returns the cached readings of a device taken within [from, to], and
+// whether the device is known.
+func (a *AirMonitorLite) History(mac string, from, to time.Time) ([]Snapshot, bool) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	c, cached := a.cache[mac]
+	_, listed := a.devices[mac]
+	if !cached {
+		return []Snapshot{}, listed
+	}
+	out := []Snapshot{}
+	for _, s := range c.history {
+		if !s.Timestamp.Before(from) && !s.Timestamp.After(to) {
+			out = append(out, s)
+		}
+	}
+	return out, true
+}
+
+// ParseTime parses an RFC3339 time or a Unix timestamp in seconds, e.g. the
+// bounds of a query, returning def when the value is empty.
+func ParseTime(value string, def time.Time) (time.Time, error) {
+	if value == "" {
+		return def, nil
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errors.Newf("expected RFC3339 or unix seconds, got %q", value)
+	}
+	return t, nil
+}
+
+// LastSync returns the outcome of the last sync, or nil before the first one.
+func (a *AirMonitorLite) LastSync() *SyncStatus {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.lastSync == nil {
+		return nil
+	}
+	s := *a.lastSync
+	return &s
+}
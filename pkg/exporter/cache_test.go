@@ -0,0 +1,64 @@
+package exporter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+)
+
+func TestAirMonitorLite_Cache(t *testing.T) {
+	a := NewAirMonitorLiteExporter(nil, prometheus.NewRegistry(), log.NewNopLogger(), WithCacheRetention(time.Hour))
+	office := client.DeviceInfo{MAC: "mac1", Name: "Office", Product: client.ProductInfo{Code: DeviceModel}}
+	bedroom := client.DeviceInfo{MAC: "mac2", Name: "Bedroom", Product: client.ProductInfo{Code: DeviceModel}}
+
+	a.Restore(NewReadings(bedroom, []client.DeviceData{{Timestamp: client.ValueData{Value: 100}, CO2: client.ValueData{Value: 700}}}))
+	a.Observe(SourcePoll, office, []client.DeviceData{
+		{Timestamp: client.ValueData{Value: 200}, CO2: client.ValueData{Value: 400}},
+		{Timestamp: client.ValueData{Value: 3000}, CO2: client.ValueData{Value: 450}},
+	})
+	a.ObservePush(office, []client.DeviceData{{Timestamp: client.ValueData{Value: 4000}, CO2: client.ValueData{Value: 500}}})
+
+	devices := a.Devices()
+	require.Len(t, devices, 2)
+	assert.Equal(t, "Bedroom", devices[0].Info.Name)
+	assert.Equal(t, SourceStore, devices[0].Source)
+	assert.Equal(t, 700.0, devices[0].Last.Values["co2"])
+	assert.Equal(t, SourcePush, devices[1].Source)
+	assert.Equal(t, time.Unix(4000, 0).UTC(), devices[1].Last.Timestamp)
+	assert.Equal(t, 500.0, devices[1].Last.Values["co2"])
+
+	// Readings older than the retention are dropped.
+	history, ok := a.History("mac1", time.Unix(0, 0), time.Unix(5000, 0))
+	require.True(t, ok)
+	require.Len(t, history, 2)
+	assert.Equal(t, 450.0, history[0].Values["co2"])
+
+	history, ok = a.History("mac1", time.Unix(3500, 0), time.Unix(5000, 0))
+	require.True(t, ok)
+	assert.Len(t, history, 1)
+
+	_, ok = a.History("mac3", time.Unix(0, 0), time.Unix(5000, 0))
+	assert.False(t, ok)
+	assert.Nil(t, a.LastSync())
+}
+
+func TestParseTime(t *testing.T) {
+	def := time.Unix(1, 0)
+	for value, expected := range map[string]time.Time{
+		"":                     def,
+		"1726750800":           time.Unix(1726750800, 0),
+		"2024-09-19T13:00:00Z": time.Unix(1726750800, 0),
+	} {
+		got, err := ParseTime(value, def)
+		require.NoError(t, err, value)
+		assert.True(t, expected.Equal(got), value)
+	}
+	_, err := ParseTime("yesterday", def)
+	assert.Error(t, err)
+}
@@ -0,0 +1,165 @@
+package exporter
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/efficientgo/core/errors"
+	"gopkg.in/yaml.v3"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+)
+
+// FieldCalibration corrects the value of a field as value*multiplier+offset,
+// clamped to [min, max].
+type FieldCalibration struct {
+	Offset     float64  `yaml:"offset"`
+	Multiplier *float64 `yaml:"multiplier,omitempty"`
+	Min        *float64 `yaml:"min,omitempty"`
+	Max        *float64 `yaml:"max,omitempty"`
+}
+
+// Apply returns the corrected value.
+func (c FieldCalibration) Apply(v float64) float64 {
+	if c.Multiplier != nil {
+		v *= *c.Multiplier
+	}
+	v += c.Offset
+	if c.Min != nil && v < *c.Min {
+		v = *c.Min
+	}
+	if c.Max != nil && v > *c.Max {
+		v = *c.Max
+	}
+	return v
+}
+
+// DeviceCalibration holds the corrections of a device, selected by MAC or name.
+type DeviceCalibration struct {
+	MAC    string                      `yaml:"mac,omitempty"`
+	Name   string                      `yaml:"name,omitempty"`
+	Fields map[string]FieldCalibration `yaml:"fields"`
+}
+
+// Calibration holds the corrections applied to device readings before they
+// are exported.
+type Calibration struct {
+	Devices []DeviceCalibration `yaml:"devices"`
+}
+
+// LoadCalibration reads and validates a calibration file.
+func LoadCalibration(path string) (*Calibration, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read calibration file %s", path)
+	}
+
+	c := &Calibration{}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil {
+		return nil, errors.Wrapf(err, "parse calibration file %s", path)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid calibration file %s", path)
+	}
+	return c, nil
+}
+
+// Validate checks that every device is selected either by MAC or by name and
+// only corrects known fields.
+func (c *Calibration) Validate() error {
+	for i, d := range c.Devices {
+		if (d.MAC == "") == (d.Name == "") {
+			return errors.Newf("device %d: exactly one of mac or name must be set", i)
+		}
+		if err := ValidateFields(d.Fields); err != nil {
+			return errors.Wrapf(err, "device %d", i)
+		}
+	}
+	return nil
+}
+
+// ValidateFields checks that the corrections of a device only apply to known
+// fields and are well-formed.
+func ValidateFields(fields map[string]FieldCalibration) error {
+	for name, f := range fields {
+		if _, ok := dataField(&client.DeviceData{}, name); !ok {
+			return errors.Newf("unknown field %q", name)
+		}
+		if f.Multiplier != nil && *f.Multiplier == 0 {
+			return errors.Newf("field %s: multiplier must not be zero", name)
+		}
+		if f.Min != nil && f.Max != nil && *f.Min > *f.Max {
+			return errors.Newf("field %s: min is greater than max", name)
+		}
+	}
+	return nil
+}
+
+// For returns the corrections of a device. Devices selected by MAC take
+// precedence over devices selected by name.
+func (c *Calibration) For(info client.DeviceInfo) (map[string]FieldCalibration, bool) {
+	if c == nil {
+		return nil, false
+	}
+	for _, d := range c.Devices {
+		if d.MAC != "" && strings.EqualFold(d.MAC, info.MAC) {
+			return d.Fields, true
+		}
+	}
+	for _, d := range c.Devices {
+		if d.Name != "" && d.Name == info.Name {
+			return d.Fields, true
+		}
+	}
+	return nil, false
+}
+
+// calibrate returns a copy of the data rows with the corrections applied.
+// Fields missing from a row, decoded as zero, are left as is so the
+// corrections do not make up values.
+func calibrate(fields map[string]FieldCalibration, data []client.DeviceData) []client.DeviceData {
+	out := make([]client.DeviceData, len(data))
+	for i, d := range data {
+		for name, f := range fields {
+			if v, ok := dataField(&d, name); ok && v.Value != 0 {
+				v.Value = f.Apply(v.Value)
+			}
+		}
+		out[i] = d
+	}
+	return out
+}
+
+// calibrationLabels returns the label values describing a field correction.
+func calibrationLabels(f FieldCalibration) (offset, multiplier, min, max string) {
+	format := func(v *float64, def string) string {
+		if v == nil {
+			return def
+		}
+		return strconv.FormatFloat(*v, 'g', -1, 64)
+	}
+	return strconv.FormatFloat(f.Offset, 'g', -1, 64), format(f.Multiplier, "1"), format(f.Min, ""), format(f.Max, "")
+}
+
+// dataField returns the value of a sensor field of a data row.
+func dataField(d *client.DeviceData, name string) (*client.ValueData, bool) {
+	switch name {
+	case "temperature":
+		return &d.Temperature, true
+	case "humidity":
+		return &d.Humidity, true
+	case "co2":
+		return &d.CO2, true
+	case "pm25":
+		return &d.PM25, true
+	case "pm10":
+		return &d.PM10, true
+	case "battery":
+		return &d.Battery, true
+	}
+	return nil, false
+}
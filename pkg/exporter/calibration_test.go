@@ -0,0 +1,134 @@
+package exporter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+)
+
+func TestLoadCalibration(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		content   string
+		expectErr bool
+	}{
+		{
+			name: "valid",
+			content: `
+devices:
+  - mac: 34CE00000000
+    fields:
+      temperature: {offset: -1.5}
+  - name: Office
+    fields:
+      co2: {offset: -40, multiplier: 1.02, min: 400, max: 5000}
+`,
+		},
+		{name: "mac and name", content: "devices: [{mac: 34CE00000000, name: Office, fields: {co2: {offset: 1}}}]", expectErr: true},
+		{name: "no selector", content: "devices: [{fields: {co2: {offset: 1}}}]", expectErr: true},
+		{name: "unknown field", content: "devices: [{mac: 34CE00000000, fields: {tvoc: {offset: 1}}}]", expectErr: true},
+		{name: "unknown key", content: "devices: [{mac: 34CE00000000, fields: {co2: {ofset: 1}}}]", expectErr: true},
+		{name: "zero multiplier", content: "devices: [{mac: 34CE00000000, fields: {co2: {multiplier: 0}}}]", expectErr: true},
+		{name: "min above max", content: "devices: [{mac: 34CE00000000, fields: {co2: {min: 10, max: 5}}}]", expectErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "calibration.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(tc.content), 0o600))
+
+			_, err := LoadCalibration(path)
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestFieldCalibration_Apply(t *testing.T) {
+	multiplier, lo, hi := 2.0, 0.0, 100.0
+	c := FieldCalibration{Offset: -10, Multiplier: &multiplier, Min: &lo, Max: &hi}
+
+	assert.Equal(t, 30.0, c.Apply(20))
+	assert.Equal(t, 0.0, c.Apply(2))
+	assert.Equal(t, 100.0, c.Apply(70))
+	assert.Equal(t, 18.5, FieldCalibration{Offset: -1.5}.Apply(20))
+}
+
+func TestCalibrate(t *testing.T) {
+	fields := map[string]FieldCalibration{"humidity": {Offset: 5}, "co2": {Offset: -40}}
+	data := []client.DeviceData{
+		{Humidity: client.ValueData{Value: 50}, CO2: client.ValueData{Value: 450}},
+		// A row without humidity nor CO2 gets no fabricated value.
+		{Temperature: client.ValueData{Value: 21}},
+	}
+
+	out := calibrate(fields, data)
+	assert.Equal(t, 55.0, out[0].Humidity.Value)
+	assert.Equal(t, 410.0, out[0].CO2.Value)
+	assert.Equal(t, data[1], out[1])
+	assert.Empty(t, NewComfortReadings(client.DeviceInfo{MAC: "mac1"}, out[1:]))
+}
+
+func TestAirMonitorLite_Calibration(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	calibration := &Calibration{Devices: []DeviceCalibration{
+		{MAC: "34ce00000000", Fields: map[string]FieldCalibration{"temperature": {Offset: -1.5}}},
+		{Name: "Bedroom", Fields: map[string]FieldCalibration{"co2": {Offset: -40}}},
+	}}
+	a := NewAirMonitorLiteExporter(nil, reg, log.NewNopLogger(), WithCalibration(calibration, true))
+
+	office := client.DeviceInfo{MAC: "34CE00000000", Name: "Office"}
+	bedroom := client.DeviceInfo{MAC: "34CE00000001", Name: "Bedroom"}
+	data := []client.DeviceData{{
+		Timestamp:   client.ValueData{Value: 100},
+		Temperature: client.ValueData{Value: 25},
+		CO2:         client.ValueData{Value: 500},
+	}}
+	a.Observe(SourcePoll, office, data)
+	a.Observe(SourcePoll, bedroom, data)
+
+	temperature, co2 := a.prom.gauges["temperature"][0].vec, a.prom.gauges["co2"][0].vec
+	assert.Equal(t, 23.5, testutil.ToFloat64(temperature.WithLabelValues(office.MAC, "")))
+	assert.Equal(t, 25.0, testutil.ToFloat64(temperature.WithLabelValues(office.MAC, "true")))
+	assert.Equal(t, 500.0, testutil.ToFloat64(co2.WithLabelValues(office.MAC, "")))
+	assert.Equal(t, 460.0, testutil.ToFloat64(co2.WithLabelValues(bedroom.MAC, "")))
+	assert.Equal(t, 500.0, testutil.ToFloat64(co2.WithLabelValues(bedroom.MAC, "true")))
+
+	// Raw series only exist for the corrected fields.
+	assert.Equal(t, 3, testutil.CollectAndCount(temperature))
+	assert.Equal(t, 3, testutil.CollectAndCount(co2))
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(a.m.calibrationInfo.WithLabelValues(office.MAC, "temperature", "-1.5", "1", "", "")))
+	assert.Equal(t, 2, testutil.CollectAndCount(a.m.calibrationInfo))
+
+	// On reload, the series of the previous corrections of the office are
+	// removed, while the ones of the unchanged bedroom are kept.
+	a.SetCalibration(&Calibration{Devices: []DeviceCalibration{
+		{MAC: "34ce00000000", Fields: map[string]FieldCalibration{"temperature": {Offset: -2}}},
+		{Name: "Bedroom", Fields: map[string]FieldCalibration{"co2": {Offset: -40}}},
+	}})
+	assert.Equal(t, 2, testutil.CollectAndCount(temperature))
+	assert.Equal(t, 3, testutil.CollectAndCount(co2))
+	assert.Equal(t, 1, testutil.CollectAndCount(a.m.calibrationInfo))
+
+	a.Observe(SourcePoll, office, []client.DeviceData{{Timestamp: client.ValueData{Value: 200}, Temperature: client.ValueData{Value: 25}}})
+	assert.Equal(t, 23.0, testutil.ToFloat64(temperature.WithLabelValues(office.MAC, "")))
+	assert.Equal(t, 25.0, testutil.ToFloat64(temperature.WithLabelValues(office.MAC, "true")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(a.m.calibrationInfo.WithLabelValues(office.MAC, "temperature", "-2", "1", "", "")))
+	assert.Equal(t, 2, testutil.CollectAndCount(a.m.calibrationInfo))
+
+	// Removing the corrections of a device removes all its calibration series.
+	a.SetCalibration(nil)
+	assert.Equal(t, 2, testutil.CollectAndCount(temperature))
+	assert.Equal(t, 2, testutil.CollectAndCount(co2))
+	assert.Equal(t, 0, testutil.CollectAndCount(a.m.calibrationInfo))
+}
@@ -0,0 +1,172 @@
+package exporter
+
+import (
+	"math"
+	"time"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+)
+
+// UnitGramsPerCubicMeter is the unit of the absolute humidity.
+const UnitGramsPerCubicMeter = "g/m3"
+
+// Names of the comfort gauges.
+const (
+	MetricDewPoint              = "qingping_dew_point_celsius"
+	MetricAbsoluteHumidity      = "qingping_absolute_humidity_grams_per_cubic_meter"
+	MetricHeatIndex             = "qingping_heat_index_celsius"
+	MetricHumidex               = "qingping_humidex"
+	MetricVapourPressureDeficit = "qingping_vapour_pressure_deficit_kilopascals"
+
+	LegacyMetricDewPoint              = "air_monitor_dew_point"
+	LegacyMetricAbsoluteHumidity      = "air_monitor_absolute_humidity"
+	LegacyMetricHeatIndex             = "air_monitor_heat_index"
+	LegacyMetricHumidex               = "air_monitor_humidex"
+	LegacyMetricVapourPressureDeficit = "air_monitor_vapour_pressure_deficit"
+)
+
+// ComfortFields are derived from the temperature and relative humidity of a
+// device data row.
+var ComfortFields = []Field{
+	{
+		Name:         "dew_point",
+		Unit:         UnitCelsius,
+		Metric:       MetricDewPoint,
+		LegacyMetric: LegacyMetricDewPoint,
+		Help:         "Dew point in degrees Celsius",
+		Value:        func(d client.DeviceData) float64 { return DewPoint(d.Temperature.Value, d.Humidity.Value) },
+	},
+	{
+		Name:         "absolute_humidity",
+		Unit:         UnitGramsPerCubicMeter,
+		Metric:       MetricAbsoluteHumidity,
+		LegacyMetric: LegacyMetricAbsoluteHumidity,
+		Help:         "Absolute humidity in g/m³",
+		Value:        func(d client.DeviceData) float64 { return AbsoluteHumidity(d.Temperature.Value, d.Humidity.Value) },
+	},
+	{
+		Name:         "heat_index",
+		Unit:         UnitCelsius,
+		Metric:       MetricHeatIndex,
+		LegacyMetric: LegacyMetricHeatIndex,
+		Help:         "Heat index (apparent temperature) in degrees Celsius",
+		Value:        func(d client.DeviceData) float64 { return HeatIndex(d.Temperature.Value, d.Humidity.Value) },
+	},
+	{
+		Name:         "humidex",
+		Unit:         UnitCelsius,
+		Metric:       MetricHumidex,
+		LegacyMetric: LegacyMetricHumidex,
+		Help:         "Humidex in degrees Celsius",
+		Value:        func(d client.DeviceData) float64 { return Humidex(d.Temperature.Value, d.Humidity.Value) },
+	},
+	{
+		Name:         "vapour_pressure_deficit",
+		Unit:         UnitKilopascal,
+		Metric:       MetricVapourPressureDeficit,
+		LegacyMetric: LegacyMetricVapourPressureDeficit,
+		Help:         "Vapour pressure deficit in kPa",
+		Value:        func(d client.DeviceData) float64 { return VapourPressureDeficit(d.Temperature.Value, d.Humidity.Value) },
+	},
+}
+
+// HasComfortFields reports whether devices of the given model report both
+// temperature and humidity, so comfort fields can be derived. Devices of
+// unknown model are assumed to be of the model handled by the exporter.
+func HasComfortFields(productCode string) bool {
+	var temperature, humidity bool
+	for _, f := range FieldsFor(productCode) {
+		temperature = temperature || f.Name == "temperature"
+		humidity = humidity || f.Name == "humidity"
+	}
+	return temperature && humidity
+}
+
+// NewComfortReadings derives the comfort readings of device data rows. Rows
+// without humidity are skipped, as no comfort field is defined for dry air.
+func NewComfortReadings(info client.DeviceInfo, data []client.DeviceData) []Reading {
+	readings := make([]Reading, 0, len(data)*len(ComfortFields))
+	for _, d := range data {
+		if d.Humidity.Value <= 0 {
+			continue
+		}
+		ts := time.Unix(int64(d.Timestamp.Value), 0)
+		for _, f := range ComfortFields {
+			readings = append(readings, Reading{
+				Device:    info,
+				Field:     f.Name,
+				Value:     f.Value(d),
+				Unit:      f.Unit,
+				Timestamp: ts,
+			})
+		}
+	}
+	return readings
+}
+
+// Magnus formula coefficients over water (Sonntag, 1990), valid from -45°C to 60°C.
+const (
+	magnusA = 17.62
+	magnusB = 243.12
+	magnusC = 6.112
+)
+
+// SaturationVapourPressure returns the saturation vapour pressure in hPa at
+// the given temperature in degrees Celsius.
+func SaturationVapourPressure(t float64) float64 {
+	return magnusC * math.Exp(magnusA*t/(magnusB+t))
+}
+
+// DewPoint returns the dew point in degrees Celsius for a temperature in
+// degrees Celsius and a relative humidity in percent.
+func DewPoint(t, rh float64) float64 {
+	gamma := math.Log(rh/100) + magnusA*t/(magnusB+t)
+	return magnusB * gamma / (magnusA - gamma)
+}
+
+// AbsoluteHumidity returns the mass of water vapour per volume of air in g/m³
+// for a temperature in degrees Celsius and a relative humidity in percent.
+func AbsoluteHumidity(t, rh float64) float64 {
+	// Vapour pressure in Pa over the specific gas constant of water vapour
+	// (461.5 J/(kg·K)) and the absolute temperature, in g/m³.
+	e := SaturationVapourPressure(t) * rh / 100 * 100
+	return e / (461.5 * (t + 273.15)) * 1000
+}
+
+// HeatIndex returns the apparent temperature in degrees Celsius, using the
+// regression of the US National Weather Service, for a temperature in degrees
+// Celsius and a relative humidity in percent.
+func HeatIndex(t, rh float64) float64 {
+	f := t*9/5 + 32
+
+	// Steadman's simple formula, used while the heat index is below 80°F.
+	hi := 0.5 * (f + 61 + (f-68)*1.2 + rh*0.094)
+	if (hi+f)/2 >= 80 {
+		hi = -42.379 + 2.04901523*f + 10.14333127*rh -
+			0.22475541*f*rh - 0.00683783*f*f - 0.05481717*rh*rh +
+			0.00122874*f*f*rh + 0.00085282*f*rh*rh - 0.00000199*f*f*rh*rh
+
+		switch {
+		case rh < 13 && f >= 80 && f <= 112:
+			hi -= (13 - rh) / 4 * math.Sqrt((17-math.Abs(f-95))/17)
+		case rh > 85 && f >= 80 && f <= 87:
+			hi += (rh - 85) / 10 * (87 - f) / 5
+		}
+	}
+	return (hi - 32) * 5 / 9
+}
+
+// Humidex returns the humidex of Environment Canada for a temperature in
+// degrees Celsius and a relative humidity in percent.
+func Humidex(t, rh float64) float64 {
+	td := DewPoint(t, rh)
+	e := 6.11 * math.Exp(5417.7530*(1/273.16-1/(td+273.15)))
+	return t + 0.5555*(e-10)
+}
+
+// VapourPressureDeficit returns the difference between the saturation and the
+// actual vapour pressure in kPa, for a temperature in degrees Celsius and a
+// relative humidity in percent.
+func VapourPressureDeficit(t, rh float64) float64 {
+	return SaturationVapourPressure(t) * (1 - rh/100) / 10
+}
@@ -0,0 +1,70 @@
+package exporter
+
+import (
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+)
+
+func TestComfortFormulas(t *testing.T) {
+	// Reference values from the NWS heat index table, the Environment Canada
+	// humidex table and common psychrometric calculators.
+	for _, tc := range []struct {
+		name        string
+		temperature float64
+		humidity    float64
+
+		dewPoint         float64
+		absoluteHumidity float64
+		heatIndex        float64
+		humidex          float64
+		vpd              float64
+	}{
+		{name: "room", temperature: 25, humidity: 50, dewPoint: 13.9, absoluteHumidity: 11.5, heatIndex: 24.9, humidex: 28.3, vpd: 1.58},
+		{name: "saturated", temperature: 20, humidity: 100, dewPoint: 20, absoluteHumidity: 17.2, heatIndex: 20.7, humidex: 27.6, vpd: 0},
+		{name: "hot and humid", temperature: 32.2, humidity: 70, dewPoint: 26.0, absoluteHumidity: 23.9, heatIndex: 41.0, humidex: 45.7, vpd: 1.44},
+		{name: "hot and dry", temperature: 35, humidity: 5, dewPoint: -10.3, absoluteHumidity: 2.0, heatIndex: 31.2, humidex: 31.0, vpd: 5.33},
+		{name: "very humid", temperature: 28, humidity: 90, dewPoint: 26.2, absoluteHumidity: 24.4, heatIndex: 34.0, humidex: 41.7, vpd: 0.38},
+		{name: "freezing", temperature: -10, humidity: 60, dewPoint: -16.3, absoluteHumidity: 1.42, heatIndex: -13.4, humidex: -14.6, vpd: 0.11},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.InDelta(t, tc.dewPoint, DewPoint(tc.temperature, tc.humidity), 0.1, "dew point")
+			assert.InDelta(t, tc.absoluteHumidity, AbsoluteHumidity(tc.temperature, tc.humidity), 0.1, "absolute humidity")
+			assert.InDelta(t, tc.heatIndex, HeatIndex(tc.temperature, tc.humidity), 0.1, "heat index")
+			assert.InDelta(t, tc.humidex, Humidex(tc.temperature, tc.humidity), 0.1, "humidex")
+			assert.InDelta(t, tc.vpd, VapourPressureDeficit(tc.temperature, tc.humidity), 0.01, "vapour pressure deficit")
+		})
+	}
+}
+
+func TestHasComfortFields(t *testing.T) {
+	assert.True(t, HasComfortFields(DeviceModel))
+	assert.True(t, HasComfortFields(""))
+	assert.False(t, HasComfortFields("CGS1"))
+}
+
+func TestAirMonitorLite_ComfortMetrics(t *testing.T) {
+	info := client.DeviceInfo{MAC: "mac1", Product: client.ProductInfo{Code: DeviceModel}}
+	data := []client.DeviceData{
+		{Timestamp: client.ValueData{Value: 100}, Temperature: client.ValueData{Value: 25}, Humidity: client.ValueData{Value: 50}},
+	}
+
+	a := NewAirMonitorLiteExporter(nil, prometheus.NewRegistry(), log.NewNopLogger(), WithComfortMetrics(true))
+	a.Observe(SourcePoll, info, data)
+	assert.InDelta(t, 13.85, testutil.ToFloat64(a.prom.gauges["dew_point"][0].vec.WithLabelValues("mac1")), 0.01)
+	assert.InDelta(t, 1.58, testutil.ToFloat64(a.prom.gauges["vapour_pressure_deficit"][0].vec.WithLabelValues("mac1")), 0.01)
+
+	// Rows without humidity have no comfort readings.
+	a.Observe(SourcePoll, info, []client.DeviceData{{Timestamp: client.ValueData{Value: 200}, Temperature: client.ValueData{Value: 30}}})
+	assert.InDelta(t, 13.85, testutil.ToFloat64(a.prom.gauges["dew_point"][0].vec.WithLabelValues("mac1")), 0.01)
+
+	// Comfort metrics are disabled by default.
+	a = NewAirMonitorLiteExporter(nil, prometheus.NewRegistry(), log.NewNopLogger())
+	a.Observe(SourcePoll, info, data)
+	assert.Equal(t, 0, testutil.CollectAndCount(a.prom.gauges["dew_point"][0].vec))
+}
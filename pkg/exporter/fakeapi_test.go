@@ -0,0 +1,38 @@
+package exporter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+)
+
+// fakeAPI is a stub of the Qingping API serving a device list and the same
+// data history for every device. The tests change its fields between syncs.
+type fakeAPI struct {
+	devices client.DeviceListResponse
+	history client.DeviceDataResponse
+	// fetched holds the MACs whose data history was requested, in order.
+	fetched []string
+}
+
+// newFakeAPI starts a fake Qingping API and returns a client of it.
+func newFakeAPI(t *testing.T) (*fakeAPI, *client.Client) {
+	t.Helper()
+	api := &fakeAPI{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/oauth":
+			_, _ = w.Write([]byte(`{"access_token": "token", "expires_in": 3600}`))
+		case "/v1/apis/devices":
+			_ = json.NewEncoder(w).Encode(api.devices)
+		case "/v1/apis/devices/data":
+			api.fetched = append(api.fetched, r.URL.Query().Get("mac"))
+			_ = json.NewEncoder(w).Encode(api.history)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return api, client.New(&client.APIConfig{BaseURL: srv.URL, OAuthURL: srv.URL + "/oauth", AppKey: "key", AppSecret: "secret"})
+}
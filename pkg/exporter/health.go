@@ -0,0 +1,83 @@
+package exporter
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+)
+
+// Names of the reporting health gauges.
+const (
+	MetricReportingGaps       = "qingping_reporting_gaps"
+	MetricReportingRatio      = "qingping_reporting_received_ratio"
+	MetricReportingLongestGap = "qingping_reporting_longest_gap_seconds"
+)
+
+// gapFactor is the number of report intervals without a row for the period to
+// count as a gap. Reports are not exactly on time, so a gap is at least one
+// missed report plus some jitter.
+const gapFactor = 1.5
+
+// Health is how regularly a device reported over a window of its data history.
+type Health struct {
+	// Interval is the report interval of the device.
+	Interval time.Duration
+	// Expected is the number of rows the device should have reported in the
+	// window, one per report interval.
+	Expected int
+	Received int
+	// Gaps is the number of periods without a row longer than 1.5 report
+	// intervals, including the ones at the start and end of the window.
+	Gaps int
+	// LongestGap is the longest period without a row.
+	LongestGap time.Duration
+}
+
+// Ratio returns the received rows over the expected ones.
+func (h Health) Ratio() float64 {
+	if h.Expected == 0 {
+		return 0
+	}
+	return float64(h.Received) / float64(h.Expected)
+}
+
+func (h Health) String() string {
+	return fmt.Sprintf("%d/%d reports (%.0f%%), %d gaps, longest %s",
+		h.Received, h.Expected, 100*h.Ratio(), h.Gaps, h.LongestGap.Truncate(time.Second))
+}
+
+// DeviceHealth returns the reporting health of a device from its data history
+// between start and end. It returns false when the device has no report
+// interval set.
+func DeviceHealth(info client.DeviceInfo, data []client.DeviceData, start, end time.Time) (Health, bool) {
+	interval := time.Duration(info.Setting.ReportInterval) * time.Second
+	if interval <= 0 || !end.After(start) {
+		return Health{}, false
+	}
+	h := Health{Interval: interval, Expected: int(end.Sub(start) / interval)}
+
+	times := make([]time.Time, 0, len(data))
+	for _, d := range data {
+		ts := time.Unix(int64(d.Timestamp.Value), 0)
+		if ts.Before(start) || ts.After(end) {
+			continue
+		}
+		times = append(times, ts)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	h.Received = len(times)
+
+	// The window edges bound the first and last periods without a row.
+	prev := start
+	for _, ts := range append(times, end) {
+		gap := ts.Sub(prev)
+		if gap > time.Duration(gapFactor*float64(interval)) {
+			h.Gaps++
+		}
+		h.LongestGap = max(h.LongestGap, gap)
+		prev = ts
+	}
+	return h, true
+}
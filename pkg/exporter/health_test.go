@@ -0,0 +1,105 @@
+package exporter
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+)
+
+// rows returns data rows at the given minutes after start.
+func rows(start time.Time, minutes ...int) []client.DeviceData {
+	out := make([]client.DeviceData, 0, len(minutes))
+	for _, m := range minutes {
+		ts := start.Add(time.Duration(m) * time.Minute)
+		out = append(out, client.DeviceData{Timestamp: client.ValueData{Value: float64(ts.Unix())}})
+	}
+	return out
+}
+
+func TestDeviceHealth(t *testing.T) {
+	start := time.Date(2024, 9, 19, 12, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	info := client.DeviceInfo{MAC: "mac1", Setting: client.DeviceSetting{ReportInterval: 900}}
+
+	for _, tc := range []struct {
+		name     string
+		data     []client.DeviceData
+		expected Health
+	}{
+		{
+			name:     "every report",
+			data:     rows(start, 15, 30, 45, 60),
+			expected: Health{Interval: 15 * time.Minute, Expected: 4, Received: 4, LongestGap: 15 * time.Minute},
+		},
+		{
+			name:     "late report",
+			data:     rows(start, 15, 35, 45, 60),
+			expected: Health{Interval: 15 * time.Minute, Expected: 4, Received: 4, LongestGap: 20 * time.Minute},
+		},
+		{
+			name:     "missed reports",
+			data:     rows(start, 60, 15),
+			expected: Health{Interval: 15 * time.Minute, Expected: 4, Received: 2, Gaps: 1, LongestGap: 45 * time.Minute},
+		},
+		{
+			// Rows outside the window are ignored, the device stopped
+			// reporting at its end.
+			name:     "stopped reporting",
+			data:     rows(start, -15, 10, 20),
+			expected: Health{Interval: 15 * time.Minute, Expected: 4, Received: 2, Gaps: 1, LongestGap: 40 * time.Minute},
+		},
+		{
+			name:     "no report",
+			expected: Health{Interval: 15 * time.Minute, Expected: 4, Gaps: 1, LongestGap: time.Hour},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h, ok := DeviceHealth(info, tc.data, start, end)
+			require.True(t, ok)
+			assert.Equal(t, tc.expected, h)
+		})
+	}
+
+	_, ok := DeviceHealth(client.DeviceInfo{MAC: "mac1"}, rows(start, 15), start, end)
+	assert.False(t, ok)
+
+	h, _ := DeviceHealth(info, rows(start, 15, 60), start, end)
+	assert.Equal(t, 0.5, h.Ratio())
+	assert.Equal(t, "2/4 reports (50%), 1 gaps, longest 45m0s", h.String())
+}
+
+func TestAirMonitorLite_SyncHealth(t *testing.T) {
+	info := client.DeviceInfo{MAC: "mac1", Product: client.ProductInfo{Code: DeviceModel}, Setting: client.DeviceSetting{ReportInterval: 900}}
+	api, c := newFakeAPI(t)
+	api.devices.Devices = []client.Device{{Info: info}}
+	reg := prometheus.NewRegistry()
+	a := NewAirMonitorLiteExporter(c, reg, log.NewNopLogger(), WithHistoryWindow(time.Hour))
+
+	// Only the two reports of the last half hour were received.
+	now := time.Now()
+	api.history.Data = rows(now, -25, -10)
+	api.history.Total = len(api.history.Data)
+	require.NoError(t, a.sync())
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP qingping_reporting_gaps Number of periods longer than 1.5 report intervals without data in the history window of the last sync
+# TYPE qingping_reporting_gaps gauge
+qingping_reporting_gaps{device_mac="mac1"} 1
+# HELP qingping_reporting_received_ratio Data rows received over the rows expected at the report interval in the history window of the last sync
+# TYPE qingping_reporting_received_ratio gauge
+qingping_reporting_received_ratio{device_mac="mac1"} 0.5
+`), MetricReportingGaps, MetricReportingRatio))
+	assert.InDelta(t, (35 * time.Minute).Seconds(), testutil.ToFloat64(a.m.reportingLongestGap.WithLabelValues("mac1")), 5)
+
+	// A truncated history leaves the metrics as they are.
+	api.history.Total = 100
+	require.NoError(t, a.sync())
+	assert.Equal(t, 1.0, testutil.ToFloat64(a.m.reportingGaps.WithLabelValues("mac1")))
+}
@@ -0,0 +1,161 @@
+package exporter
+
+import (
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/efficientgo/core/errors"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+)
+
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// reservedLabels are the labels of the per-device metrics, which extra labels
+// cannot override.
+var reservedLabels = []string{
+	LabelDeviceMAC, LabelRaw,
+	"device_name", "status", "product_name", "product_code", "product_id",
+	"field", "offset", "multiplier", "min", "max",
+	"standard", "category", "pollutant",
+}
+
+// DeviceLabels holds the extra labels of a device, selected by MAC or name.
+type DeviceLabels struct {
+	MAC    string
+	Name   string
+	Labels map[string]string
+}
+
+type deviceTemplates struct {
+	mac, name string
+	labels    map[string]*template.Template
+}
+
+// ExtraLabels adds labels to every per-device metric. Values are either static
+// or templates executed on the client.DeviceInfo, e.g. "{{ .GroupName }}".
+// The label names are fixed once created, while the values can be updated.
+// A nil *ExtraLabels adds no label.
+type ExtraLabels struct {
+	names []string
+
+	mtx     sync.Mutex
+	common  map[string]*template.Template
+	devices []deviceTemplates
+}
+
+// NewExtraLabels validates the label names and parses the values. Labels set
+// for a device override the common ones.
+func NewExtraLabels(common map[string]string, devices []DeviceLabels) (*ExtraLabels, error) {
+	seen := make(map[string]struct{})
+	parse := func(labels map[string]string) (map[string]*template.Template, error) {
+		out := make(map[string]*template.Template, len(labels))
+		for name, value := range labels {
+			if !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+				return nil, errors.Newf("invalid label name %q", name)
+			}
+			if slices.Contains(reservedLabels, name) {
+				return nil, errors.Newf("label name %q is reserved", name)
+			}
+			t, err := template.New(name).Option("missingkey=error").Parse(value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "label %s", name)
+			}
+			// Catch references to unknown fields early.
+			if err := t.Execute(&strings.Builder{}, client.DeviceInfo{}); err != nil {
+				return nil, errors.Wrapf(err, "label %s", name)
+			}
+			out[name] = t
+			seen[name] = struct{}{}
+		}
+		return out, nil
+	}
+
+	l := &ExtraLabels{}
+	var err error
+	if l.common, err = parse(common); err != nil {
+		return nil, errors.Wrap(err, "labels")
+	}
+	for i, d := range devices {
+		if (d.MAC == "") == (d.Name == "") {
+			return nil, errors.Newf("devices[%d]: exactly one of mac or name must be set", i)
+		}
+		t, err := parse(d.Labels)
+		if err != nil {
+			return nil, errors.Wrapf(err, "devices[%d]: labels", i)
+		}
+		l.devices = append(l.devices, deviceTemplates{mac: d.MAC, name: d.Name, labels: t})
+	}
+	for name := range seen {
+		l.names = append(l.names, name)
+	}
+	sort.Strings(l.names)
+	return l, nil
+}
+
+// Names returns the extra label names, sorted.
+func (l *ExtraLabels) Names() []string {
+	if l == nil {
+		return nil
+	}
+	return l.names
+}
+
+// Values returns the values of the extra labels of a device, in the order of
+// Names. Labels not set for the device are empty.
+func (l *ExtraLabels) Values(info client.DeviceInfo) []string {
+	if l == nil || len(l.names) == 0 {
+		return nil
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	templates := make(map[string]*template.Template, len(l.names))
+	for name, t := range l.common {
+		templates[name] = t
+	}
+	// Devices selected by MAC take precedence over devices selected by name.
+	for _, byMAC := range []bool{false, true} {
+		for _, d := range l.devices {
+			if byMAC && d.mac != "" && strings.EqualFold(d.mac, info.MAC) || !byMAC && d.name != "" && d.name == info.Name {
+				for name, t := range d.labels {
+					templates[name] = t
+				}
+			}
+		}
+	}
+
+	values := make([]string, len(l.names))
+	for i, name := range l.names {
+		t, ok := templates[name]
+		if !ok {
+			continue
+		}
+		var b strings.Builder
+		if err := t.Execute(&b, info); err == nil {
+			values[i] = b.String()
+		}
+	}
+	return values
+}
+
+// Update replaces the label values with the ones of other, e.g. on a config
+// reload. The label names cannot change, as the metrics are already registered.
+func (l *ExtraLabels) Update(other *ExtraLabels) error {
+	if !slices.Equal(l.Names(), other.Names()) {
+		return errors.Newf("extra label names cannot change without a restart: got %v, want %v", other.Names(), l.Names())
+	}
+	if l == nil {
+		return nil
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.common, l.devices = other.common, other.devices
+	return nil
+}
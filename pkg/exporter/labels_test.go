@@ -0,0 +1,79 @@
+package exporter
+
+import (
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+)
+
+func TestNewExtraLabels(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		common  map[string]string
+		devices []DeviceLabels
+	}{
+		{name: "invalid name", common: map[string]string{"room-name": "x"}},
+		{name: "internal name", common: map[string]string{"__room": "x"}},
+		{name: "reserved name", common: map[string]string{"device_mac": "x"}},
+		{name: "bad template", common: map[string]string{"room": "{{ .Name"}},
+		{name: "unknown field", common: map[string]string{"room": "{{ .Room }}"}},
+		{name: "no selector", devices: []DeviceLabels{{Labels: map[string]string{"room": "x"}}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewExtraLabels(tc.common, tc.devices)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestExtraLabels_Values(t *testing.T) {
+	l, err := NewExtraLabels(
+		map[string]string{"site": "home", "room": "{{ .Name }}"},
+		[]DeviceLabels{
+			{Name: "Office", Labels: map[string]string{"owner": "alice", "room": "study"}},
+			{MAC: "34ce00000000", Labels: map[string]string{"room": "{{ .GroupName }}"}},
+		},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"owner", "room", "site"}, l.Names())
+
+	assert.Equal(t, []string{"", "Bedroom", "home"}, l.Values(client.DeviceInfo{MAC: "34CE00000001", Name: "Bedroom"}))
+	assert.Equal(t, []string{"alice", "study", "home"}, l.Values(client.DeviceInfo{MAC: "34CE00000001", Name: "Office"}))
+	// Devices selected by MAC take precedence.
+	assert.Equal(t, []string{"alice", "First floor", "home"}, l.Values(client.DeviceInfo{MAC: "34CE00000000", Name: "Office", GroupName: "First floor"}))
+
+	other, err := NewExtraLabels(map[string]string{"site": "office"}, nil)
+	require.NoError(t, err)
+	require.Error(t, l.Update(other))
+
+	var none *ExtraLabels
+	assert.Nil(t, none.Values(client.DeviceInfo{MAC: "34CE00000000"}))
+}
+
+func TestAirMonitorLite_ExtraLabels(t *testing.T) {
+	l, err := NewExtraLabels(map[string]string{"room": "{{ .Name }}"}, nil)
+	require.NoError(t, err)
+	reg := prometheus.NewRegistry()
+	a := NewAirMonitorLiteExporter(nil, reg, log.NewNopLogger(), WithExtraLabels(l))
+
+	office := client.DeviceInfo{MAC: "mac1", Name: "Office", Product: client.ProductInfo{Code: DeviceModel}}
+	a.UpdateDeviceInfo(office)
+	a.Observe(SourcePoll, office, []client.DeviceData{{Timestamp: client.ValueData{Value: 100}, CO2: client.ValueData{Value: 500}}})
+	assert.Equal(t, 500.0, testutil.ToFloat64(a.prom.gauges["co2"][0].vec.WithLabelValues("mac1", "Office")))
+	assert.Equal(t, 100.0, testutil.ToFloat64(a.m.lastReportTimestamp[0].WithLabelValues("mac1", "Office")))
+
+	// Renaming the device replaces its series.
+	renamed := office
+	renamed.Name = "Study"
+	a.Observe(SourcePoll, renamed, []client.DeviceData{{Timestamp: client.ValueData{Value: 200}, CO2: client.ValueData{Value: 600}}})
+	assert.Equal(t, 600.0, testutil.ToFloat64(a.prom.gauges["co2"][0].vec.WithLabelValues("mac1", "Study")))
+	assert.Equal(t, 1, testutil.CollectAndCount(a.prom.gauges["co2"][0].vec))
+	assert.Equal(t, 1, testutil.CollectAndCount(a.m.lastReportTimestamp[0]))
+	assert.Equal(t, 0, testutil.CollectAndCount(a.m.deviceInfo[0]))
+}
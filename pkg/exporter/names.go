@@ -0,0 +1,75 @@
+package exporter
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// names returns the names a metric is registered under: its name and, in
+// legacy mode, the name it had before following the Prometheus conventions.
+func names(name, legacyName string, legacy bool) []string {
+	if legacy && legacyName != "" {
+		return []string{name, legacyName}
+	}
+	return []string{name}
+}
+
+// gaugeVecs is a gauge registered under several names, set together.
+type gaugeVecs []*prometheus.GaugeVec
+
+func newGaugeVecs(reg prometheus.Registerer, names []string, help string, labels []string) gaugeVecs {
+	g := make(gaugeVecs, 0, len(names))
+	for _, name := range names {
+		g = append(g, promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels))
+	}
+	return g
+}
+
+func (g gaugeVecs) set(value float64, lvs ...string) {
+	for _, vec := range g {
+		vec.WithLabelValues(lvs...).Set(value)
+	}
+}
+
+func (g gaugeVecs) deletePartialMatch(labels prometheus.Labels) {
+	for _, vec := range g {
+		vec.DeletePartialMatch(labels)
+	}
+}
+
+// counterVecs is a counter registered under several names, incremented together.
+type counterVecs []*prometheus.CounterVec
+
+func newCounterVecs(reg prometheus.Registerer, names []string, help string, labels []string) counterVecs {
+	c := make(counterVecs, 0, len(names))
+	for _, name := range names {
+		c = append(c, promauto.With(reg).NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels))
+	}
+	return c
+}
+
+func (c counterVecs) inc(lvs ...string) {
+	for _, vec := range c {
+		vec.WithLabelValues(lvs...).Inc()
+	}
+}
+
+// histogramVecs is a histogram registered under several names, observed together.
+type histogramVecs []*prometheus.HistogramVec
+
+func newHistogramVecs(reg prometheus.Registerer, names []string, opts prometheus.HistogramOpts, labels []string) histogramVecs {
+	h := make(histogramVecs, 0, len(names))
+	for _, name := range names {
+		opts.Name = name
+		h = append(h, promauto.With(reg).NewHistogramVec(opts, labels))
+	}
+	return h
+}
+
+func (h histogramVecs) observer(lvs ...string) prometheus.Observer {
+	return prometheus.ObserverFunc(func(v float64) {
+		for _, vec := range h {
+			vec.WithLabelValues(lvs...).Observe(v)
+		}
+	})
+}
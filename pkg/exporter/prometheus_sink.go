@@ -0,0 +1,169 @@
+package exporter
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// LabelRaw marks the series holding uncalibrated values.
+const LabelRaw = "raw"
+
+type prometheusSinkOpts struct {
+	rawLabel    bool
+	conversions []string
+	legacy      bool
+	labels      *ExtraLabels
+}
+
+type PrometheusSinkOption func(*prometheusSinkOpts)
+
+// WithRawLabel adds the raw label to the gauges, empty for the exported
+// values, so uncalibrated values can be written with WriteRaw.
+func WithRawLabel(rawLabel bool) func(*prometheusSinkOpts) {
+	return func(o *prometheusSinkOpts) {
+		o.rawLabel = rawLabel
+	}
+}
+
+// WithConversions also exposes the fields in other units, by conversion suffix.
+func WithConversions(suffixes ...string) func(*prometheusSinkOpts) {
+	return func(o *prometheusSinkOpts) {
+		o.conversions = append(o.conversions, suffixes...)
+	}
+}
+
+// WithLegacyGauges also exposes the gauges under their legacy names, see
+// Field.LegacyMetric.
+func WithLegacyGauges(legacy bool) func(*prometheusSinkOpts) {
+	return func(o *prometheusSinkOpts) {
+		o.legacy = legacy
+	}
+}
+
+// WithGaugeLabels adds the extra labels to the gauges, with the values of the
+// device of every reading.
+func WithGaugeLabels(l *ExtraLabels) func(*prometheusSinkOpts) {
+	return func(o *prometheusSinkOpts) {
+		o.labels = l
+	}
+}
+
+// gauge is a gauge of a field, in the unit of the field or converted.
+type gauge struct {
+	vec     *prometheus.GaugeVec
+	convert func(float64) float64
+}
+
+// PrometheusSink exposes the latest reading of every field as a gauge per device.
+type PrometheusSink struct {
+	// gauges holds the gauges of every field name.
+	gauges   map[string][]gauge
+	rawLabel bool
+	labels   *ExtraLabels
+}
+
+func NewPrometheusSink(reg prometheus.Registerer, opts ...PrometheusSinkOption) *PrometheusSink {
+	o := prometheusSinkOpts{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	labels := []string{LabelDeviceMAC}
+	if o.rawLabel {
+		labels = append(labels, LabelRaw)
+	}
+	labels = append(labels, o.labels.Names()...)
+	newGauge := func(name, help string, convert func(float64) float64) gauge {
+		return gauge{
+			vec: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+				Name: name,
+				Help: help,
+			}, labels),
+			convert: convert,
+		}
+	}
+
+	fields := AllFields()
+	s := &PrometheusSink{gauges: make(map[string][]gauge, len(fields)), rawLabel: o.rawLabel, labels: o.labels}
+	for _, f := range fields {
+		s.gauges[f.Name] = append(s.gauges[f.Name], newGauge(f.Metric, f.Help, nil))
+		if o.legacy {
+			s.gauges[f.Name] = append(s.gauges[f.Name], newGauge(f.LegacyMetric, f.Help+" (deprecated, use "+f.Metric+")", nil))
+		}
+		for _, suffix := range o.conversions {
+			c, ok := Conversions[suffix]
+			if !ok || c.From != f.Unit {
+				continue
+			}
+			s.gauges[f.Name] = append(s.gauges[f.Name], newGauge(convertedMetric(f, c, false), f.Help+", in "+c.Suffix, c.Convert))
+			if o.legacy {
+				s.gauges[f.Name] = append(s.gauges[f.Name], newGauge(convertedMetric(f, c, true), f.Help+", in "+c.Suffix+" (deprecated)", c.Convert))
+			}
+		}
+	}
+	return s
+}
+
+func (s *PrometheusSink) Name() string {
+	return "prometheus"
+}
+
+func (s *PrometheusSink) Write(_ context.Context, readings []Reading) error {
+	s.write(readings, "")
+	return nil
+}
+
+// WriteRaw exposes uncalibrated readings with the raw="true" label. It does
+// nothing unless the sink was created with the raw label.
+func (s *PrometheusSink) WriteRaw(readings []Reading) {
+	if s.rawLabel {
+		s.write(readings, "true")
+	}
+}
+
+// DeleteDevice removes the series of a device, e.g. when its extra label values change.
+func (s *PrometheusSink) DeleteDevice(mac string) {
+	for _, gauges := range s.gauges {
+		for _, g := range gauges {
+			g.vec.DeletePartialMatch(prometheus.Labels{LabelDeviceMAC: mac})
+		}
+	}
+}
+
+// DeleteRaw removes the raw series of a device, e.g. when its calibration changes.
+func (s *PrometheusSink) DeleteRaw(mac string) {
+	if !s.rawLabel {
+		return
+	}
+	for _, gauges := range s.gauges {
+		for _, g := range gauges {
+			g.vec.DeletePartialMatch(prometheus.Labels{LabelDeviceMAC: mac, LabelRaw: "true"})
+		}
+	}
+}
+
+func (s *PrometheusSink) write(readings []Reading, raw string) {
+	extra := make(map[string][]string)
+	// Readings are in ascending timestamp order, so the latest one wins.
+	for _, r := range readings {
+		values, ok := extra[r.Device.MAC]
+		if !ok {
+			values = s.labels.Values(r.Device)
+			extra[r.Device.MAC] = values
+		}
+		labels := []string{r.Device.MAC}
+		if s.rawLabel {
+			labels = append(labels, raw)
+		}
+		labels = append(labels, values...)
+		for _, g := range s.gauges[r.Field] {
+			v := r.Value
+			if g.convert != nil {
+				v = g.convert(v)
+			}
+			g.vec.WithLabelValues(labels...).Set(v)
+		}
+	}
+}
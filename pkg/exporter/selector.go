@@ -0,0 +1,193 @@
+package exporter
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/efficientgo/core/errors"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+)
+
+// Reasons a device is filtered out of the sync.
+const (
+	FilterReasonUnsupportedModel = "unsupported_model"
+	FilterReasonNotIncluded      = "not_included"
+	FilterReasonExcluded         = "excluded"
+)
+
+// DeviceSelector matches devices on all of its set criteria. List criteria
+// match any of their values.
+type DeviceSelector struct {
+	MACs []string `yaml:"macs,omitempty"`
+	// Name is a regular expression matched against the whole device name.
+	Name            string   `yaml:"name,omitempty"`
+	ProductCodes    []string `yaml:"product_codes,omitempty"`
+	Groups          []string `yaml:"groups,omitempty"`
+	ConnectionTypes []string `yaml:"connection_types,omitempty"`
+	// FirmwareMin and FirmwareMax bound the firmware version, inclusive.
+	FirmwareMin string `yaml:"firmware_min,omitempty"`
+	FirmwareMax string `yaml:"firmware_max,omitempty"`
+
+	name *regexp.Regexp
+}
+
+// Validate checks that the selector has a criterion and compiles its name
+// expression.
+func (s *DeviceSelector) Validate() error {
+	if len(s.MACs) == 0 && s.Name == "" && len(s.ProductCodes) == 0 && len(s.Groups) == 0 &&
+		len(s.ConnectionTypes) == 0 && s.FirmwareMin == "" && s.FirmwareMax == "" {
+		return errors.New("at least one criterion must be set")
+	}
+	if s.Name != "" {
+		re, err := regexp.Compile("^(?:" + s.Name + ")$")
+		if err != nil {
+			return errors.Wrapf(err, "name")
+		}
+		s.name = re
+	}
+	for _, v := range []string{s.FirmwareMin, s.FirmwareMax} {
+		if _, ok := parseVersion(v); v != "" && !ok {
+			return errors.Newf("invalid firmware version %q", v)
+		}
+	}
+	if s.FirmwareMin != "" && s.FirmwareMax != "" && compareVersions(s.FirmwareMin, s.FirmwareMax) > 0 {
+		return errors.New("firmware_min is greater than firmware_max")
+	}
+	return nil
+}
+
+// Matches reports whether the device matches all criteria of the selector.
+func (s *DeviceSelector) Matches(info client.DeviceInfo) bool {
+	contains := func(values []string, v string) bool {
+		if len(values) == 0 {
+			return true
+		}
+		for _, value := range values {
+			if strings.EqualFold(value, v) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !contains(s.MACs, info.MAC) || !contains(s.ProductCodes, info.Product.Code) ||
+		!contains(s.Groups, info.GroupName) || !contains(s.ConnectionTypes, info.ConnectionType) {
+		return false
+	}
+	if s.Name != "" {
+		re := s.name
+		if re == nil {
+			re = regexp.MustCompile("^(?:" + s.Name + ")$")
+		}
+		if !re.MatchString(info.Name) {
+			return false
+		}
+	}
+	if s.FirmwareMin != "" && compareVersions(info.Version, s.FirmwareMin) < 0 {
+		return false
+	}
+	if s.FirmwareMax != "" && compareVersions(info.Version, s.FirmwareMax) > 0 {
+		return false
+	}
+	return true
+}
+
+// DeviceFilter selects the devices handled by the exporter. Devices are kept
+// when they match any include selector, or there is none, and no exclude selector.
+type DeviceFilter struct {
+	Include []DeviceSelector `yaml:"include,omitempty"`
+	Exclude []DeviceSelector `yaml:"exclude,omitempty"`
+}
+
+// Validate checks and compiles the selectors.
+func (f *DeviceFilter) Validate() error {
+	if f == nil {
+		return nil
+	}
+	for i := range f.Include {
+		if err := f.Include[i].Validate(); err != nil {
+			return errors.Wrapf(err, "include[%d]", i)
+		}
+	}
+	for i := range f.Exclude {
+		if err := f.Exclude[i].Validate(); err != nil {
+			return errors.Wrapf(err, "exclude[%d]", i)
+		}
+	}
+	return nil
+}
+
+// Keep reports whether the device is selected, and otherwise why not.
+func (f *DeviceFilter) Keep(info client.DeviceInfo) (bool, string) {
+	if f == nil {
+		return true, ""
+	}
+	if len(f.Include) > 0 {
+		included := false
+		for i := range f.Include {
+			if f.Include[i].Matches(info) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false, FilterReasonNotIncluded
+		}
+	}
+	for i := range f.Exclude {
+		if f.Exclude[i].Matches(info) {
+			return false, FilterReasonExcluded
+		}
+	}
+	return true, ""
+}
+
+// parseVersion extracts the numeric components of a firmware version, e.g.
+// 1, 2 and 3 from "v1.2.3_0153".
+func parseVersion(v string) ([]int, bool) {
+	v = strings.TrimLeft(v, "vV")
+	var parts []int
+	for _, p := range strings.Split(v, ".") {
+		end := 0
+		for end < len(p) && p[end] >= '0' && p[end] <= '9' {
+			end++
+		}
+		if end == 0 {
+			break
+		}
+		n, err := strconv.Atoi(p[:end])
+		if err != nil {
+			return nil, false
+		}
+		parts = append(parts, n)
+		if end < len(p) {
+			break
+		}
+	}
+	return parts, len(parts) > 0
+}
+
+// compareVersions compares firmware versions by their numeric components,
+// missing components being zero. Unparsable versions sort first.
+func compareVersions(a, b string) int {
+	pa, _ := parseVersion(a)
+	pb, _ := parseVersion(b)
+	for i := 0; i < max(len(pa), len(pb)); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
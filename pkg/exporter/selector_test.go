@@ -0,0 +1,155 @@
+package exporter
+
+import (
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+)
+
+func TestCompareVersions(t *testing.T) {
+	assert.Equal(t, 0, compareVersions("1.2.3", "v1.2.3"))
+	assert.Equal(t, 0, compareVersions("1.2", "1.2.0"))
+	assert.Equal(t, -1, compareVersions("1.2.3", "1.10.0"))
+	assert.Equal(t, 1, compareVersions("v4.1.0_0153", "4.0.9"))
+	assert.Equal(t, -1, compareVersions("unknown", "0.0.1"))
+}
+
+func TestDeviceFilter(t *testing.T) {
+	office := client.DeviceInfo{MAC: "34CE00000000", Name: "Office", Version: "1.2.3", GroupName: "Home", ConnectionType: "WIFI", Product: client.ProductInfo{Code: DeviceModel}}
+	demo := client.DeviceInfo{MAC: "34CE00000001", Name: "Demo unit 1", Version: "1.0.0", GroupName: "Lab", ConnectionType: "NB-IoT", Product: client.ProductInfo{Code: DeviceModel}}
+
+	for _, tc := range []struct {
+		name   string
+		filter *DeviceFilter
+		office string
+		demo   string
+	}{
+		{name: "none", filter: nil},
+		{name: "empty", filter: &DeviceFilter{}},
+		{name: "exclude name", filter: &DeviceFilter{Exclude: []DeviceSelector{{Name: "Demo.*"}}}, demo: FilterReasonExcluded},
+		{name: "name is anchored", filter: &DeviceFilter{Exclude: []DeviceSelector{{Name: "unit"}}}},
+		{name: "include mac", filter: &DeviceFilter{Include: []DeviceSelector{{MACs: []string{"34ce00000000"}}}}, demo: FilterReasonNotIncluded},
+		{name: "include group", filter: &DeviceFilter{Include: []DeviceSelector{{Groups: []string{"Lab"}}}}, office: FilterReasonNotIncluded},
+		{name: "exclude connection type", filter: &DeviceFilter{Exclude: []DeviceSelector{{ConnectionTypes: []string{"nb-iot"}}}}, demo: FilterReasonExcluded},
+		{name: "firmware range", filter: &DeviceFilter{Include: []DeviceSelector{{FirmwareMin: "1.1", FirmwareMax: "2"}}}, demo: FilterReasonNotIncluded},
+		{name: "all criteria must match", filter: &DeviceFilter{Exclude: []DeviceSelector{{Groups: []string{"Lab"}, ProductCodes: []string{"CGS1"}}}}},
+		{
+			name: "include then exclude",
+			filter: &DeviceFilter{
+				Include: []DeviceSelector{{ProductCodes: []string{DeviceModel}}},
+				Exclude: []DeviceSelector{{MACs: []string{office.MAC}}},
+			},
+			office: FilterReasonExcluded,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.NoError(t, tc.filter.Validate())
+			for _, d := range []struct {
+				info   client.DeviceInfo
+				reason string
+			}{{office, tc.office}, {demo, tc.demo}} {
+				keep, reason := tc.filter.Keep(d.info)
+				assert.Equal(t, d.reason == "", keep, d.info.Name)
+				assert.Equal(t, d.reason, reason, d.info.Name)
+			}
+		})
+	}
+}
+
+func TestDeviceFilter_Validate(t *testing.T) {
+	for _, f := range []DeviceFilter{
+		{Include: []DeviceSelector{{}}},
+		{Exclude: []DeviceSelector{{Name: "("}}},
+		{Include: []DeviceSelector{{FirmwareMin: "latest"}}},
+		{Include: []DeviceSelector{{FirmwareMin: "2.0", FirmwareMax: "1.0"}}},
+	} {
+		assert.Error(t, f.Validate())
+	}
+}
+
+func TestAirMonitorLite_SyncFilter(t *testing.T) {
+	api, c := newFakeAPI(t)
+	api.devices.Devices = []client.Device{
+		{Info: client.DeviceInfo{MAC: "mac1", Name: "Office", Product: client.ProductInfo{Code: DeviceModel}}},
+		{Info: client.DeviceInfo{MAC: "mac2", Name: "Demo", Product: client.ProductInfo{Code: DeviceModel}}},
+		{Info: client.DeviceInfo{MAC: "mac3", Name: "Clock", Product: client.ProductInfo{Code: "CGC1"}}},
+	}
+	filter := &DeviceFilter{Exclude: []DeviceSelector{{Name: "Demo"}}}
+	require.NoError(t, filter.Validate())
+	reg := prometheus.NewRegistry()
+	a := NewAirMonitorLiteExporter(c, reg, log.NewNopLogger(), WithDeviceFilter(filter))
+
+	require.NoError(t, a.sync())
+	assert.Equal(t, []string{"mac1"}, api.fetched)
+	assert.Equal(t, 1.0, testutil.ToFloat64(a.m.devicesFiltered.WithLabelValues(FilterReasonExcluded)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(a.m.devicesFiltered.WithLabelValues(FilterReasonUnsupportedModel)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(a.m.devicesFiltered.WithLabelValues(FilterReasonNotIncluded)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(a.m.syncFailures.WithLabelValues(SyncPhaseDataHistory)))
+
+	require.NotNil(t, a.LastSync())
+	assert.Empty(t, a.LastSync().Error)
+	states := a.Devices()
+	require.Len(t, states, 1)
+	require.NotNil(t, states[0].LastSync)
+	assert.Empty(t, states[0].LastSync.Error)
+
+	// Devices removed from the account or filtered out are forgotten, and
+	// their series removed.
+	api.devices.Devices = api.devices.Devices[1:]
+	require.NoError(t, a.sync())
+	assert.Empty(t, a.Devices())
+	assertSeries(t, reg, 0)
+
+	api.devices.Devices = append(api.devices.Devices, client.Device{Info: client.DeviceInfo{MAC: "mac1", Name: "Office", Product: client.ProductInfo{Code: DeviceModel}}})
+	require.NoError(t, a.sync())
+	require.Len(t, a.Devices(), 1)
+	assertSeries(t, reg, 1)
+	filter = &DeviceFilter{Exclude: []DeviceSelector{{Name: "Demo"}, {Name: "Office"}}}
+	require.NoError(t, filter.Validate())
+	a.SetDeviceFilter(filter)
+	require.NoError(t, a.sync())
+	assert.Empty(t, a.Devices())
+	assertSeries(t, reg, 0)
+}
+
+func TestAirMonitorLite_SyncPruneRestored(t *testing.T) {
+	api, c := newFakeAPI(t)
+	listed := client.DeviceInfo{MAC: "mac1", Name: "Office", Product: client.ProductInfo{Code: DeviceModel}}
+	api.devices.Devices = []client.Device{{Info: listed, Data: client.DeviceData{Timestamp: client.ValueData{Value: 150}}}}
+	reg := prometheus.NewRegistry()
+	a := NewAirMonitorLiteExporter(c, reg, log.NewNopLogger())
+
+	// Devices restored from the store and missing from the device list are
+	// forgotten by the sync, the other ones keep their readings.
+	for _, info := range []client.DeviceInfo{{MAC: "mac1", Name: "Office"}, {MAC: "mac2", Name: "Removed"}} {
+		a.Restore(NewReadings(info, []client.DeviceData{{Timestamp: client.ValueData{Value: 100}, CO2: client.ValueData{Value: 450}}}))
+	}
+	require.Len(t, a.Devices(), 2)
+	require.NoError(t, a.sync())
+
+	states := a.Devices()
+	require.Len(t, states, 1)
+	assert.Equal(t, "mac1", states[0].Info.MAC)
+	require.NotNil(t, states[0].Last)
+	require.NotNil(t, states[0].Reported)
+	assert.Equal(t, int64(150), states[0].Reported.Unix())
+	assertSeries(t, reg, 1)
+	assert.Equal(t, 1, testutil.CollectAndCount(a.prom.gauges["co2"][0].vec))
+}
+
+// assertSeries checks the number of devices with device info and last report
+// series.
+func assertSeries(t *testing.T, reg *prometheus.Registry, expected int) {
+	t.Helper()
+	for _, name := range []string{MetricDeviceInfo, MetricLastReportTimestamp} {
+		count, err := testutil.GatherAndCount(reg, name)
+		require.NoError(t, err)
+		assert.Equal(t, expected, count, name)
+	}
+}
@@ -0,0 +1,308 @@
+package exporter
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+)
+
+// Units of the device data fields.
+const (
+	UnitCelsius                 = "celsius"
+	UnitPercent                 = "percent"
+	UnitPPM                     = "ppm"
+	UnitMicrogramsPerCubicMeter = "ug/m3"
+	UnitKilopascal              = "kPa"
+)
+
+// Field is a sensor field of the device data.
+type Field struct {
+	// Name identifies the field in readings, e.g. "temperature".
+	Name string
+	Unit string
+	// Metric is the name of the Prometheus gauge exposing the field.
+	Metric string
+	// LegacyMetric is the name the gauge had before following the
+	// Prometheus naming conventions, also exposed in legacy mode.
+	LegacyMetric string
+	Help         string
+	Value        func(client.DeviceData) float64
+}
+
+// Fields are the sensor fields read from the device data.
+var Fields = []Field{
+	{
+		Name:         "temperature",
+		Unit:         UnitCelsius,
+		Metric:       MetricTemperature,
+		LegacyMetric: LegacyMetricTemperature,
+		Help:         "Temperature in degrees Celsius",
+		Value:        func(d client.DeviceData) float64 { return d.Temperature.Value },
+	},
+	{
+		Name:         "humidity",
+		Unit:         UnitPercent,
+		Metric:       MetricHumidity,
+		LegacyMetric: LegacyMetricHumidity,
+		Help:         "Humidity percentage",
+		Value:        func(d client.DeviceData) float64 { return d.Humidity.Value },
+	},
+	{
+		Name:         "co2",
+		Unit:         UnitPPM,
+		Metric:       MetricCO2,
+		LegacyMetric: LegacyMetricCO2,
+		Help:         "CO2 concentration in ppm",
+		Value: func(d client.DeviceData) float64 {
+			// Some models only report the concentration as a percentage.
+			if d.CO2.Value == 0 && d.CO2Percent.Value > 0 {
+				return d.CO2Percent.Value * 10000
+			}
+			return d.CO2.Value
+		},
+	},
+	{
+		Name:         "pm25",
+		Unit:         UnitMicrogramsPerCubicMeter,
+		Metric:       MetricPM25,
+		LegacyMetric: LegacyMetricPM25,
+		Help:         "PM2.5 concentration in µg/m³",
+		Value:        func(d client.DeviceData) float64 { return d.PM25.Value },
+	},
+	{
+		Name:         "pm10",
+		Unit:         UnitMicrogramsPerCubicMeter,
+		Metric:       MetricPM10,
+		LegacyMetric: LegacyMetricPM10,
+		Help:         "PM10 concentration in µg/m³",
+		Value:        func(d client.DeviceData) float64 { return d.PM10.Value },
+	},
+	{
+		Name:         "battery",
+		Unit:         UnitPercent,
+		Metric:       MetricBattery,
+		LegacyMetric: LegacyMetricBattery,
+		Help:         "Battery level percentage",
+		Value:        func(d client.DeviceData) float64 { return d.Battery.Value },
+	},
+}
+
+// modelFields lists the names of the fields reported by each device model.
+var modelFields = map[string][]string{
+	DeviceModel: {"temperature", "humidity", "co2", "pm25", "pm10", "battery"},
+}
+
+// FieldsFor returns the sensor fields reported by a device model, none for an
+// unsupported model. Devices without a model, e.g. pushed without their info,
+// are assumed to be of the model handled by the exporter.
+func FieldsFor(productCode string) []Field {
+	if productCode == "" {
+		productCode = DeviceModel
+	}
+	names := modelFields[productCode]
+
+	fields := make([]Field, 0, len(names))
+	for _, f := range Fields {
+		for _, name := range names {
+			if f.Name == name {
+				fields = append(fields, f)
+				break
+			}
+		}
+	}
+	return fields
+}
+
+// Reading is a single normalized sensor value of a device.
+type Reading struct {
+	Device    client.DeviceInfo
+	Field     string
+	Value     float64
+	Unit      string
+	Timestamp time.Time
+}
+
+// NewReadings normalizes device data rows into readings, one per row and
+// field reported by the device model.
+func NewReadings(info client.DeviceInfo, data []client.DeviceData) []Reading {
+	fields := FieldsFor(info.Product.Code)
+	readings := make([]Reading, 0, len(data)*len(fields))
+	for _, d := range data {
+		ts := time.Unix(int64(d.Timestamp.Value), 0)
+		for _, f := range fields {
+			readings = append(readings, Reading{
+				Device:    info,
+				Field:     f.Name,
+				Value:     f.Value(d),
+				Unit:      f.Unit,
+				Timestamp: ts,
+			})
+		}
+	}
+	return readings
+}
+
+// AllFields returns the sensor fields followed by the comfort fields.
+func AllFields() []Field {
+	all := make([]Field, 0, len(Fields)+len(ComfortFields))
+	all = append(all, Fields...)
+	return append(all, ComfortFields...)
+}
+
+// FieldByName returns the sensor or comfort field with the given name.
+func FieldByName(name string) (Field, bool) {
+	for _, f := range AllFields() {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Field{}, false
+}
+
+// Row groups the readings of a device taken at the same time.
+type Row struct {
+	Device    client.DeviceInfo
+	Timestamp time.Time
+	Readings  []Reading
+}
+
+// Rows groups readings by device and timestamp, keeping their order.
+func Rows(readings []Reading) []Row {
+	var rows []Row
+	index := make(map[string]int)
+	for _, r := range readings {
+		key := r.Device.MAC + "/" + r.Timestamp.String()
+		i, ok := index[key]
+		if !ok {
+			i = len(rows)
+			index[key] = i
+			rows = append(rows, Row{Device: r.Device, Timestamp: r.Timestamp})
+		}
+		rows[i].Readings = append(rows[i].Readings, r)
+	}
+	return rows
+}
+
+// Sink receives the readings handled by the exporter.
+type Sink interface {
+	// Name identifies the sink in metrics and logs.
+	Name() string
+	// Write is called with the readings of a device that are newer than any
+	// seen before, in ascending timestamp order.
+	Write(ctx context.Context, readings []Reading) error
+}
+
+// DeviceSink is a Sink that is also notified of the device information on
+// every sync, e.g. to track whether devices are online.
+type DeviceSink interface {
+	Sink
+	UpdateDevice(ctx context.Context, info client.DeviceInfo) error
+}
+
+// sinkQueueSize is the number of pending writes buffered per sink.
+const sinkQueueSize = 256
+
+type sinkItem struct {
+	readings []Reading
+	device   *client.DeviceInfo
+}
+
+type sinkWorker struct {
+	sink  Sink
+	queue chan sinkItem
+}
+
+// fanout writes to every sink from its own queue and goroutine, so a slow or
+// failing sink does not block the others nor the exporter.
+type fanout struct {
+	workers []*sinkWorker
+	logger  log.Logger
+
+	writes  *prometheus.CounterVec
+	dropped *prometheus.CounterVec
+}
+
+func newFanout(sinks []Sink, reg prometheus.Registerer, logger log.Logger) *fanout {
+	f := &fanout{
+		logger: logger,
+		writes: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "qingping_sink_writes_total",
+			Help: "Number of writes to each sink, by result",
+		}, []string{"sink", "result"}),
+		dropped: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "qingping_sink_dropped_writes_total",
+			Help: "Number of writes dropped because the sink queue was full",
+		}, []string{"sink"}),
+	}
+	for _, s := range sinks {
+		f.workers = append(f.workers, &sinkWorker{sink: s, queue: make(chan sinkItem, sinkQueueSize)})
+		f.writes.WithLabelValues(s.Name(), "success")
+		f.writes.WithLabelValues(s.Name(), "error")
+		f.dropped.WithLabelValues(s.Name())
+	}
+	return f
+}
+
+func (f *fanout) write(readings []Reading) {
+	f.enqueue(sinkItem{readings: readings})
+}
+
+func (f *fanout) updateDevice(info client.DeviceInfo) {
+	f.enqueue(sinkItem{device: &info})
+}
+
+func (f *fanout) enqueue(item sinkItem) {
+	for _, w := range f.workers {
+		if _, ok := w.sink.(DeviceSink); item.device != nil && !ok {
+			continue
+		}
+		select {
+		case w.queue <- item:
+		default:
+			f.dropped.WithLabelValues(w.sink.Name()).Inc()
+		}
+	}
+}
+
+// run processes the sink queues until the context is done.
+func (f *fanout) run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, w := range f.workers {
+		wg.Add(1)
+		go func(w *sinkWorker) {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case item := <-w.queue:
+					f.process(ctx, w.sink, item)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func (f *fanout) process(ctx context.Context, s Sink, item sinkItem) {
+	var err error
+	if item.device != nil {
+		err = s.(DeviceSink).UpdateDevice(ctx, *item.device)
+	} else {
+		err = s.Write(ctx, item.readings)
+	}
+
+	if err != nil {
+		f.writes.WithLabelValues(s.Name(), "error").Inc()
+		level.Warn(f.logger).Log("msg", "failed to write to sink", "sink", s.Name(), "err", err)
+		return
+	}
+	f.writes.WithLabelValues(s.Name(), "success").Inc()
+}
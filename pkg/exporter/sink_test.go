@@ -0,0 +1,98 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+)
+
+type recordingSink struct {
+	name string
+	err  error
+	// block makes writes hang until the channel is closed.
+	block chan struct{}
+
+	mtx      sync.Mutex
+	readings []Reading
+	devices  []client.DeviceInfo
+}
+
+func (s *recordingSink) Name() string {
+	return s.name
+}
+
+func (s *recordingSink) Write(_ context.Context, readings []Reading) error {
+	if s.block != nil {
+		<-s.block
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.readings = append(s.readings, readings...)
+	return s.err
+}
+
+func (s *recordingSink) UpdateDevice(_ context.Context, info client.DeviceInfo) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.devices = append(s.devices, info)
+	return nil
+}
+
+func (s *recordingSink) received() ([]Reading, []client.DeviceInfo) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.readings, s.devices
+}
+
+func TestAirMonitorLite_Sinks(t *testing.T) {
+	ok := &recordingSink{name: "ok"}
+	failing := &recordingSink{name: "failing", err: errors.New("unavailable")}
+	blocked := &recordingSink{name: "blocked", block: make(chan struct{})}
+	defer close(blocked.block)
+
+	reg := prometheus.NewRegistry()
+	a := NewAirMonitorLiteExporter(nil, reg, log.NewNopLogger(), WithPolling(false), WithSinks(ok, failing, blocked))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = a.Run(ctx)
+	}()
+
+	info := client.DeviceInfo{MAC: "mac1", Product: client.ProductInfo{Code: DeviceModel}}
+	a.UpdateDeviceInfo(info)
+	// More writes than fit in the queue of the blocked sink. Wait for every
+	// write to reach the healthy sink, so only the blocked one falls behind.
+	for i := 1; i <= sinkQueueSize+10; i++ {
+		a.Observe(SourcePoll, info, []client.DeviceData{{Timestamp: client.ValueData{Value: float64(i)}, CO2: client.ValueData{Value: 400}}})
+		require.Eventually(t, func() bool {
+			readings, _ := ok.received()
+			return len(readings) == i*len(FieldsFor(DeviceModel))
+		}, 10*time.Second, time.Millisecond)
+	}
+
+	readings, devices := ok.received()
+	assert.Equal(t, []client.DeviceInfo{info}, devices)
+	assert.Equal(t, Reading{Device: info, Field: "co2", Value: 400, Unit: UnitPPM, Timestamp: time.Unix(1, 0)}, readings[2])
+
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(a.sinks.writes.WithLabelValues("failing", "error")) == sinkQueueSize+10
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0.0, testutil.ToFloat64(a.sinks.writes.WithLabelValues("ok", "error")))
+
+	// The blocked sink holds at most one write in flight and a full queue, the rest is dropped.
+	assert.GreaterOrEqual(t, testutil.ToFloat64(a.sinks.dropped.WithLabelValues("blocked")), 9.0)
+
+	// The Prometheus gauges are not affected by other sinks.
+	assert.Equal(t, 400.0, testutil.ToFloat64(a.prom.gauges["co2"][0].vec.WithLabelValues("mac1")))
+}
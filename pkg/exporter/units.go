@@ -0,0 +1,67 @@
+package exporter
+
+import (
+	"sort"
+	"strings"
+)
+
+// Conversion exposes the fields of a unit under another unit, as separate
+// gauges named after the field metric with the unit suffix replaced.
+type Conversion struct {
+	// Suffix replaces the unit suffix of the field metric, e.g. "fahrenheit".
+	Suffix string
+	// From is the unit of the fields the conversion applies to.
+	From    string
+	Convert func(float64) float64
+}
+
+// Conversions holds the supported conversions by suffix.
+var Conversions = map[string]Conversion{
+	"fahrenheit":   {Suffix: "fahrenheit", From: UnitCelsius, Convert: func(v float64) float64 { return v*9/5 + 32 }},
+	"kelvin":       {Suffix: "kelvin", From: UnitCelsius, Convert: func(v float64) float64 { return v + 273.15 }},
+	"percent":      {Suffix: "percent", From: UnitPPM, Convert: func(v float64) float64 { return v / 10000 }},
+	"pascals":      {Suffix: "pascals", From: UnitKilopascal, Convert: func(v float64) float64 { return v * 1000 }},
+	"hectopascals": {Suffix: "hectopascals", From: UnitKilopascal, Convert: func(v float64) float64 { return v * 10 }},
+}
+
+// ConversionNames returns the suffixes of the supported conversions, sorted.
+func ConversionNames() []string {
+	names := make([]string, 0, len(Conversions))
+	for name := range Conversions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// unitSuffixes holds the suffixes of the metric names by unit.
+var unitSuffixes = map[string]string{
+	UnitCelsius:                 "celsius",
+	UnitPercent:                 "percent",
+	UnitPPM:                     "ppm",
+	UnitMicrogramsPerCubicMeter: "micrograms_per_cubic_meter",
+	UnitGramsPerCubicMeter:      "grams_per_cubic_meter",
+	UnitKilopascal:              "kilopascals",
+}
+
+// convertedMetric returns the name of the gauge exposing a field converted to
+// another unit, e.g. qingping_temperature_fahrenheit. In legacy mode, the
+// suffix is appended to the legacy name instead, e.g.
+// air_monitor_temperature_fahrenheit.
+func convertedMetric(f Field, c Conversion, legacy bool) string {
+	if legacy {
+		return f.LegacyMetric + "_" + c.Suffix
+	}
+	return strings.TrimSuffix(f.Metric, "_"+unitSuffixes[f.Unit]) + "_" + c.Suffix
+}
+
+// ConvertedMetric returns the name of the gauge exposing a field in the unit of
+// a conversion suffix, e.g. qingping_temperature_fahrenheit, and whether the
+// conversion applies to the field.
+func ConvertedMetric(f Field, suffix string) (string, bool) {
+	c, ok := Conversions[suffix]
+	if !ok || c.From != f.Unit {
+		return "", false
+	}
+	return convertedMetric(f, c, false), true
+}
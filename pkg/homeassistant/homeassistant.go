@@ -0,0 +1,292 @@
+// Package homeassistant republishes device readings to MQTT together with
+// Home Assistant discovery configs, so each device shows up in Home Assistant
+// with one sensor entity per field.
+package homeassistant
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/mqtt"
+)
+
+// Config holds the Home Assistant publishing settings.
+type Config struct {
+	Enabled         bool
+	DiscoveryPrefix string
+	TopicPrefix     string
+}
+
+func (c *Config) BindFlags(cmd *kingpin.CmdClause) {
+	cmd.Flag("homeassistant.enabled", "Publish readings with Home Assistant discovery to the broker set with --mqtt.broker.").
+		BoolVar(&c.Enabled)
+
+	cmd.Flag("homeassistant.discovery-prefix", "Topic prefix Home Assistant listens to for discovery configs.").
+		Default("homeassistant").
+		StringVar(&c.DiscoveryPrefix)
+
+	cmd.Flag("homeassistant.topic-prefix", "Topic prefix of the state and availability topics.").
+		Default("qingping_exporter").
+		StringVar(&c.TopicPrefix)
+}
+
+// sensor describes the Home Assistant entity of a reading field.
+type sensor struct {
+	key         string
+	name        string
+	deviceClass string
+	unit        string
+}
+
+// sensors are keyed by the name of the exporter field they publish.
+var sensors = []sensor{
+	{key: "temperature", name: "Temperature", deviceClass: "temperature", unit: "°C"},
+	{key: "humidity", name: "Humidity", deviceClass: "humidity", unit: "%"},
+	{key: "co2", name: "CO2", deviceClass: "carbon_dioxide", unit: "ppm"},
+	{key: "pm25", name: "PM2.5", deviceClass: "pm25", unit: "µg/m³"},
+	{key: "pm10", name: "PM10", deviceClass: "pm10", unit: "µg/m³"},
+	{key: "battery", name: "Battery", deviceClass: "battery", unit: "%"},
+}
+
+// discoveryDevice is the device section of a discovery config.
+type discoveryDevice struct {
+	Identifiers  []string   `json:"identifiers"`
+	Connections  [][]string `json:"connections"`
+	Name         string     `json:"name"`
+	Manufacturer string     `json:"manufacturer"`
+	Model        string     `json:"model,omitempty"`
+	SWVersion    string     `json:"sw_version,omitempty"`
+}
+
+// discoveryConfig is the discovery config of a sensor entity.
+type discoveryConfig struct {
+	Name              string          `json:"name"`
+	UniqueID          string          `json:"unique_id"`
+	ObjectID          string          `json:"object_id"`
+	StateTopic        string          `json:"state_topic"`
+	ValueTemplate     string          `json:"value_template"`
+	DeviceClass       string          `json:"device_class"`
+	StateClass        string          `json:"state_class"`
+	UnitOfMeasurement string          `json:"unit_of_measurement"`
+	AvailabilityTopic string          `json:"availability_topic"`
+	Device            discoveryDevice `json:"device"`
+}
+
+// Publisher publishes device readings and discovery configs to MQTT.
+// It implements exporter.DeviceSink.
+type Publisher struct {
+	mqttCfg mqtt.Config
+	cfg     Config
+	logger  log.Logger
+	errors  prometheus.Counter
+
+	mtx    sync.Mutex
+	client paho.Client
+	// published holds the last discovery configs published per device MAC,
+	// so they are only republished when the device information changes.
+	published map[string]client.DeviceInfo
+	// states holds the last state published per device MAC.
+	states map[string][]byte
+	// values holds the latest value of each field per device MAC.
+	values map[string]map[string]any
+}
+
+func NewPublisher(mqttCfg mqtt.Config, cfg Config, reg prometheus.Registerer, logger log.Logger) *Publisher {
+	return &Publisher{
+		mqttCfg: mqttCfg,
+		cfg:     cfg,
+		logger:  log.With(logger, "component", "homeassistant"),
+		errors: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "qingping_homeassistant_publish_errors_total",
+			Help: "Number of messages that failed to be published to Home Assistant",
+		}),
+		published: make(map[string]client.DeviceInfo),
+		states:    make(map[string][]byte),
+		values:    make(map[string]map[string]any),
+	}
+}
+
+// Run connects to the broker and keeps the connection until the context is done.
+func (p *Publisher) Run(ctx context.Context) error {
+	opts := p.mqttCfg.ClientOptions("_homeassistant").SetOnConnectHandler(func(paho.Client) {
+		// Messages are retained, but republish them in case they were dropped
+		// while disconnected or the broker lost them.
+		p.mtx.Lock()
+		defer p.mtx.Unlock()
+		for mac, info := range p.published {
+			p.publishDiscovery(info)
+			p.publishAvailability(info)
+			if state, ok := p.states[mac]; ok {
+				p.publish(p.stateTopic(mac), state)
+			}
+		}
+	})
+
+	c := paho.NewClient(opts)
+	p.mtx.Lock()
+	p.client = c
+	p.mtx.Unlock()
+
+	if err := mqtt.Wait(ctx, c.Connect()); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return errors.Wrapf(err, "connect to MQTT broker %s", p.mqttCfg.Broker)
+	}
+	defer c.Disconnect(250)
+	level.Info(p.logger).Log("msg", "publishing to Home Assistant", "broker", p.mqttCfg.Broker)
+
+	<-ctx.Done()
+	return nil
+}
+
+func (p *Publisher) Name() string {
+	return "homeassistant"
+}
+
+// UpdateDevice publishes the availability of the device, and its discovery
+// configs when they changed.
+func (p *Publisher) UpdateDevice(_ context.Context, info client.DeviceInfo) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if prev, ok := p.published[info.MAC]; !ok || prev.Name != info.Name || prev.Version != info.Version {
+		p.publishDiscovery(info)
+	}
+	p.published[info.MAC] = info
+	p.publishAvailability(info)
+	return nil
+}
+
+// Write publishes the latest value of each field as the device state.
+func (p *Publisher) Write(_ context.Context, readings []exporter.Reading) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	updated := make(map[string]client.DeviceInfo)
+	for _, r := range readings {
+		values, ok := p.values[r.Device.MAC]
+		if !ok {
+			values = make(map[string]any)
+			p.values[r.Device.MAC] = values
+		}
+		values[r.Field] = r.Value
+		values["timestamp"] = r.Timestamp.UTC().Format(time.RFC3339)
+		updated[r.Device.MAC] = r.Device
+	}
+
+	var err error
+	for mac, info := range updated {
+		payload, merr := json.Marshal(p.values[mac])
+		if merr != nil {
+			p.errors.Inc()
+			err = errors.Wrapf(merr, "encode state of %s", mac)
+			continue
+		}
+
+		// Devices only seen through pushes or MQTT have no sync updates.
+		if _, ok := p.published[mac]; !ok {
+			p.published[mac] = info
+			p.publishDiscovery(info)
+			p.publishAvailability(info)
+		}
+		p.states[mac] = payload
+		p.publish(p.stateTopic(mac), payload)
+	}
+	return err
+}
+
+// publishAvailability publishes whether the device is online.
+// It must be called with the lock held.
+func (p *Publisher) publishAvailability(info client.DeviceInfo) {
+	availability := "online"
+	if info.Status.Offline {
+		availability = "offline"
+	}
+	p.publish(p.availabilityTopic(info.MAC), []byte(availability))
+}
+
+// publishDiscovery publishes the discovery configs of all sensors of a device.
+// It must be called with the lock held.
+func (p *Publisher) publishDiscovery(info client.DeviceInfo) {
+	id := "qingping_" + strings.ToLower(info.MAC)
+	name := info.Name
+	if name == "" {
+		name = info.MAC
+	}
+	device := discoveryDevice{
+		Identifiers:  []string{id},
+		Connections:  [][]string{{"mac", info.MAC}},
+		Name:         name,
+		Manufacturer: "Qingping",
+		Model:        info.Product.EnName,
+		SWVersion:    info.Version,
+	}
+
+	for _, s := range sensors {
+		cfg := discoveryConfig{
+			Name:              s.name,
+			UniqueID:          id + "_" + s.key,
+			ObjectID:          id + "_" + s.key,
+			StateTopic:        p.stateTopic(info.MAC),
+			ValueTemplate:     fmt.Sprintf("{{ value_json.%s }}", s.key),
+			DeviceClass:       s.deviceClass,
+			StateClass:        "measurement",
+			UnitOfMeasurement: s.unit,
+			AvailabilityTopic: p.availabilityTopic(info.MAC),
+			Device:            device,
+		}
+		payload, err := json.Marshal(cfg)
+		if err != nil {
+			p.errors.Inc()
+			level.Error(p.logger).Log("msg", "failed to encode discovery config", "mac", info.MAC, "err", err)
+			continue
+		}
+		p.publish(p.discoveryTopic(info.MAC, s.key), payload)
+	}
+}
+
+// publish publishes a retained message without waiting for it to be delivered.
+// It must be called with the lock held.
+func (p *Publisher) publish(topic string, payload []byte) {
+	if p.client == nil || !p.client.IsConnectionOpen() {
+		p.errors.Inc()
+		level.Debug(p.logger).Log("msg", "not connected, dropping message", "topic", topic)
+		return
+	}
+
+	token := p.client.Publish(topic, 1, true, payload)
+	go func() {
+		<-token.Done()
+		if err := token.Error(); err != nil {
+			p.errors.Inc()
+			level.Warn(p.logger).Log("msg", "failed to publish message", "topic", topic, "err", err)
+		}
+	}()
+}
+
+func (p *Publisher) discoveryTopic(mac, key string) string {
+	return fmt.Sprintf("%s/sensor/qingping_%s/%s/config", p.cfg.DiscoveryPrefix, strings.ToLower(mac), key)
+}
+
+func (p *Publisher) stateTopic(mac string) string {
+	return fmt.Sprintf("%s/%s/state", p.cfg.TopicPrefix, strings.ToLower(mac))
+}
+
+func (p *Publisher) availabilityTopic(mac string) string {
+	return fmt.Sprintf("%s/%s/availability", p.cfg.TopicPrefix, strings.ToLower(mac))
+}
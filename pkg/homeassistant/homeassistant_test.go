@@ -0,0 +1,114 @@
+package homeassistant_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/homeassistant"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/mqtt"
+)
+
+func TestPublisher(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	broker := mochi.New(&mochi.Options{InlineClient: true})
+	require.NoError(t, broker.AddHook(new(auth.AllowHook), nil))
+	require.NoError(t, broker.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp", Address: addr})))
+	go func() {
+		_ = broker.Serve()
+	}()
+	defer broker.Close()
+
+	var (
+		mtx      sync.Mutex
+		messages = map[string][]byte{}
+	)
+	require.NoError(t, broker.Subscribe("#", 1, func(_ *mochi.Client, _ packets.Subscription, pk packets.Packet) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		messages[pk.TopicName] = pk.Payload
+	}))
+	received := func(topic string) []byte {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return messages[topic]
+	}
+
+	p := homeassistant.NewPublisher(
+		mqtt.Config{Broker: "tcp://" + addr, ClientID: "test"},
+		homeassistant.Config{Enabled: true, DiscoveryPrefix: "homeassistant", TopicPrefix: "qingping_exporter"},
+		prometheus.NewRegistry(),
+		log.NewNopLogger(),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- p.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		require.NoError(t, <-done)
+	}()
+
+	info := client.DeviceInfo{
+		MAC:     "34CE00000000",
+		Name:    "Office Air Monitor",
+		Version: "4.8.5",
+		Product: client.ProductInfo{Code: "CGDN1", EnName: "Qingping Air Monitor Lite"},
+		Status:  client.DeviceStatus{Offline: true},
+	}
+	require.NoError(t, p.UpdateDevice(ctx, info))
+	require.NoError(t, p.Write(ctx, exporter.NewReadings(info, []client.DeviceData{
+		{Timestamp: client.ValueData{Value: 1726749900}, CO2: client.ValueData{Value: 454}},
+		{Timestamp: client.ValueData{Value: 1726750800}, CO2: client.ValueData{Value: 452}, Temperature: client.ValueData{Value: 26.1}},
+	})))
+
+	const configTopic = "homeassistant/sensor/qingping_34ce00000000/temperature/config"
+	require.Eventually(t, func() bool {
+		return received(configTopic) != nil &&
+			received("qingping_exporter/34ce00000000/availability") != nil &&
+			received("qingping_exporter/34ce00000000/state") != nil
+	}, 10*time.Second, 10*time.Millisecond)
+
+	var cfg map[string]any
+	require.NoError(t, json.Unmarshal(received(configTopic), &cfg))
+	assert.Equal(t, "temperature", cfg["device_class"])
+	assert.Equal(t, "°C", cfg["unit_of_measurement"])
+	assert.Equal(t, "qingping_exporter/34ce00000000/state", cfg["state_topic"])
+	assert.Equal(t, "{{ value_json.temperature }}", cfg["value_template"])
+	assert.Equal(t, map[string]any{
+		"identifiers":  []any{"qingping_34ce00000000"},
+		"connections":  []any{[]any{"mac", "34CE00000000"}},
+		"name":         "Office Air Monitor",
+		"manufacturer": "Qingping",
+		"model":        "Qingping Air Monitor Lite",
+		"sw_version":   "4.8.5",
+	}, cfg["device"])
+
+	assert.Equal(t, "offline", string(received("qingping_exporter/34ce00000000/availability")))
+
+	var state map[string]any
+	require.NoError(t, json.Unmarshal(received("qingping_exporter/34ce00000000/state"), &state))
+	assert.Equal(t, 452.0, state["co2"])
+	assert.Equal(t, 26.1, state["temperature"])
+	assert.Equal(t, "2024-09-19T13:00:00Z", state["timestamp"])
+}
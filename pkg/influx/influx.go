@@ -0,0 +1,306 @@
+// Package influx writes device readings to InfluxDB using the v2 write API
+// and the line protocol.
+package influx
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+)
+
+// Config holds the InfluxDB writer settings.
+type Config struct {
+	URL    string
+	Token  string
+	Org    string
+	Bucket string
+
+	BatchSize     int
+	FlushInterval time.Duration
+	MaxRetries    int
+	RetryBackoff  time.Duration
+}
+
+func (c *Config) BindFlags(cmd *kingpin.CmdClause) {
+	cmd.Flag("influx.url", "URL of the InfluxDB server to write readings to, e.g. http://localhost:8086. Disabled when empty.").
+		Envar("QINGPING_INFLUX_URL").
+		StringVar(&c.URL)
+
+	cmd.Flag("influx.token", "API token used to write to InfluxDB.").
+		Envar("QINGPING_INFLUX_TOKEN").
+		StringVar(&c.Token)
+
+	cmd.Flag("influx.org", "InfluxDB organization.").
+		Envar("QINGPING_INFLUX_ORG").
+		StringVar(&c.Org)
+
+	cmd.Flag("influx.bucket", "InfluxDB bucket.").
+		Envar("QINGPING_INFLUX_BUCKET").
+		StringVar(&c.Bucket)
+
+	cmd.Flag("influx.batch-size", "Maximum number of lines sent in a single write.").
+		Default("500").
+		IntVar(&c.BatchSize)
+
+	cmd.Flag("influx.flush-interval", "Interval at which buffered lines are written.").
+		Default("10s").
+		DurationVar(&c.FlushInterval)
+
+	cmd.Flag("influx.max-retries", "Number of times a failed write is retried.").
+		Default("3").
+		IntVar(&c.MaxRetries)
+
+	cmd.Flag("influx.retry-backoff", "Initial backoff between retries, doubled on every attempt.").
+		Default("1s").
+		DurationVar(&c.RetryBackoff)
+}
+
+// Enabled reports whether a server was configured.
+func (c *Config) Enabled() bool {
+	return c.URL != ""
+}
+
+// Validate checks the settings required to write.
+func (c *Config) Validate() error {
+	if c.Bucket == "" {
+		return errors.New("--influx.bucket is required when writing to InfluxDB")
+	}
+	if c.BatchSize <= 0 {
+		return errors.New("--influx.batch-size must be positive")
+	}
+	return nil
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	tagEscaper         = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+)
+
+// Lines formats readings as line protocol entries, one per device and
+// timestamp. The measurement is the device model, tags come from the device
+// information, fields are the readings and the timestamp, in seconds, is the
+// one reported by the device.
+func Lines(readings []exporter.Reading) []string {
+	rows := exporter.Rows(readings)
+	lines := make([]string, 0, len(rows))
+	for _, row := range rows {
+		lines = append(lines, line(row))
+	}
+	return lines
+}
+
+func line(row exporter.Row) string {
+	var b strings.Builder
+	info := row.Device
+
+	measurement := strings.ToLower(info.Product.Code)
+	if measurement == "" {
+		measurement = "qingping"
+	}
+	b.WriteString(measurementEscaper.Replace(measurement))
+
+	// Tags are sorted by key, as recommended for write performance.
+	for _, tag := range [][2]string{
+		{"group", info.GroupName},
+		{"mac", info.MAC},
+		{"model", info.Product.EnName},
+		{"name", info.Name},
+		{"version", info.Version},
+	} {
+		// Empty tag values are not allowed.
+		if tag[1] == "" {
+			continue
+		}
+		b.WriteString("," + tag[0] + "=" + tagEscaper.Replace(tag[1]))
+	}
+
+	for i, r := range row.Readings {
+		sep := ","
+		if i == 0 {
+			sep = " "
+		}
+		b.WriteString(sep + tagEscaper.Replace(r.Field) + "=" + strconv.FormatFloat(r.Value, 'f', -1, 64))
+	}
+
+	b.WriteString(" " + strconv.FormatInt(row.Timestamp.Unix(), 10))
+	return b.String()
+}
+
+// Writer buffers readings as line protocol and writes them to InfluxDB in
+// batches. It implements exporter.Sink.
+type Writer struct {
+	cfg        Config
+	httpClient *http.Client
+	logger     log.Logger
+	lines      *prometheus.CounterVec
+
+	mtx    sync.Mutex
+	buffer []string
+	full   chan struct{}
+}
+
+func NewWriter(cfg Config, reg prometheus.Registerer, logger log.Logger) *Writer {
+	return &Writer{
+		cfg:        cfg,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		logger:     log.With(logger, "component", "influx"),
+		lines: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "qingping_influx_lines_total",
+			Help: "Number of line protocol entries written to InfluxDB, by result",
+		}, []string{"result"}),
+		full: make(chan struct{}, 1),
+	}
+}
+
+func (w *Writer) Name() string {
+	return "influx"
+}
+
+// Write buffers the readings, which are written on the next flush.
+func (w *Writer) Write(_ context.Context, readings []exporter.Reading) error {
+	lines := Lines(readings)
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.buffer = append(w.buffer, lines...)
+	if len(w.buffer) >= w.cfg.BatchSize {
+		select {
+		case w.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Run writes the buffered lines on every flush interval, or as soon as a batch
+// is full, until the context is done.
+func (w *Writer) Run(ctx context.Context) error {
+	level.Info(w.logger).Log("msg", "writing readings to InfluxDB", "url", w.cfg.URL, "bucket", w.cfg.Bucket)
+
+	ticker := time.NewTicker(w.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// Flush what was buffered before shutting down.
+			flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			w.Flush(flushCtx)
+			cancel()
+			return nil
+		case <-ticker.C:
+			w.Flush(ctx)
+		case <-w.full:
+			w.Flush(ctx)
+		}
+	}
+}
+
+// Flush writes all buffered lines in batches. Batches that still fail after
+// all retries are dropped.
+func (w *Writer) Flush(ctx context.Context) {
+	w.mtx.Lock()
+	lines := w.buffer
+	w.buffer = nil
+	w.mtx.Unlock()
+
+	for len(lines) > 0 {
+		n := min(len(lines), w.cfg.BatchSize)
+		batch := lines[:n]
+		lines = lines[n:]
+
+		if err := w.writeWithRetry(ctx, batch); err != nil {
+			w.lines.WithLabelValues("dropped").Add(float64(len(batch)))
+			level.Error(w.logger).Log("msg", "failed to write lines, dropping them", "lines", len(batch), "err", err)
+			continue
+		}
+		w.lines.WithLabelValues("written").Add(float64(len(batch)))
+	}
+}
+
+// permanentError is an error that retrying will not fix.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (w *Writer) writeWithRetry(ctx context.Context, lines []string) error {
+	body := []byte(strings.Join(lines, "\n") + "\n")
+	backoff := w.cfg.RetryBackoff
+
+	var err error
+	for attempt := 0; attempt <= w.cfg.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		err = w.write(ctx, body)
+		if err == nil {
+			return nil
+		}
+		var perm permanentError
+		if errors.As(err, &perm) {
+			return err
+		}
+		level.Warn(w.logger).Log("msg", "write to InfluxDB failed, retrying", "attempt", attempt+1, "err", err)
+	}
+	return err
+}
+
+func (w *Writer) write(ctx context.Context, body []byte) error {
+	values := url.Values{}
+	values.Set("org", w.cfg.Org)
+	values.Set("bucket", w.cfg.Bucket)
+	values.Set("precision", "s")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/api/v2/write?%s", strings.TrimSuffix(w.cfg.URL, "/"), values.Encode()), bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err: err}
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.cfg.Token != "" {
+		req.Header.Set("Authorization", "Token "+w.cfg.Token)
+	}
+
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("write failed: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	// Rate limiting and server errors are transient, anything else is not.
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return err
+	}
+	return permanentError{err: err}
+}
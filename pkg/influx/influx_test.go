@@ -0,0 +1,146 @@
+package influx_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/influx"
+)
+
+var testDevice = client.DeviceInfo{
+	MAC:     "34CE00000000",
+	Name:    "Office Air Monitor",
+	Version: "4.8.5",
+	Product: client.ProductInfo{Code: "CGDN1", EnName: "Qingping Air Monitor Lite"},
+}
+
+var testRows = []client.DeviceData{
+	{
+		Timestamp:   client.ValueData{Value: 1726749900},
+		Battery:     client.ValueData{Value: 47},
+		Temperature: client.ValueData{Value: 25.6},
+		Humidity:    client.ValueData{Value: 58.3},
+		CO2:         client.ValueData{Value: 454},
+		PM25:        client.ValueData{Value: 12},
+		PM10:        client.ValueData{Value: 12},
+	},
+	{
+		Timestamp:   client.ValueData{Value: 1726750800},
+		Battery:     client.ValueData{Value: 44},
+		Temperature: client.ValueData{Value: 26.1},
+		Humidity:    client.ValueData{Value: 56},
+		CO2:         client.ValueData{Value: 452},
+		PM25:        client.ValueData{Value: 12},
+		PM10:        client.ValueData{Value: 12},
+	},
+}
+
+func TestLines(t *testing.T) {
+	assert.Equal(t, []string{
+		`cgdn1,mac=34CE00000000,model=Qingping\ Air\ Monitor\ Lite,name=Office\ Air\ Monitor,version=4.8.5 temperature=25.6,humidity=58.3,co2=454,pm25=12,pm10=12,battery=47 1726749900`,
+		`cgdn1,mac=34CE00000000,model=Qingping\ Air\ Monitor\ Lite,name=Office\ Air\ Monitor,version=4.8.5 temperature=26.1,humidity=56,co2=452,pm25=12,pm10=12,battery=44 1726750800`,
+	}, influx.Lines(exporter.NewReadings(testDevice, testRows)))
+
+	assert.Equal(t, []string{
+		`qingping,group=a\,b\=c,mac=mac1 co2\ ppm=0 0`,
+	}, influx.Lines([]exporter.Reading{{
+		Device:    client.DeviceInfo{MAC: "mac1", GroupName: "a,b=c"},
+		Field:     "co2 ppm",
+		Timestamp: time.Unix(0, 0),
+	}}))
+}
+
+func TestWriter(t *testing.T) {
+	var (
+		attempts int
+		bodies   []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v2/write", r.URL.Path)
+		assert.Equal(t, "my-org", r.URL.Query().Get("org"))
+		assert.Equal(t, "my-bucket", r.URL.Query().Get("bucket"))
+		assert.Equal(t, "s", r.URL.Query().Get("precision"))
+		assert.Equal(t, "Token my-token", r.Header.Get("Authorization"))
+
+		attempts++
+		// Fail the first attempt to exercise retries.
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	reg := prometheus.NewRegistry()
+	w := influx.NewWriter(influx.Config{
+		URL:           srv.URL,
+		Token:         "my-token",
+		Org:           "my-org",
+		Bucket:        "my-bucket",
+		BatchSize:     1,
+		FlushInterval: time.Hour,
+		MaxRetries:    2,
+		RetryBackoff:  time.Millisecond,
+	}, reg, log.NewNopLogger())
+
+	require.NoError(t, w.Write(context.Background(), exporter.NewReadings(testDevice, testRows)))
+	w.Flush(context.Background())
+
+	assert.Equal(t, 3, attempts)
+	require.Len(t, bodies, 2)
+	lines := influx.Lines(exporter.NewReadings(testDevice, testRows))
+	assert.Equal(t, lines[0]+"\n", bodies[0])
+	assert.Equal(t, lines[1]+"\n", bodies[1])
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP qingping_influx_lines_total Number of line protocol entries written to InfluxDB, by result
+# TYPE qingping_influx_lines_total counter
+qingping_influx_lines_total{result="written"} 2
+`), "qingping_influx_lines_total"))
+}
+
+func TestWriter_DropsOnClientError(t *testing.T) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		attempts++
+		http.Error(w, `{"code":"invalid","message":"bad line"}`, http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	reg := prometheus.NewRegistry()
+	w := influx.NewWriter(influx.Config{
+		URL:           srv.URL,
+		Bucket:        "my-bucket",
+		BatchSize:     10,
+		FlushInterval: time.Hour,
+		MaxRetries:    3,
+		RetryBackoff:  time.Millisecond,
+	}, reg, log.NewNopLogger())
+
+	require.NoError(t, w.Write(context.Background(), exporter.NewReadings(testDevice, testRows)))
+	w.Flush(context.Background())
+
+	// Client errors are not retried.
+	assert.Equal(t, 1, attempts)
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP qingping_influx_lines_total Number of line protocol entries written to InfluxDB, by result
+# TYPE qingping_influx_lines_total counter
+qingping_influx_lines_total{result="dropped"} 2
+`), "qingping_influx_lines_total"))
+}
@@ -0,0 +1,268 @@
+package mixin
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/aqi"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+)
+
+// DashboardUID is the UID of the generated dashboard, stable so imports
+// replace the previous version.
+const DashboardUID = "qingping-air-monitors"
+
+// grafanaUnits maps the units of the fields and the conversion suffixes to
+// Grafana units.
+var grafanaUnits = map[string]string{
+	exporter.UnitCelsius:                 "celsius",
+	exporter.UnitPercent:                 "percent",
+	exporter.UnitPPM:                     "ppm",
+	exporter.UnitMicrogramsPerCubicMeter: "conμgm3",
+	exporter.UnitGramsPerCubicMeter:      "congm3",
+	exporter.UnitKilopascal:              "pressurekpa",
+	"fahrenheit":                         "fahrenheit",
+	"kelvin":                             "kelvin",
+	"pascals":                            "pressurepa",
+	"hectopascals":                       "pressurehpa",
+}
+
+// Dashboard is a Grafana dashboard, as imported from JSON.
+type Dashboard struct {
+	UID           string     `json:"uid"`
+	Title         string     `json:"title"`
+	Tags          []string   `json:"tags"`
+	Editable      bool       `json:"editable"`
+	Refresh       string     `json:"refresh"`
+	SchemaVersion int        `json:"schemaVersion"`
+	Time          TimeRange  `json:"time"`
+	Templating    Templating `json:"templating"`
+	Panels        []Panel    `json:"panels"`
+}
+
+type TimeRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type Templating struct {
+	List []Variable `json:"list"`
+}
+
+// Variable is a template variable of the dashboard.
+type Variable struct {
+	Name       string      `json:"name"`
+	Label      string      `json:"label,omitempty"`
+	Type       string      `json:"type"`
+	Query      string      `json:"query"`
+	Datasource *Datasource `json:"datasource,omitempty"`
+	Refresh    int         `json:"refresh,omitempty"`
+	Multi      bool        `json:"multi,omitempty"`
+	IncludeAll bool        `json:"includeAll,omitempty"`
+	AllValue   string      `json:"allValue,omitempty"`
+	Sort       int         `json:"sort,omitempty"`
+}
+
+type Datasource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type Panel struct {
+	ID          int         `json:"id"`
+	Type        string      `json:"type"`
+	Title       string      `json:"title"`
+	Description string      `json:"description,omitempty"`
+	GridPos     GridPos     `json:"gridPos"`
+	Datasource  *Datasource `json:"datasource,omitempty"`
+	Targets     []Target    `json:"targets,omitempty"`
+	FieldConfig FieldConfig `json:"fieldConfig"`
+}
+
+type GridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type Target struct {
+	RefID        string `json:"refId"`
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat,omitempty"`
+	Instant      bool   `json:"instant,omitempty"`
+	Format       string `json:"format,omitempty"`
+}
+
+type FieldConfig struct {
+	Defaults FieldDefaults `json:"defaults"`
+}
+
+type FieldDefaults struct {
+	Unit       string         `json:"unit,omitempty"`
+	Thresholds *Thresholds    `json:"thresholds,omitempty"`
+	Custom     map[string]any `json:"custom,omitempty"`
+}
+
+type Thresholds struct {
+	Mode  string          `json:"mode"`
+	Steps []ThresholdStep `json:"steps"`
+}
+
+// ThresholdStep colors the values from Value, the first step having none.
+type ThresholdStep struct {
+	Color string   `json:"color"`
+	Value *float64 `json:"value"`
+}
+
+// threshold returns thresholds coloring the values past value, above or below.
+func threshold(value float64, above bool) *Thresholds {
+	good, bad := "green", "red"
+	if !above {
+		good, bad = bad, good
+	}
+	return &Thresholds{Mode: "absolute", Steps: []ThresholdStep{{Color: good}, {Color: bad, Value: &value}}}
+}
+
+// Dashboard returns a dashboard of the devices, with a panel per gauge and the
+// state of the syncs. The devices can be filtered by MAC and extra label.
+func (c *Config) Dashboard() Dashboard {
+	ds := &Datasource{Type: "prometheus", UID: "${datasource}"}
+	variables := []Variable{{Name: "datasource", Label: "Data source", Type: "datasource", Query: "prometheus"}}
+	filters := make([]string, 0, len(c.ExtraLabels)+1)
+	for _, name := range append([]string{exporter.LabelDeviceMAC}, c.ExtraLabels...) {
+		variables = append(variables, Variable{
+			Name:       name,
+			Type:       "query",
+			Query:      fmt.Sprintf("label_values(%s%s, %s)", exporter.MetricDeviceInfo, c.selector(), name),
+			Datasource: ds,
+			// Refresh on time range change.
+			Refresh:    2,
+			Multi:      true,
+			IncludeAll: true,
+			// Also match the devices without the label.
+			AllValue: ".*",
+			Sort:     1,
+		})
+		filters = append(filters, fmt.Sprintf(`%s=~"$%s"`, name, name))
+	}
+	devices := c.selector(filters...)
+
+	var panels []Panel
+	add := func(p Panel, w, h int) {
+		// Panels are laid out left to right, wrapping at the width of the grid.
+		x, y := 0, 0
+		if n := len(panels); n > 0 {
+			last := panels[n-1].GridPos
+			x, y = last.X+last.W, last.Y
+			if x+w > 24 {
+				x, y = 0, last.Y+last.H
+			}
+		}
+		p.ID = len(panels) + 1
+		p.Datasource = ds
+		p.GridPos = GridPos{H: h, W: w, X: x, Y: y}
+		panels = append(panels, p)
+	}
+
+	add(Panel{
+		Type:  "table",
+		Title: "Devices",
+		Targets: []Target{{
+			RefID:   "A",
+			Expr:    exporter.MetricDeviceInfo + devices,
+			Instant: true,
+			Format:  "table",
+		}},
+	}, 24, 6)
+
+	legend := "{{" + exporter.LabelDeviceMAC + "}}"
+	for _, g := range c.gauges() {
+		title, _, _ := strings.Cut(g.field.Help, " in ")
+		title = strings.TrimSuffix(title, " percentage")
+		p := Panel{
+			Type:        "timeseries",
+			Title:       title,
+			Description: g.metric,
+			Targets:     []Target{{RefID: "A", Expr: g.metric + devices, LegendFormat: legend}},
+			FieldConfig: FieldConfig{Defaults: FieldDefaults{Unit: grafanaUnits[g.unit]}},
+		}
+		// Thresholds are only drawn in the units of the alerts.
+		if g.metric == g.field.Metric {
+			switch g.field.Name {
+			case "co2":
+				p.FieldConfig.Defaults.Thresholds = threshold(c.CO2Above, true)
+			case "pm25":
+				p.FieldConfig.Defaults.Thresholds = threshold(c.PM25Above, true)
+			case "pm10":
+				p.FieldConfig.Defaults.Thresholds = threshold(c.PM10Above, true)
+			case "battery":
+				p.FieldConfig.Defaults.Thresholds = threshold(c.BatteryBelow, false)
+			}
+		}
+		if p.FieldConfig.Defaults.Thresholds != nil {
+			p.FieldConfig.Defaults.Custom = map[string]any{"thresholdsStyle": map[string]any{"mode": "line"}}
+		}
+		add(p, 12, 8)
+	}
+
+	for _, standard := range c.AQIStandards {
+		add(Panel{
+			Type:  "timeseries",
+			Title: "Air quality index (" + standard + ")",
+			Targets: []Target{{
+				RefID:        "A",
+				Expr:         aqi.MetricAQI + c.selector(append([]string{fmt.Sprintf("standard=%q", standard)}, filters...)...),
+				LegendFormat: legend + " {{category}}",
+			}},
+		}, 12, 8)
+	}
+
+	add(Panel{
+		Type:        "timeseries",
+		Title:       "Time since last report",
+		Description: "Time since the devices last reported data.",
+		Targets: []Target{{
+			RefID:        "A",
+			Expr:         "time() - " + exporter.MetricLastReportTimestamp + devices,
+			LegendFormat: legend,
+		}},
+		FieldConfig: FieldConfig{Defaults: FieldDefaults{
+			Unit:       "s",
+			Thresholds: threshold(c.StaleAfter.Seconds(), true),
+			Custom:     map[string]any{"thresholdsStyle": map[string]any{"mode": "line"}},
+		}},
+	}, 12, 8)
+	add(Panel{
+		Type:  "timeseries",
+		Title: "Sync failures",
+		Targets: []Target{{
+			RefID:        "A",
+			Expr:         fmt.Sprintf("sum by (phase) (increase(%s%s[$__rate_interval]))", exporter.MetricSyncFailures, c.selector()),
+			LegendFormat: "{{phase}}",
+		}},
+		FieldConfig: FieldConfig{Defaults: FieldDefaults{Unit: "short"}},
+	}, 12, 8)
+	add(Panel{
+		Type:  "timeseries",
+		Title: "Sync duration, 90th percentile",
+		Targets: []Target{{
+			RefID:        "A",
+			Expr:         fmt.Sprintf("histogram_quantile(0.9, sum by (le, phase) (rate(%s_bucket%s[$__rate_interval])))", exporter.MetricSyncDuration, c.selector()),
+			LegendFormat: "{{phase}}",
+		}},
+		FieldConfig: FieldConfig{Defaults: FieldDefaults{Unit: "s"}},
+	}, 12, 8)
+
+	return Dashboard{
+		UID:           DashboardUID,
+		Title:         "Qingping air monitors",
+		Tags:          []string{"qingping"},
+		Editable:      true,
+		Refresh:       "1m",
+		SchemaVersion: 39,
+		Time:          TimeRange{From: "now-24h", To: "now"},
+		Templating:    Templating{List: variables},
+		Panels:        panels,
+	}
+}
@@ -0,0 +1,146 @@
+// Package mixin generates Prometheus rules and a Grafana dashboard for the
+// exporter. Metric names come from the definitions the exporter registers, so
+// the generated queries always match what it exposes.
+package mixin
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/aqi"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+)
+
+// Config holds the thresholds of the rules and the features enabled on the
+// exporter, which decide the metrics used.
+type Config struct {
+	// Selector holds label matchers added to every query, e.g. job="qingping".
+	Selector string
+
+	CO2Above     float64
+	PM25Above    float64
+	PM10Above    float64
+	BatteryBelow float64
+	StaleAfter   time.Duration
+	// For is how long the conditions must hold before the alerts fire.
+	For time.Duration
+
+	// Comfort, Units and AQIStandards are set as with the flags of the run command.
+	Comfort      bool
+	Units        []string
+	AQIStandards []string
+	// ExtraLabels are the names of the labels added to the per-device metrics,
+	// set from the config file.
+	ExtraLabels []string
+}
+
+func (c *Config) BindFlags(cmd *kingpin.CmdClause) {
+	cmd.Flag("selector", "Label matchers added to every query, e.g. job=\"qingping\".").
+		StringVar(&c.Selector)
+
+	cmd.Flag("alert.co2-above", "CO2 concentration in ppm above which the air is considered poor.").
+		Default("1200").
+		Float64Var(&c.CO2Above)
+
+	cmd.Flag("alert.pm25-above", "PM2.5 concentration in µg/m³ above which the air is considered poor.").
+		Default("35").
+		Float64Var(&c.PM25Above)
+
+	cmd.Flag("alert.pm10-above", "PM10 concentration in µg/m³ above which the air is considered poor.").
+		Default("50").
+		Float64Var(&c.PM10Above)
+
+	cmd.Flag("alert.battery-below", "Battery level percentage below which the battery is considered low.").
+		Default("20").
+		Float64Var(&c.BatteryBelow)
+
+	cmd.Flag("alert.stale-after", "Time without data after which the data of a device is considered stale.").
+		Default("30m").
+		DurationVar(&c.StaleAfter)
+
+	cmd.Flag("alert.for", "How long the conditions must hold before the alerts fire.").
+		Default("15m").
+		DurationVar(&c.For)
+
+	cmd.Flag("metrics.comfort", "Whether the exporter exposes the comfort metrics, as with the run command.").
+		BoolVar(&c.Comfort)
+
+	cmd.Flag("metrics.unit", "Unit the exporter also exposes the gauges in, as with the run command. Can be repeated.").
+		EnumsVar(&c.Units, exporter.ConversionNames()...)
+
+	cmd.Flag("aqi.standard", "Standard the exporter computes the air quality index with, as with the run command. Can be repeated.").
+		EnumsVar(&c.AQIStandards, aqi.StandardNames()...)
+}
+
+func (c *Config) Validate() error {
+	if c.Selector != "" {
+		if _, err := parser.ParseMetricSelector("{" + c.Selector + "}"); err != nil {
+			return errors.Wrap(err, "--selector")
+		}
+	}
+	if c.StaleAfter <= 0 {
+		return errors.New("--alert.stale-after must be positive")
+	}
+	if c.For < 0 {
+		return errors.New("--alert.for must not be negative")
+	}
+	return nil
+}
+
+// selector returns the label matchers of the config followed by the given
+// ones, in braces, or an empty string without any.
+func (c *Config) selector(matchers ...string) string {
+	all := make([]string, 0, len(matchers)+1)
+	if c.Selector != "" {
+		all = append(all, c.Selector)
+	}
+	all = append(all, matchers...)
+	if len(all) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(all, ", ") + "}"
+}
+
+// gauge is a per-device gauge of a field, in the unit it is exposed in.
+type gauge struct {
+	field  exporter.Field
+	metric string
+	unit   string
+}
+
+// gauges returns the gauges of the fields reported by the device model, and of
+// the comfort fields when enabled. Fields converted to another unit use the
+// gauge of the first conversion.
+func (c *Config) gauges() []gauge {
+	fields := exporter.FieldsFor(exporter.DeviceModel)
+	if c.Comfort {
+		fields = append(fields, exporter.ComfortFields...)
+	}
+	out := make([]gauge, 0, len(fields))
+	for _, f := range fields {
+		g := gauge{field: f, metric: f.Metric, unit: f.Unit}
+		for _, suffix := range c.Units {
+			if name, ok := exporter.ConvertedMetric(f, suffix); ok {
+				g.metric, g.unit = name, suffix
+				break
+			}
+		}
+		out = append(out, g)
+	}
+	return out
+}
+
+// metric returns the name of the gauge of a field.
+func metric(name string) string {
+	f, _ := exporter.FieldByName(name)
+	return f.Metric
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
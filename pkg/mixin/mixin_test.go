@@ -0,0 +1,184 @@
+package mixin_test
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/aqi"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/mixin"
+)
+
+func config() mixin.Config {
+	return mixin.Config{
+		Selector:     `job="qingping"`,
+		CO2Above:     1200,
+		PM25Above:    35,
+		PM10Above:    50,
+		BatteryBelow: 20,
+		StaleAfter:   30 * time.Minute,
+		For:          15 * time.Minute,
+		Comfort:      true,
+		Units:        []string{"fahrenheit"},
+		AQIStandards: []string{aqi.StandardUSEPA},
+		ExtraLabels:  []string{"room"},
+	}
+}
+
+// describeRecorder records the names of the metrics registered on it.
+type describeRecorder struct {
+	names map[string]bool
+}
+
+var fqNameRE = regexp.MustCompile(`fqName: "([^"]+)"`)
+
+func (r *describeRecorder) Register(c prometheus.Collector) error {
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		c.Describe(descs)
+		close(descs)
+	}()
+	for d := range descs {
+		r.names[fqNameRE.FindStringSubmatch(d.String())[1]] = true
+	}
+	return nil
+}
+
+func (r *describeRecorder) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		_ = r.Register(c)
+	}
+}
+
+func (r *describeRecorder) Unregister(prometheus.Collector) bool { return true }
+
+// registeredMetrics returns the names of the metrics registered by the exporter
+// with the features of the config enabled.
+func registeredMetrics(t *testing.T, c mixin.Config) map[string]bool {
+	t.Helper()
+	labels := make(map[string]string, len(c.ExtraLabels))
+	for _, name := range c.ExtraLabels {
+		labels[name] = "value"
+	}
+	extra, err := exporter.NewExtraLabels(labels, nil)
+	require.NoError(t, err)
+
+	r := &describeRecorder{names: make(map[string]bool)}
+	exporter.NewAirMonitorLiteExporter(client.New(&client.APIConfig{}), r, log.NewNopLogger(),
+		exporter.WithComfortMetrics(c.Comfort),
+		exporter.WithUnitConversions(c.Units...),
+		exporter.WithExtraLabels(extra),
+	)
+	aqi.NewSink(aqi.Config{Standards: c.AQIStandards, ExtraLabels: extra}, r)
+	return r.names
+}
+
+// metricNames returns the names of the metrics an expression selects.
+func metricNames(t *testing.T, expr string) []string {
+	t.Helper()
+	// Grafana variables are replaced by a valid duration.
+	e, err := parser.ParseExpr(strings.ReplaceAll(expr, "$__rate_interval", "5m"))
+	require.NoError(t, err, expr)
+
+	var names []string
+	parser.Inspect(e, func(node parser.Node, _ []parser.Node) error {
+		if vs, ok := node.(*parser.VectorSelector); ok {
+			names = append(names, vs.Name)
+		}
+		return nil
+	})
+	return names
+}
+
+func TestRules(t *testing.T) {
+	c := config()
+	b, err := yaml.Marshal(c.Rules())
+	require.NoError(t, err)
+
+	groups, errs := rulefmt.Parse(b)
+	require.Empty(t, errs)
+	require.Len(t, groups.Groups, 2)
+
+	registered := registeredMetrics(t, c)
+	var alerts []string
+	for _, g := range groups.Groups {
+		for _, r := range g.Rules {
+			if r.Alert.Value != "" {
+				alerts = append(alerts, r.Alert.Value)
+			}
+			assert.Contains(t, r.Expr.Value, c.Selector)
+			for _, name := range metricNames(t, r.Expr.Value) {
+				assert.True(t, registered[name], "%s is not registered by the exporter", name)
+			}
+		}
+	}
+	assert.Equal(t, []string{
+		"QingpingDeviceOffline", "QingpingBatteryLow", "QingpingDataStale",
+		mixin.AlertHighCO2, mixin.AlertHighPM25, mixin.AlertHighPM10, mixin.AlertSyncFailures,
+	}, alerts)
+	assert.Equal(t, "qingping:qingping_temperature_fahrenheit:avg1h", groups.Groups[0].Rules[0].Record.Value)
+}
+
+func TestDashboard(t *testing.T) {
+	c := config()
+	b, err := json.Marshal(c.Dashboard())
+	require.NoError(t, err)
+
+	var d mixin.Dashboard
+	require.NoError(t, json.Unmarshal(b, &d))
+	assert.Equal(t, mixin.DashboardUID, d.UID)
+
+	var variables []string
+	for _, v := range d.Templating.List {
+		variables = append(variables, v.Name)
+	}
+	assert.Equal(t, []string{"datasource", "device_mac", "room"}, variables)
+
+	registered := registeredMetrics(t, c)
+	ids := make(map[int]bool)
+	for _, p := range d.Panels {
+		assert.False(t, ids[p.ID], "duplicate panel ID %d", p.ID)
+		ids[p.ID] = true
+		assert.LessOrEqual(t, p.GridPos.X+p.GridPos.W, 24)
+
+		require.NotEmpty(t, p.Targets)
+		for _, target := range p.Targets {
+			for _, name := range metricNames(t, target.Expr) {
+				name = strings.TrimSuffix(name, "_bucket")
+				assert.True(t, registered[name], "%s is not registered by the exporter", name)
+			}
+		}
+	}
+
+	titles := make(map[string]string)
+	for _, p := range d.Panels {
+		titles[p.Title] = p.Targets[0].Expr
+	}
+	assert.Equal(t, `qingping_temperature_fahrenheit{job="qingping", device_mac=~"$device_mac", room=~"$room"}`, titles["Temperature"])
+	assert.Contains(t, titles, "Dew point")
+	assert.Contains(t, titles, "Air quality index (us_epa)")
+}
+
+func TestConfig_Validate(t *testing.T) {
+	c := config()
+	require.NoError(t, c.Validate())
+
+	c.Selector = `job=`
+	assert.Error(t, c.Validate())
+
+	c = config()
+	c.StaleAfter = 0
+	assert.Error(t, c.Validate())
+}
@@ -0,0 +1,124 @@
+package mixin
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/alertmanager"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+)
+
+// Names of the alerts on the air quality and the syncs. The alerts on the
+// device state are named as the ones pushed to Alertmanager.
+const (
+	AlertHighCO2      = "QingpingHighCO2"
+	AlertHighPM25     = "QingpingHighPM25"
+	AlertHighPM10     = "QingpingHighPM10"
+	AlertSyncFailures = "QingpingSyncFailures"
+)
+
+// syncFailuresWindow is the window the sync failures are counted over.
+const syncFailuresWindow = 15 * time.Minute
+
+// RuleFile is a Prometheus rule file.
+type RuleFile struct {
+	Groups []RuleGroup `yaml:"groups"`
+}
+
+type RuleGroup struct {
+	Name  string `yaml:"name"`
+	Rules []Rule `yaml:"rules"`
+}
+
+// Rule is either a recording or an alerting rule.
+type Rule struct {
+	Record      string            `yaml:"record,omitempty"`
+	Alert       string            `yaml:"alert,omitempty"`
+	Expr        string            `yaml:"expr"`
+	For         model.Duration    `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// Rules returns the recording rules of hourly averages of the gauges, and the
+// alerting rules on the device state, the air quality and the syncs.
+func (c *Config) Rules() RuleFile {
+	var recording []Rule
+	for _, g := range c.gauges() {
+		if g.field.Name == "battery" {
+			continue
+		}
+		// The averages keep all the labels of the series, so the level of the
+		// rule names is neutral.
+		recording = append(recording, Rule{
+			Record: "qingping:" + g.metric + ":avg1h",
+			Expr:   fmt.Sprintf("avg_over_time(%s%s[1h])", g.metric, c.selector()),
+		})
+	}
+	recording = append(recording, Rule{
+		Record: "status:" + exporter.MetricDeviceInfo + ":count",
+		Expr:   fmt.Sprintf("count by (status) (%s%s)", exporter.MetricDeviceInfo, c.selector()),
+	})
+
+	device := "{{ $labels." + exporter.LabelDeviceMAC + " }}"
+	// threshold returns an alert on a field crossing a value, named as the
+	// quantity in the annotations.
+	threshold := func(alert, field, quantity string, above bool, value float64, unit string) Rule {
+		comparison, word := "<", "below"
+		if above {
+			comparison, word = ">", "above"
+		}
+		return Rule{
+			Alert:  alert,
+			Expr:   fmt.Sprintf("%s%s %s %s", metric(field), c.selector(), comparison, formatFloat(value)),
+			For:    model.Duration(c.For),
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("%s of %s is %s %s%s", quantity, device, word, formatFloat(value), unit),
+				"description": fmt.Sprintf("%s is at {{ $value }}%s.", quantity, unit),
+			},
+		}
+	}
+	alerts := []Rule{
+		{
+			Alert:  alertmanager.AlertDeviceOffline,
+			Expr:   fmt.Sprintf("%s%s", exporter.MetricDeviceInfo, c.selector(`status="offline"`)),
+			For:    model.Duration(c.For),
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "{{ $labels.device_name }} is offline",
+				"description": "The Qingping API reports the device " + device + " offline.",
+			},
+		},
+		threshold(alertmanager.AlertBatteryLow, "battery", "Battery", false, c.BatteryBelow, "%"),
+		{
+			Alert:  alertmanager.AlertDataStale,
+			Expr:   fmt.Sprintf("time() - %s%s > %d", exporter.MetricLastReportTimestamp, c.selector(), int64(c.StaleAfter.Seconds())),
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "No data from " + device,
+				"description": "The last data was reported {{ $value | humanizeDuration }} ago.",
+			},
+		},
+		threshold(AlertHighCO2, "co2", "CO2", true, c.CO2Above, " ppm"),
+		threshold(AlertHighPM25, "pm25", "PM2.5", true, c.PM25Above, " µg/m³"),
+		threshold(AlertHighPM10, "pm10", "PM10", true, c.PM10Above, " µg/m³"),
+		{
+			Alert:  AlertSyncFailures,
+			Expr:   fmt.Sprintf("increase(%s%s[%s]) > 0", exporter.MetricSyncFailures, c.selector(), model.Duration(syncFailuresWindow)),
+			For:    model.Duration(c.For),
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "The exporter fails to sync with the Qingping API",
+				"description": "{{ $value | humanize }} requests of the {{ $labels.phase }} phase failed in the last " + model.Duration(syncFailuresWindow).String() + ".",
+			},
+		},
+	}
+
+	return RuleFile{Groups: []RuleGroup{
+		{Name: "qingping.rules", Rules: recording},
+		{Name: "qingping.alerts", Rules: alerts},
+	}}
+}
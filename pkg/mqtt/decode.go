@@ -0,0 +1,171 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+
+	"github.com/efficientgo/core/errors"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+)
+
+// Message types of JSON reports sent by devices.
+const (
+	typeRealtime = "12"
+	typeHistory  = "17"
+)
+
+// jsonReport is a JSON report published by a device.
+type jsonReport struct {
+	Type       string              `json:"type"`
+	MAC        string              `json:"mac"`
+	Timestamp  int64               `json:"timestamp"`
+	SensorData []client.DeviceData `json:"sensorData"`
+}
+
+// Keys of the binary protocol holding sensor data.
+const (
+	keyHistory  = 0x03
+	keyRealtime = 0x14
+)
+
+var binaryMagic = []byte("CG")
+
+// Decode decodes a report published by a device on the given topic, returning
+// the MAC of the device and its readings. Both the JSON and the binary report
+// formats are supported. Reports that carry no sensor data (e.g. heartbeats or
+// setting acknowledgements) return no readings and no error.
+func Decode(topic string, payload []byte) (string, []client.DeviceData, error) {
+	mac := macFromTopic(topic)
+
+	payload = bytes.TrimSpace(payload)
+	switch {
+	case len(payload) == 0:
+		return mac, nil, errors.New("empty payload")
+	case payload[0] == '{':
+		return decodeJSON(mac, payload)
+	case bytes.HasPrefix(payload, binaryMagic):
+		data, err := decodeBinary(payload)
+		return mac, data, err
+	default:
+		return mac, nil, errors.New("unknown payload format")
+	}
+}
+
+// macFromTopic extracts the device MAC from a <prefix>/<mac>/up topic.
+func macFromTopic(topic string) string {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return strings.ToUpper(parts[len(parts)-2])
+}
+
+func decodeJSON(mac string, payload []byte) (string, []client.DeviceData, error) {
+	var r jsonReport
+	if err := json.Unmarshal(payload, &r); err != nil {
+		return mac, nil, errors.Wrap(err, "decode JSON report")
+	}
+	if r.MAC != "" {
+		mac = strings.ToUpper(r.MAC)
+	}
+	if r.Type != typeRealtime && r.Type != typeHistory {
+		return mac, nil, nil
+	}
+
+	data := r.SensorData[:0]
+	for _, d := range r.SensorData {
+		// Realtime reports may omit the reading timestamp.
+		if d.Timestamp.Value == 0 {
+			d.Timestamp.Value = float64(r.Timestamp)
+		}
+		data = append(data, d)
+	}
+	return mac, data, nil
+}
+
+// decodeBinary decodes a binary report. A frame is laid out as:
+//
+//	"CG" | command (1) | length (2, LE) | payload (length) | checksum (2, LE)
+//
+// where the checksum is the sum of all preceding bytes and the payload is a
+// sequence of key (1) | length (2, LE) | value entries. Sensor data entries
+// hold a base timestamp (4, LE), the interval between records in seconds
+// (2, LE) and a list of 10-byte records:
+//
+//	temperature and humidity (3) | PM2.5 (2, LE) | PM10 (2, LE) | CO2 (2, LE) | battery (1)
+//
+// Temperature and humidity are packed in 24 bits, the upper 12 holding the
+// temperature in tenths of a degree offset by 500 and the lower 12 the
+// humidity in tenths of a percent.
+func decodeBinary(frame []byte) ([]client.DeviceData, error) {
+	const headerLen, checksumLen = 5, 2
+	if len(frame) < headerLen+checksumLen {
+		return nil, errors.New("binary report too short")
+	}
+
+	length := int(binary.LittleEndian.Uint16(frame[3:5]))
+	if len(frame) != headerLen+length+checksumLen {
+		return nil, errors.Newf("binary report length mismatch: header says %d bytes, got %d", length, len(frame)-headerLen-checksumLen)
+	}
+
+	var sum uint16
+	for _, b := range frame[:headerLen+length] {
+		sum += uint16(b)
+	}
+	if expected := binary.LittleEndian.Uint16(frame[headerLen+length:]); sum != expected {
+		return nil, errors.Newf("binary report checksum mismatch: expected %#04x, got %#04x", expected, sum)
+	}
+
+	var data []client.DeviceData
+	payload := frame[headerLen : headerLen+length]
+	for len(payload) > 0 {
+		if len(payload) < 3 {
+			return nil, errors.New("truncated binary report entry")
+		}
+		key := payload[0]
+		n := int(binary.LittleEndian.Uint16(payload[1:3]))
+		if len(payload) < 3+n {
+			return nil, errors.Newf("truncated binary report entry %#02x", key)
+		}
+		value := payload[3 : 3+n]
+		payload = payload[3+n:]
+
+		if key != keyHistory && key != keyRealtime {
+			continue
+		}
+		records, err := decodeSensorData(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decode sensor data entry %#02x", key)
+		}
+		data = append(data, records...)
+	}
+	return data, nil
+}
+
+func decodeSensorData(b []byte) ([]client.DeviceData, error) {
+	const prefixLen, recordLen = 6, 10
+	if len(b) < prefixLen || (len(b)-prefixLen)%recordLen != 0 {
+		return nil, errors.Newf("invalid sensor data length %d", len(b))
+	}
+
+	ts := binary.LittleEndian.Uint32(b[0:4])
+	interval := binary.LittleEndian.Uint16(b[4:6])
+
+	var data []client.DeviceData
+	for i, r := 0, b[prefixLen:]; len(r) > 0; i, r = i+1, r[recordLen:] {
+		th := uint32(r[0])<<16 | uint32(r[1])<<8 | uint32(r[2])
+		data = append(data, client.DeviceData{
+			Timestamp:   client.ValueData{Value: float64(ts + uint32(i)*uint32(interval))},
+			Temperature: client.ValueData{Value: (float64(th>>12) - 500) / 10},
+			Humidity:    client.ValueData{Value: float64(th&0xfff) / 10},
+			PM25:        client.ValueData{Value: float64(binary.LittleEndian.Uint16(r[3:5]))},
+			PM10:        client.ValueData{Value: float64(binary.LittleEndian.Uint16(r[5:7]))},
+			CO2:         client.ValueData{Value: float64(binary.LittleEndian.Uint16(r[7:9]))},
+			Battery:     client.ValueData{Value: float64(r[9])},
+		})
+	}
+	return data, nil
+}
@@ -0,0 +1,166 @@
+// Package mqtt ingests reports published by Qingping devices configured with
+// a private MQTT server.
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+)
+
+// Config holds the connection settings of the MQTT broker.
+type Config struct {
+	Broker      string
+	Username    string
+	Password    string
+	ClientID    string
+	TopicPrefix string
+}
+
+func (c *Config) BindFlags(cmd *kingpin.CmdClause) {
+	cmd.Flag("mqtt.broker", "URL of the MQTT broker devices publish to, e.g. tcp://localhost:1883. Disabled when empty.").
+		Envar("QINGPING_MQTT_BROKER").
+		StringVar(&c.Broker)
+
+	cmd.Flag("mqtt.username", "Username to connect to the MQTT broker.").
+		Envar("QINGPING_MQTT_USERNAME").
+		StringVar(&c.Username)
+
+	cmd.Flag("mqtt.password", "Password to connect to the MQTT broker.").
+		Envar("QINGPING_MQTT_PASSWORD").
+		StringVar(&c.Password)
+
+	cmd.Flag("mqtt.client-id", "Client ID used to connect to the MQTT broker. Defaults to one derived from the hostname.").
+		StringVar(&c.ClientID)
+
+	cmd.Flag("mqtt.topic-prefix", "Prefix of the topics devices publish to, as configured on the devices.").
+		Default("qingping").
+		StringVar(&c.TopicPrefix)
+}
+
+// Enabled reports whether a broker was configured.
+func (c *Config) Enabled() bool {
+	return c.Broker != ""
+}
+
+// ClientOptions returns the options to connect to the configured broker. The
+// clientSuffix is appended to the client ID so multiple clients can share a config.
+func (c *Config) ClientOptions(clientSuffix string) *paho.ClientOptions {
+	clientID := c.ClientID
+	if clientID == "" {
+		hostname, _ := os.Hostname()
+		clientID = fmt.Sprintf("qingping_exporter_%s", hostname)
+	}
+
+	return paho.NewClientOptions().
+		AddBroker(c.Broker).
+		SetClientID(clientID + clientSuffix).
+		SetUsername(c.Username).
+		SetPassword(c.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(5 * time.Second)
+}
+
+// Wait waits for the token to complete or the context to be done.
+func Wait(ctx context.Context, token paho.Token) error {
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// InventoryFunc looks up the cloud information of a device by MAC.
+type InventoryFunc func(mac string) (client.DeviceInfo, bool)
+
+// ObserveFunc is called with the readings decoded from every report.
+type ObserveFunc func(info client.DeviceInfo, data []client.DeviceData)
+
+// Subscriber subscribes to device reports and decodes them into readings.
+type Subscriber struct {
+	cfg       Config
+	inventory InventoryFunc
+	observe   ObserveFunc
+	logger    log.Logger
+	messages  *prometheus.CounterVec
+}
+
+// NewSubscriber creates a subscriber. The inventory is used to attach the
+// cloud device information to reports and may be nil.
+func NewSubscriber(cfg Config, inventory InventoryFunc, observe ObserveFunc, reg prometheus.Registerer, logger log.Logger) *Subscriber {
+	return &Subscriber{
+		cfg:       cfg,
+		inventory: inventory,
+		observe:   observe,
+		logger:    log.With(logger, "component", "mqtt"),
+		messages: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "qingping_mqtt_messages_total",
+			Help: "Number of MQTT messages received from devices, by result",
+		}, []string{"result"}),
+	}
+}
+
+// Topic is the topic filter matching the reports of all devices.
+func (s *Subscriber) Topic() string {
+	return s.cfg.TopicPrefix + "/+/up"
+}
+
+// Run connects to the broker and processes reports until the context is done.
+// The subscription is renewed whenever the client reconnects.
+func (s *Subscriber) Run(ctx context.Context) error {
+	opts := s.cfg.ClientOptions("_sub").SetOnConnectHandler(func(c paho.Client) {
+		if err := Wait(ctx, c.Subscribe(s.Topic(), 1, s.handle)); err != nil {
+			level.Error(s.logger).Log("msg", "failed to subscribe to device reports", "topic", s.Topic(), "err", err)
+			return
+		}
+		level.Info(s.logger).Log("msg", "subscribed to device reports", "broker", s.cfg.Broker, "topic", s.Topic())
+	})
+
+	c := paho.NewClient(opts)
+	if err := Wait(ctx, c.Connect()); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return errors.Wrapf(err, "connect to MQTT broker %s", s.cfg.Broker)
+	}
+	defer c.Disconnect(250)
+
+	<-ctx.Done()
+	return nil
+}
+
+func (s *Subscriber) handle(_ paho.Client, msg paho.Message) {
+	mac, data, err := Decode(msg.Topic(), msg.Payload())
+	if err != nil {
+		s.messages.WithLabelValues("invalid").Inc()
+		level.Warn(s.logger).Log("msg", "failed to decode device report", "topic", msg.Topic(), "err", err)
+		return
+	}
+	if len(data) == 0 {
+		s.messages.WithLabelValues("ignored").Inc()
+		return
+	}
+
+	info := client.DeviceInfo{MAC: mac}
+	if s.inventory != nil {
+		if known, ok := s.inventory(mac); ok {
+			info = known
+		}
+	}
+
+	s.messages.WithLabelValues("accepted").Inc()
+	s.observe(info, data)
+}
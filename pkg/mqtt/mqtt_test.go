@@ -0,0 +1,222 @@
+package mqtt_test
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/mqtt"
+)
+
+const jsonReport = `{
+	"type": "17",
+	"id": 1,
+	"need_ack": 1,
+	"mac": "34ce00000000",
+	"timestamp": 1726750810,
+	"sensorData": [
+		{"timestamp": {"value": 1726749900}, "battery": {"value": 47}, "temperature": {"value": 25.6}, "humidity": {"value": 58.3}, "co2": {"value": 454}, "pm25": {"value": 12}, "pm10": {"value": 12}},
+		{"timestamp": {"value": 1726750800}, "battery": {"value": 44}, "temperature": {"value": 26.1}, "humidity": {"value": 56}, "co2": {"value": 452}, "pm25": {"value": 12}, "pm10": {"value": 12}}
+	]
+}`
+
+// binaryReport builds a binary report frame with a single sensor data entry.
+func binaryReport(ts uint32, interval uint16, records ...[]byte) []byte {
+	value := binary.LittleEndian.AppendUint32(nil, ts)
+	value = binary.LittleEndian.AppendUint16(value, interval)
+	for _, r := range records {
+		value = append(value, r...)
+	}
+
+	payload := []byte{0x14}
+	payload = binary.LittleEndian.AppendUint16(payload, uint16(len(value)))
+	payload = append(payload, value...)
+
+	frame := []byte{'C', 'G', 0x41}
+	frame = binary.LittleEndian.AppendUint16(frame, uint16(len(payload)))
+	frame = append(frame, payload...)
+
+	var sum uint16
+	for _, b := range frame {
+		sum += uint16(b)
+	}
+	return binary.LittleEndian.AppendUint16(frame, sum)
+}
+
+// record encodes a binary sensor record.
+func record(temperature, humidity float64, pm25, pm10, co2 uint16, battery byte) []byte {
+	th := uint32(temperature*10+500)<<12 | uint32(humidity*10)
+	r := []byte{byte(th >> 16), byte(th >> 8), byte(th)}
+	r = binary.LittleEndian.AppendUint16(r, pm25)
+	r = binary.LittleEndian.AppendUint16(r, pm10)
+	r = binary.LittleEndian.AppendUint16(r, co2)
+	return append(r, battery)
+}
+
+func TestDecode(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		topic        string
+		payload      []byte
+		expectedMAC  string
+		expectedData []client.DeviceData
+		expectErr    bool
+	}{
+		{
+			name:        "json history report",
+			topic:       "qingping/34CE00000000/up",
+			payload:     []byte(jsonReport),
+			expectedMAC: "34CE00000000",
+			expectedData: []client.DeviceData{
+				{Timestamp: client.ValueData{Value: 1726749900}, Battery: client.ValueData{Value: 47}, Temperature: client.ValueData{Value: 25.6}, Humidity: client.ValueData{Value: 58.3}, CO2: client.ValueData{Value: 454}, PM25: client.ValueData{Value: 12}, PM10: client.ValueData{Value: 12}},
+				{Timestamp: client.ValueData{Value: 1726750800}, Battery: client.ValueData{Value: 44}, Temperature: client.ValueData{Value: 26.1}, Humidity: client.ValueData{Value: 56}, CO2: client.ValueData{Value: 452}, PM25: client.ValueData{Value: 12}, PM10: client.ValueData{Value: 12}},
+			},
+		},
+		{
+			name:        "json realtime report without reading timestamp",
+			topic:       "qingping/34CE00000000/up",
+			payload:     []byte(`{"type": "12", "timestamp": 1726750810, "sensorData": [{"co2": {"value": 500}}]}`),
+			expectedMAC: "34CE00000000",
+			expectedData: []client.DeviceData{
+				{Timestamp: client.ValueData{Value: 1726750810}, CO2: client.ValueData{Value: 500}},
+			},
+		},
+		{
+			name:        "json report without sensor data",
+			topic:       "qingping/34CE00000000/up",
+			payload:     []byte(`{"type": "13", "timestamp": 1726750810}`),
+			expectedMAC: "34CE00000000",
+		},
+		{
+			name:        "binary report",
+			topic:       "qingping/34ce00000000/up",
+			payload:     binaryReport(1726749900, 900, record(25.6, 58.3, 12, 13, 454, 47), record(-5.2, 56, 11, 12, 452, 44)),
+			expectedMAC: "34CE00000000",
+			expectedData: []client.DeviceData{
+				{Timestamp: client.ValueData{Value: 1726749900}, Battery: client.ValueData{Value: 47}, Temperature: client.ValueData{Value: 25.6}, Humidity: client.ValueData{Value: 58.3}, CO2: client.ValueData{Value: 454}, PM25: client.ValueData{Value: 12}, PM10: client.ValueData{Value: 13}},
+				{Timestamp: client.ValueData{Value: 1726750800}, Battery: client.ValueData{Value: 44}, Temperature: client.ValueData{Value: -5.2}, Humidity: client.ValueData{Value: 56}, CO2: client.ValueData{Value: 452}, PM25: client.ValueData{Value: 11}, PM10: client.ValueData{Value: 12}},
+			},
+		},
+		{
+			name:      "binary report with bad checksum",
+			topic:     "qingping/34CE00000000/up",
+			payload:   append(binaryReport(1726749900, 900, record(25.6, 58.3, 12, 13, 454, 47))[:20], 0, 0),
+			expectErr: true,
+		},
+		{
+			name:      "unknown payload",
+			topic:     "qingping/34CE00000000/up",
+			payload:   []byte("hello"),
+			expectErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mac, data, err := mqtt.Decode(tc.topic, tc.payload)
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedMAC, mac)
+			require.Len(t, data, len(tc.expectedData))
+			for i := range data {
+				assert.Equal(t, tc.expectedData[i].Timestamp, data[i].Timestamp)
+				assert.InDelta(t, tc.expectedData[i].Temperature.Value, data[i].Temperature.Value, 1e-9)
+				assert.InDelta(t, tc.expectedData[i].Humidity.Value, data[i].Humidity.Value, 1e-9)
+				assert.Equal(t, tc.expectedData[i].CO2, data[i].CO2)
+				assert.Equal(t, tc.expectedData[i].PM25, data[i].PM25)
+				assert.Equal(t, tc.expectedData[i].PM10, data[i].PM10)
+				assert.Equal(t, tc.expectedData[i].Battery, data[i].Battery)
+			}
+		})
+	}
+}
+
+// startBroker starts an embedded MQTT broker and returns its address.
+func startBroker(t *testing.T) (*mochi.Server, string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	server := mochi.New(&mochi.Options{InlineClient: true})
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	require.NoError(t, server.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp", Address: addr})))
+	go func() {
+		_ = server.Serve()
+	}()
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+
+	return server, "tcp://" + addr
+}
+
+func TestSubscriber(t *testing.T) {
+	broker, addr := startBroker(t)
+
+	var (
+		mtx      sync.Mutex
+		observed []client.DeviceInfo
+	)
+	inventory := func(mac string) (client.DeviceInfo, bool) {
+		if mac == "34CE00000000" {
+			return client.DeviceInfo{MAC: mac, Name: "Office Air Monitor"}, true
+		}
+		return client.DeviceInfo{}, false
+	}
+	observe := func(info client.DeviceInfo, data []client.DeviceData) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		observed = append(observed, info)
+		assert.Len(t, data, 2)
+	}
+
+	cfg := mqtt.Config{Broker: addr, ClientID: "test", TopicPrefix: "qingping"}
+	sub := mqtt.NewSubscriber(cfg, inventory, observe, prometheus.NewRegistry(), log.NewNopLogger())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- sub.Run(ctx)
+	}()
+
+	// Wait for the subscription before publishing.
+	require.Eventually(t, func() bool {
+		return len(broker.Topics.Subscribers("qingping/34CE00000000/up").Subscriptions) > 0
+	}, 10*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, broker.Publish("qingping/34CE00000000/up", []byte(jsonReport), false, 1))
+	require.NoError(t, broker.Publish("qingping/34CE00000001/up",
+		binaryReport(1726749900, 900, record(25.6, 58.3, 12, 13, 454, 47), record(26.1, 56, 12, 12, 452, 44)), false, 1))
+
+	require.Eventually(t, func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return len(observed) == 2
+	}, 10*time.Second, 10*time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-done)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	assert.ElementsMatch(t, []client.DeviceInfo{
+		{MAC: "34CE00000000", Name: "Office Air Monitor"},
+		{MAC: "34CE00000001"},
+	}, observed)
+}
@@ -0,0 +1,328 @@
+// Package otlp pushes device readings to an OpenTelemetry collector over OTLP,
+// as an alternative to Prometheus scraping.
+package otlp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+)
+
+// Protocols supported to push metrics.
+const (
+	ProtocolHTTP = "http"
+	ProtocolGRPC = "grpc"
+)
+
+// Config holds the OTLP exporter settings.
+type Config struct {
+	Endpoint string
+	Protocol string
+	Headers  map[string]string
+	Interval time.Duration
+
+	TLSCAFile             string
+	TLSCertFile           string
+	TLSKeyFile            string
+	TLSInsecureSkipVerify bool
+}
+
+func (c *Config) BindFlags(cmd *kingpin.CmdClause) {
+	cmd.Flag("otlp.endpoint", "URL of the OTLP receiver to push metrics to, e.g. http://localhost:4318. Disabled when empty.").
+		Envar("QINGPING_OTLP_ENDPOINT").
+		StringVar(&c.Endpoint)
+
+	cmd.Flag("otlp.protocol", "Protocol used to push metrics.").
+		Default(ProtocolHTTP).
+		EnumVar(&c.Protocol, ProtocolHTTP, ProtocolGRPC)
+
+	cmd.Flag("otlp.header", "Header sent with every push, as key=value. Can be repeated.").
+		StringMapVar(&c.Headers)
+
+	cmd.Flag("otlp.interval", "Interval between pushes.").
+		Default("30s").
+		DurationVar(&c.Interval)
+
+	cmd.Flag("otlp.tls.ca-file", "CA certificate used to verify the OTLP receiver.").
+		StringVar(&c.TLSCAFile)
+
+	cmd.Flag("otlp.tls.cert-file", "Client certificate used to authenticate to the OTLP receiver.").
+		StringVar(&c.TLSCertFile)
+
+	cmd.Flag("otlp.tls.key-file", "Client key used to authenticate to the OTLP receiver.").
+		StringVar(&c.TLSKeyFile)
+
+	cmd.Flag("otlp.tls.insecure-skip-verify", "Skip verification of the OTLP receiver certificate.").
+		BoolVar(&c.TLSInsecureSkipVerify)
+}
+
+// Enabled reports whether an endpoint was configured.
+func (c *Config) Enabled() bool {
+	return c.Endpoint != ""
+}
+
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	if c.TLSCAFile == "" && c.TLSCertFile == "" && !c.TLSInsecureSkipVerify {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: c.TLSInsecureSkipVerify,
+	}
+	if c.TLSCAFile != "" {
+		ca, err := os.ReadFile(c.TLSCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read CA file")
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.Newf("no certificates found in %s", c.TLSCAFile)
+		}
+	}
+	if c.TLSCertFile != "" || c.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load client certificate")
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func (c *Config) newExporter(ctx context.Context) (sdkmetric.Exporter, error) {
+	tlsCfg, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	switch c.Protocol {
+	case ProtocolGRPC:
+		opts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithEndpointURL(c.Endpoint), otlpmetricgrpc.WithHeaders(c.Headers)}
+		if tlsCfg != nil {
+			opts = append(opts, otlpmetricgrpc.WithTLSCredentials(credentials.NewTLS(tlsCfg)))
+		}
+		return otlpmetricgrpc.New(ctx, opts...)
+	default:
+		opts := []otlpmetrichttp.Option{otlpmetrichttp.WithEndpointURL(c.Endpoint), otlpmetrichttp.WithHeaders(c.Headers)}
+		if tlsCfg != nil {
+			opts = append(opts, otlpmetrichttp.WithTLSClientConfig(tlsCfg))
+		}
+		return otlpmetrichttp.New(ctx, opts...)
+	}
+}
+
+// ucumUnits maps the units of the exporter fields to UCUM units.
+var ucumUnits = map[string]string{
+	exporter.UnitCelsius:                 "Cel",
+	exporter.UnitPercent:                 "%",
+	exporter.UnitPPM:                     "ppm",
+	exporter.UnitMicrogramsPerCubicMeter: "ug/m3",
+	exporter.UnitGramsPerCubicMeter:      "g/m3",
+	exporter.UnitKilopascal:              "kPa",
+}
+
+var scope = instrumentation.Scope{Name: "github.com/pedro-stanaka/qingping_exporter"}
+
+// maxPendingReadings is the number of readings, one per field of a report,
+// buffered per device while the receiver is unreachable. At one report per
+// minute, that is about 27 hours of the 6 sensor fields, or 15 hours with the
+// comfort fields. The oldest ones are dropped first.
+const maxPendingReadings = 10000
+
+type pending struct {
+	info     client.DeviceInfo
+	readings []exporter.Reading
+}
+
+// Exporter buffers the readings of every device and pushes them over OTLP on
+// an interval. Each device is pushed as its own resource, and every data point
+// carries the timestamp reported by the device. It implements exporter.DeviceSink.
+type Exporter struct {
+	cfg     Config
+	logger  log.Logger
+	pushes  *prometheus.CounterVec
+	dropped prometheus.Counter
+
+	mtx     sync.Mutex
+	pending map[string]*pending
+}
+
+func NewExporter(cfg Config, reg prometheus.Registerer, logger log.Logger) *Exporter {
+	return &Exporter{
+		cfg:    cfg,
+		logger: log.With(logger, "component", "otlp"),
+		pushes: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "qingping_otlp_pushes_total",
+			Help: "Number of OTLP pushes, one per device, by result",
+		}, []string{"result"}),
+		dropped: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "qingping_otlp_dropped_readings_total",
+			Help: "Number of readings dropped because too many were buffered for a device while the receiver was unreachable",
+		}),
+		pending: make(map[string]*pending),
+	}
+}
+
+func (e *Exporter) Name() string {
+	return "otlp"
+}
+
+// UpdateDevice refreshes the resource attributes of the pending readings.
+func (e *Exporter) UpdateDevice(_ context.Context, info client.DeviceInfo) error {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	if p, ok := e.pending[info.MAC]; ok {
+		p.info = info
+	}
+	return nil
+}
+
+// Write buffers the readings, which are pushed on the next interval.
+func (e *Exporter) Write(_ context.Context, readings []exporter.Reading) error {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	for _, r := range readings {
+		p, ok := e.pending[r.Device.MAC]
+		if !ok {
+			p = &pending{}
+			e.pending[r.Device.MAC] = p
+		}
+		p.info = r.Device
+		p.readings = append(p.readings, r)
+	}
+	for _, p := range e.pending {
+		e.trim(p)
+	}
+	return nil
+}
+
+// trim drops the oldest readings of a device over maxPendingReadings. It must
+// be called with the lock held.
+func (e *Exporter) trim(p *pending) {
+	if n := len(p.readings) - maxPendingReadings; n > 0 {
+		p.readings = append(p.readings[:0:0], p.readings[n:]...)
+		e.dropped.Add(float64(n))
+		level.Warn(e.logger).Log("msg", "too many readings buffered, dropping the oldest", "mac", p.info.MAC, "dropped", n)
+	}
+}
+
+// Run pushes the buffered readings on every interval until the context is done.
+func (e *Exporter) Run(ctx context.Context) error {
+	exp, err := e.cfg.newExporter(ctx)
+	if err != nil {
+		return errors.Wrap(err, "create OTLP exporter")
+	}
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = exp.Shutdown(shutdownCtx)
+	}()
+	level.Info(e.logger).Log("msg", "pushing metrics over OTLP", "endpoint", e.cfg.Endpoint, "protocol", e.cfg.Protocol)
+
+	ticker := time.NewTicker(e.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// Flush what was buffered before shutting down.
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			e.push(flushCtx, exp)
+			cancel()
+			return nil
+		case <-ticker.C:
+			e.push(ctx, exp)
+		}
+	}
+}
+
+func (e *Exporter) push(ctx context.Context, exp sdkmetric.Exporter) {
+	e.mtx.Lock()
+	batch := e.pending
+	e.pending = make(map[string]*pending)
+	e.mtx.Unlock()
+
+	for mac, p := range batch {
+		if err := exp.Export(ctx, resourceMetrics(p.info, p.readings)); err != nil {
+			e.pushes.WithLabelValues("error").Inc()
+			level.Warn(e.logger).Log("msg", "failed to push metrics", "mac", mac, "err", err)
+
+			// Keep the readings for the next push, before the ones that
+			// arrived meanwhile.
+			e.mtx.Lock()
+			if newer, ok := e.pending[mac]; ok {
+				p.info = newer.info
+				p.readings = append(p.readings, newer.readings...)
+			}
+			e.pending[mac] = p
+			e.trim(p)
+			e.mtx.Unlock()
+			continue
+		}
+		e.pushes.WithLabelValues("success").Inc()
+	}
+}
+
+// resourceMetrics converts the readings of a device into OTLP gauges, with the
+// device information as resource attributes.
+func resourceMetrics(info client.DeviceInfo, readings []exporter.Reading) *metricdata.ResourceMetrics {
+	res := resource.NewSchemaless(
+		attribute.String("service.name", "qingping_exporter"),
+		attribute.String("device.id", info.MAC),
+		attribute.String("device.manufacturer", "Qingping"),
+		attribute.String("device.model.identifier", info.Product.Code),
+		attribute.String("device.model.name", info.Product.EnName),
+		attribute.String("qingping.device.name", info.Name),
+		attribute.String("qingping.device.version", info.Version),
+		attribute.String("qingping.device.group", info.GroupName),
+	)
+
+	points := make(map[string][]metricdata.DataPoint[float64])
+	for _, r := range readings {
+		points[r.Field] = append(points[r.Field], metricdata.DataPoint[float64]{
+			Time:  r.Timestamp,
+			Value: r.Value,
+		})
+	}
+
+	metrics := make([]metricdata.Metrics, 0, len(points))
+	for _, f := range exporter.AllFields() {
+		if len(points[f.Name]) == 0 {
+			continue
+		}
+		metrics = append(metrics, metricdata.Metrics{
+			Name:        f.Metric,
+			Description: f.Help,
+			Unit:        ucumUnits[f.Unit],
+			Data:        metricdata.Gauge[float64]{DataPoints: points[f.Name]},
+		})
+	}
+
+	return &metricdata.ResourceMetrics{
+		Resource:     res,
+		ScopeMetrics: []metricdata.ScopeMetrics{{Scope: scope, Metrics: metrics}},
+	}
+}
@@ -0,0 +1,248 @@
+package otlp_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/otlp"
+)
+
+// collector is an OTLP receiver stub recording the pushes it accepts.
+type collector struct {
+	url string
+
+	mtx      sync.Mutex
+	fail     bool
+	rejected int
+	requests []*collectormetrics.ExportMetricsServiceRequest
+	headers  []string
+}
+
+func newCollector(t *testing.T) *collector {
+	t.Helper()
+	c := &collector{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/metrics", r.URL.Path)
+
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		if c.fail {
+			c.rejected++
+			// Not retried by the OTLP exporter.
+			http.Error(w, "rejected", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		req := &collectormetrics.ExportMetricsServiceRequest{}
+		require.NoError(t, proto.Unmarshal(body, req))
+		c.requests = append(c.requests, req)
+		c.headers = append(c.headers, r.Header.Get("X-Scope-OrgID"))
+
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+	c.url = srv.URL
+	return c
+}
+
+func (c *collector) setFail(fail bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.fail = fail
+}
+
+func (c *collector) failed() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.rejected
+}
+
+func (c *collector) received() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return len(c.requests)
+}
+
+// run runs the exporter until the pushes received by the collector are all
+// acknowledged and the condition holds. Stopping during a push would push its
+// readings again on shutdown.
+func run(t *testing.T, e *otlp.Exporter, reg *prometheus.Registry, c *collector, condition func() bool) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- e.Run(ctx)
+	}()
+	require.Eventually(t, func() bool {
+		return c.received() > 0 && successfulPushes(t, reg) == c.received() && condition()
+	}, 10*time.Second, 10*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func successfulPushes(t *testing.T, reg *prometheus.Registry) int {
+	t.Helper()
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	for _, mf := range families {
+		if mf.GetName() != "qingping_otlp_pushes_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			if m.GetLabel()[0].GetValue() == "success" {
+				return int(m.GetCounter().GetValue())
+			}
+		}
+	}
+	return 0
+}
+
+// co2Points returns the Unix timestamps of the CO2 points pushed, in order.
+func co2Points(t *testing.T, c *collector) []int64 {
+	t.Helper()
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var out []int64
+	for _, req := range c.requests {
+		for _, m := range req.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+			if m.Name == exporter.MetricCO2 {
+				for _, p := range m.GetGauge().DataPoints {
+					out = append(out, time.Unix(0, int64(p.TimeUnixNano)).Unix())
+				}
+			}
+		}
+	}
+	return out
+}
+
+func TestExporter(t *testing.T) {
+	c := newCollector(t)
+	reg := prometheus.NewRegistry()
+
+	e := otlp.NewExporter(otlp.Config{
+		Endpoint: c.url,
+		Protocol: otlp.ProtocolHTTP,
+		Headers:  map[string]string{"X-Scope-OrgID": "tenant"},
+		Interval: 10 * time.Millisecond,
+	}, reg, log.NewNopLogger())
+
+	info := client.DeviceInfo{
+		MAC:     "34CE00000000",
+		Name:    "Office Air Monitor",
+		Version: "4.8.5",
+		Product: client.ProductInfo{Code: "CGDN1", EnName: "Qingping Air Monitor Lite"},
+	}
+	require.NoError(t, e.Write(context.Background(), exporter.NewReadings(info, []client.DeviceData{
+		{Timestamp: client.ValueData{Value: 1726749900}, CO2: client.ValueData{Value: 454}},
+		{Timestamp: client.ValueData{Value: 1726750800}, CO2: client.ValueData{Value: 452}},
+	})))
+
+	run(t, e, reg, c, func() bool { return true })
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	// Buffered readings are pushed once.
+	require.Len(t, c.requests, 1)
+	assert.Equal(t, "tenant", c.headers[0])
+
+	rm := c.requests[0].ResourceMetrics
+	require.Len(t, rm, 1)
+
+	attrs := map[string]string{}
+	for _, kv := range rm[0].Resource.Attributes {
+		attrs[kv.Key] = kv.Value.GetStringValue()
+	}
+	assert.Equal(t, "34CE00000000", attrs["device.id"])
+	assert.Equal(t, "CGDN1", attrs["device.model.identifier"])
+	assert.Equal(t, "Office Air Monitor", attrs["qingping.device.name"])
+	assert.Equal(t, "4.8.5", attrs["qingping.device.version"])
+
+	var found bool
+	for _, m := range rm[0].ScopeMetrics[0].Metrics {
+		if m.Name != "qingping_co2_ppm" {
+			continue
+		}
+		found = true
+		assert.Equal(t, "ppm", m.Unit)
+
+		points := m.GetGauge().DataPoints
+		require.Len(t, points, 2)
+		assert.Equal(t, uint64(time.Unix(1726749900, 0).UnixNano()), points[0].TimeUnixNano)
+		assert.Equal(t, 454.0, points[0].GetAsDouble())
+		assert.Equal(t, uint64(time.Unix(1726750800, 0).UnixNano()), points[1].TimeUnixNano)
+		assert.Equal(t, 452.0, points[1].GetAsDouble())
+	}
+	assert.True(t, found, "qingping_co2_ppm not pushed")
+}
+
+func TestExporter_FailedPush(t *testing.T) {
+	c := newCollector(t)
+	c.setFail(true)
+	reg := prometheus.NewRegistry()
+	e := otlp.NewExporter(otlp.Config{Endpoint: c.url, Protocol: otlp.ProtocolHTTP, Interval: 10 * time.Millisecond}, reg, log.NewNopLogger())
+
+	info := client.DeviceInfo{MAC: "34CE00000000", Product: client.ProductInfo{Code: exporter.DeviceModel}}
+	write := func(ts int64) {
+		assert.NoError(t, e.Write(context.Background(), exporter.NewReadings(info, []client.DeviceData{
+			{Timestamp: client.ValueData{Value: float64(ts)}, CO2: client.ValueData{Value: 450}},
+		})))
+	}
+
+	write(1726749900)
+	go func() {
+		// The failed readings are pushed again, before the newer ones.
+		for c.failed() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		write(1726750800)
+		c.setFail(false)
+	}()
+	run(t, e, reg, c, func() bool { return len(co2Points(t, c)) == 2 })
+
+	assert.Equal(t, []int64{1726749900, 1726750800}, co2Points(t, c))
+}
+
+func TestExporter_DropOldest(t *testing.T) {
+	c := newCollector(t)
+	reg := prometheus.NewRegistry()
+	e := otlp.NewExporter(otlp.Config{Endpoint: c.url, Protocol: otlp.ProtocolHTTP, Interval: 10 * time.Millisecond}, reg, log.NewNopLogger())
+
+	// 2000 rows of 6 fields, over the 10000 readings buffered per device.
+	info := client.DeviceInfo{MAC: "34CE00000000", Product: client.ProductInfo{Code: exporter.DeviceModel}}
+	data := make([]client.DeviceData, 2000)
+	for i := range data {
+		data[i] = client.DeviceData{Timestamp: client.ValueData{Value: float64(1726749900 + 60*i)}}
+	}
+	require.NoError(t, e.Write(context.Background(), exporter.NewReadings(info, data)))
+	run(t, e, reg, c, func() bool { return true })
+
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP qingping_otlp_dropped_readings_total Number of readings dropped because too many were buffered for a device while the receiver was unreachable
+# TYPE qingping_otlp_dropped_readings_total counter
+qingping_otlp_dropped_readings_total 2000
+`), "qingping_otlp_dropped_readings_total"))
+	// The readings of the first 333 rows and 2 fields of the next are dropped.
+	points := co2Points(t, c)
+	require.Len(t, points, 2000-333)
+	assert.Equal(t, int64(1726749900+60*333), points[0])
+	assert.Equal(t, int64(1726749900+60*1999), points[len(points)-1])
+}
@@ -0,0 +1,82 @@
+package store
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+)
+
+// QueryPath is the path of the HTTP query endpoint.
+const QueryPath = "/api/v1/query"
+
+// defaultQueryRange is the range queried when no start is given.
+const defaultQueryRange = 24 * time.Hour
+
+// QueryResponse is the body returned by the query endpoint.
+type QueryResponse struct {
+	MAC     string    `json:"mac"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Records []Record  `json:"records"`
+}
+
+// Handler serves the records of a device in a time range as JSON, e.g.
+// GET /api/v1/query?mac=34CE00000000&start=2024-09-19T00:00:00Z&end=1726790400.
+type Handler struct {
+	store  *Store
+	logger log.Logger
+}
+
+func NewHandler(store *Store, logger log.Logger) *Handler {
+	return &Handler{store: store, logger: log.With(logger, "component", "store")}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	mac := q.Get("mac")
+	if mac == "" {
+		http.Error(w, "missing mac parameter", http.StatusBadRequest)
+		return
+	}
+
+	end, err := exporter.ParseTime(q.Get("end"), time.Now())
+	if err != nil {
+		http.Error(w, "invalid end parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	start, err := exporter.ParseTime(q.Get("start"), end.Add(-defaultQueryRange))
+	if err != nil {
+		http.Error(w, "invalid start parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if start.After(end) {
+		http.Error(w, "start is after end", http.StatusBadRequest)
+		return
+	}
+
+	resp := QueryResponse{
+		MAC:     mac,
+		Start:   start.UTC(),
+		End:     end.UTC(),
+		Records: h.store.Query(mac, start, end),
+	}
+	if resp.Records == nil {
+		resp.Records = []Record{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		level.Warn(h.logger).Log("msg", "failed to write query response", "err", err)
+	}
+}
@@ -0,0 +1,348 @@
+// Package store persists device readings on the local disk, so the history of
+// the devices and their last known values survive restarts and cloud outages.
+//
+// Readings are appended as JSON lines to one segment file per UTC day. All
+// records within the retention are kept in memory to serve queries.
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+)
+
+const (
+	segmentPrefix = "readings-"
+	segmentSuffix = ".jsonl"
+	segmentLayout = "2006-01-02"
+
+	// compactInterval is how often expired records are removed.
+	compactInterval = time.Hour
+)
+
+// Config holds the local store settings.
+type Config struct {
+	Path      string
+	Retention time.Duration
+}
+
+func (c *Config) BindFlags(cmd *kingpin.CmdClause) {
+	cmd.Flag("store.path", "Directory where readings are persisted, to serve their history and restore the last values on restart. Disabled when empty.").
+		StringVar(&c.Path)
+
+	cmd.Flag("store.retention", "How long readings are kept in the local store.").
+		Default("720h").
+		DurationVar(&c.Retention)
+}
+
+// Enabled reports whether a store directory was configured.
+func (c *Config) Enabled() bool {
+	return c.Path != ""
+}
+
+// Record holds the readings of a device taken at the same time, by field name.
+type Record struct {
+	MAC       string             `json:"mac"`
+	Name      string             `json:"name,omitempty"`
+	Timestamp time.Time          `json:"timestamp"`
+	Values    map[string]float64 `json:"values"`
+}
+
+// Readings converts the record back into exporter readings.
+func (r Record) Readings() []exporter.Reading {
+	info := client.DeviceInfo{MAC: r.MAC, Name: r.Name}
+	readings := make([]exporter.Reading, 0, len(r.Values))
+	for _, f := range exporter.AllFields() {
+		v, ok := r.Values[f.Name]
+		if !ok {
+			continue
+		}
+		readings = append(readings, exporter.Reading{
+			Device:    info,
+			Field:     f.Name,
+			Value:     v,
+			Unit:      f.Unit,
+			Timestamp: r.Timestamp,
+		})
+	}
+	return readings
+}
+
+// Store is an append-only store of device readings, deduplicated by device
+// MAC and timestamp. It implements exporter.Sink.
+type Store struct {
+	dir       string
+	retention time.Duration
+	logger    log.Logger
+	records   prometheus.Gauge
+
+	mtx sync.RWMutex
+	// byMAC holds the records of every device, sorted by timestamp.
+	byMAC map[string][]Record
+}
+
+// Open opens the store in the directory of the config, creating it if needed,
+// and loads the records within the retention.
+func Open(cfg Config, reg prometheus.Registerer, logger log.Logger) (*Store, error) {
+	if err := os.MkdirAll(cfg.Path, 0o750); err != nil {
+		return nil, errors.Wrapf(err, "create store directory %s", cfg.Path)
+	}
+
+	s := &Store{
+		dir:       cfg.Path,
+		retention: cfg.Retention,
+		logger:    log.With(logger, "component", "store"),
+		records: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "qingping_store_records",
+			Help: "Number of device readings rows held in the local store",
+		}),
+		byMAC: make(map[string][]Record),
+	}
+
+	if err := s.compact(time.Now()); err != nil {
+		return nil, err
+	}
+	segments, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range segments {
+		if err := s.load(name); err != nil {
+			return nil, err
+		}
+	}
+	s.trim(time.Now())
+
+	level.Info(s.logger).Log("msg", "opened local store", "path", s.dir, "segments", len(segments))
+	return s, nil
+}
+
+func (s *Store) Name() string {
+	return "store"
+}
+
+// Write persists the readings, ignoring the rows already stored.
+func (s *Store) Write(_ context.Context, readings []exporter.Reading) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	bySegment := make(map[string][]Record)
+	for _, row := range exporter.Rows(readings) {
+		r := Record{
+			MAC:       row.Device.MAC,
+			Name:      row.Device.Name,
+			Timestamp: row.Timestamp.UTC(),
+			Values:    make(map[string]float64, len(row.Readings)),
+		}
+		for _, reading := range row.Readings {
+			r.Values[reading.Field] = reading.Value
+		}
+		if !s.insert(r) {
+			continue
+		}
+		name := segmentName(r.Timestamp)
+		bySegment[name] = append(bySegment[name], r)
+	}
+
+	for name, records := range bySegment {
+		if err := s.appendSegment(name, records); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Query returns the records of a device within [start, end], in ascending
+// timestamp order.
+func (s *Store) Query(mac string, start, end time.Time) []Record {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	records := s.byMAC[mac]
+	from := sort.Search(len(records), func(i int) bool {
+		return !records[i].Timestamp.Before(start)
+	})
+	to := sort.Search(len(records), func(i int) bool {
+		return records[i].Timestamp.After(end)
+	})
+	if from >= to {
+		return nil
+	}
+	return append([]Record(nil), records[from:to]...)
+}
+
+// Last returns the most recent record of every device.
+func (s *Store) Last() []Record {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	last := make([]Record, 0, len(s.byMAC))
+	for _, records := range s.byMAC {
+		if len(records) > 0 {
+			last = append(last, records[len(records)-1])
+		}
+	}
+	sort.Slice(last, func(i, j int) bool {
+		return last[i].MAC < last[j].MAC
+	})
+	return last
+}
+
+// Run removes expired records periodically until the context is done.
+func (s *Store) Run(ctx context.Context) error {
+	ticker := time.NewTicker(compactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			if err := s.compact(now); err != nil {
+				level.Warn(s.logger).Log("msg", "failed to remove expired segments", "err", err)
+			}
+			s.mtx.Lock()
+			s.trim(now)
+			s.mtx.Unlock()
+		}
+	}
+}
+
+// insert adds a record to memory, returning false if the device already has
+// a record at the same timestamp. It must be called with the lock held.
+func (s *Store) insert(r Record) bool {
+	records := s.byMAC[r.MAC]
+	i := sort.Search(len(records), func(i int) bool {
+		return !records[i].Timestamp.Before(r.Timestamp)
+	})
+	if i < len(records) && records[i].Timestamp.Equal(r.Timestamp) {
+		return false
+	}
+	records = append(records, Record{})
+	copy(records[i+1:], records[i:])
+	records[i] = r
+	s.byMAC[r.MAC] = records
+	s.records.Inc()
+	return true
+}
+
+// trim drops the records older than the retention from memory.
+// It must be called with the lock held.
+func (s *Store) trim(now time.Time) {
+	cutoff := now.Add(-s.retention)
+	for mac, records := range s.byMAC {
+		i := sort.Search(len(records), func(i int) bool {
+			return !records[i].Timestamp.Before(cutoff)
+		})
+		if i == 0 {
+			continue
+		}
+		s.records.Sub(float64(i))
+		if i == len(records) {
+			delete(s.byMAC, mac)
+			continue
+		}
+		s.byMAC[mac] = append([]Record(nil), records[i:]...)
+	}
+}
+
+// compact removes the segments that only hold records older than the retention.
+func (s *Store) compact(now time.Time) error {
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+
+	cutoff := now.Add(-s.retention)
+	for _, name := range segments {
+		day, err := time.Parse(segmentLayout, strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix))
+		if err != nil || !day.Add(24*time.Hour).Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, name)); err != nil {
+			return errors.Wrapf(err, "remove segment %s", name)
+		}
+		level.Debug(s.logger).Log("msg", "removed expired segment", "segment", name)
+	}
+	return nil
+}
+
+// segments returns the names of the segment files, oldest first.
+func (s *Store) segments() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read store directory %s", s.dir)
+	}
+
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), segmentPrefix) && strings.HasSuffix(e.Name(), segmentSuffix) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// load reads the records of a segment into memory. Lines that cannot be
+// decoded, e.g. after a crash in the middle of a write, are skipped.
+func (s *Store) load(name string) error {
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		return errors.Wrapf(err, "open segment %s", name)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil || r.MAC == "" {
+			level.Warn(s.logger).Log("msg", "skipping corrupted record", "segment", name, "err", err)
+			continue
+		}
+		s.insert(r)
+	}
+	return errors.Wrapf(scanner.Err(), "read segment %s", name)
+}
+
+// appendSegment appends records to a segment file.
+func (s *Store) appendSegment(name string, records []Record) error {
+	f, err := os.OpenFile(filepath.Join(s.dir, name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+	if err != nil {
+		return errors.Wrapf(err, "open segment %s", name)
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			_ = f.Close()
+			return errors.Wrapf(err, "encode record of %s", r.MAC)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return errors.Wrapf(err, "write segment %s", name)
+	}
+	return errors.Wrapf(f.Close(), "close segment %s", name)
+}
+
+func segmentName(t time.Time) string {
+	return segmentPrefix + t.UTC().Format(segmentLayout) + segmentSuffix
+}
@@ -0,0 +1,130 @@
+package store_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/store"
+)
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	cfg := store.Config{Path: dir, Retention: 48 * time.Hour}
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	s, err := store.Open(cfg, prometheus.NewRegistry(), log.NewNopLogger())
+	require.NoError(t, err)
+
+	office := client.DeviceInfo{MAC: "34CE00000000", Name: "Office"}
+	bedroom := client.DeviceInfo{MAC: "34CE00000001", Name: "Bedroom"}
+	row := func(t time.Time, co2 float64) client.DeviceData {
+		return client.DeviceData{Timestamp: client.ValueData{Value: float64(t.Unix())}, CO2: client.ValueData{Value: co2}}
+	}
+
+	require.NoError(t, s.Write(ctx, exporter.NewReadings(office, []client.DeviceData{
+		row(now.Add(-72*time.Hour), 300),
+		row(now.Add(-time.Hour), 400),
+		row(now, 450),
+	})))
+	// Rows already stored are ignored, even out of order.
+	require.NoError(t, s.Write(ctx, exporter.NewReadings(office, []client.DeviceData{
+		row(now.Add(-time.Hour), 999),
+		row(now.Add(-30*time.Minute), 420),
+	})))
+	require.NoError(t, s.Write(ctx, exporter.NewReadings(bedroom, []client.DeviceData{row(now, 600)})))
+
+	records := s.Query(office.MAC, now.Add(-2*time.Hour), now)
+	require.Len(t, records, 3)
+	assert.Equal(t, []float64{400, 420, 450}, []float64{records[0].Values["co2"], records[1].Values["co2"], records[2].Values["co2"]})
+	assert.Equal(t, "Office", records[0].Name)
+	assert.Len(t, s.Query(office.MAC, now.Add(-2*time.Hour), now.Add(-time.Hour)), 1)
+	assert.Empty(t, s.Query("unknown", now.Add(-2*time.Hour), now))
+
+	// Reopening restores the records within the retention and removes expired segments.
+	s, err = store.Open(cfg, prometheus.NewRegistry(), log.NewNopLogger())
+	require.NoError(t, err)
+
+	assert.Len(t, s.Query(office.MAC, time.Time{}, now), 3)
+	_, err = os.Stat(filepath.Join(dir, "readings-"+now.Add(-72*time.Hour).Format("2006-01-02")+".jsonl"))
+	assert.True(t, os.IsNotExist(err))
+
+	last := s.Last()
+	require.Len(t, last, 2)
+	assert.Equal(t, office.MAC, last[0].MAC)
+	assert.Equal(t, 450.0, last[0].Values["co2"])
+	assert.Equal(t, bedroom.MAC, last[1].MAC)
+
+	readings := last[0].Readings()
+	require.Len(t, readings, len(exporter.FieldsFor(exporter.DeviceModel)))
+	assert.Equal(t, office, readings[0].Device)
+	assert.True(t, now.Equal(readings[0].Timestamp))
+}
+
+func TestStore_CorruptedSegment(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().UTC()
+	segment := filepath.Join(dir, "readings-"+now.Format("2006-01-02")+".jsonl")
+	line := `{"mac":"34CE00000000","timestamp":"` + now.Format(time.RFC3339) + `","values":{"co2":450}}`
+	require.NoError(t, os.WriteFile(segment, []byte(line+"\n{\"mac\":\"34CE"), 0o600))
+
+	s, err := store.Open(store.Config{Path: dir, Retention: time.Hour}, prometheus.NewRegistry(), log.NewNopLogger())
+	require.NoError(t, err)
+	require.Len(t, s.Last(), 1)
+}
+
+func TestHandler(t *testing.T) {
+	s, err := store.Open(store.Config{Path: t.TempDir(), Retention: time.Hour}, prometheus.NewRegistry(), log.NewNopLogger())
+	require.NoError(t, err)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	info := client.DeviceInfo{MAC: "34CE00000000"}
+	require.NoError(t, s.Write(context.Background(), exporter.NewReadings(info, []client.DeviceData{
+		{Timestamp: client.ValueData{Value: float64(now.Add(-10 * time.Minute).Unix())}, CO2: client.ValueData{Value: 400}},
+		{Timestamp: client.ValueData{Value: float64(now.Unix())}, CO2: client.ValueData{Value: 450}},
+	})))
+
+	srv := httptest.NewServer(store.NewHandler(s, log.NewNopLogger()))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		name            string
+		query           string
+		expectedStatus  int
+		expectedRecords int
+	}{
+		{name: "default range", query: "?mac=34CE00000000", expectedStatus: http.StatusOK, expectedRecords: 2},
+		{name: "rfc3339 start", query: "?mac=34CE00000000&start=" + now.Add(-5*time.Minute).Format(time.RFC3339), expectedStatus: http.StatusOK, expectedRecords: 1},
+		{name: "unknown device", query: "?mac=unknown", expectedStatus: http.StatusOK},
+		{name: "missing mac", query: "", expectedStatus: http.StatusBadRequest},
+		{name: "invalid start", query: "?mac=34CE00000000&start=yesterday", expectedStatus: http.StatusBadRequest},
+		{name: "start after end", query: "?mac=34CE00000000&start=200&end=100", expectedStatus: http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := http.Get(srv.URL + store.QueryPath + tc.query)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, tc.expectedStatus, resp.StatusCode)
+			if tc.expectedStatus != http.StatusOK {
+				return
+			}
+
+			var body store.QueryResponse
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			assert.Len(t, body.Records, tc.expectedRecords)
+		})
+	}
+}
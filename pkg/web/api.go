@@ -0,0 +1,96 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+)
+
+// DevicesPath is the path of the device API.
+const DevicesPath = "/api/v1/devices"
+
+// defaultHistoryRange is the range of history returned when no start is given.
+const defaultHistoryRange = time.Hour
+
+// DevicesResponse is the body returned by the devices endpoint.
+type DevicesResponse struct {
+	LastSync *exporter.SyncStatus   `json:"last_sync,omitempty"`
+	Devices  []exporter.DeviceState `json:"devices"`
+}
+
+// HistoryResponse is the body returned by the device history endpoint.
+type HistoryResponse struct {
+	MAC     string              `json:"mac"`
+	From    time.Time           `json:"from"`
+	To      time.Time           `json:"to"`
+	History []exporter.Snapshot `json:"history"`
+}
+
+// Mux registers handlers, e.g. an *http.ServeMux or the thanos HTTP server.
+type Mux interface {
+	Handle(pattern string, handler http.Handler)
+}
+
+// API serves the devices and their recent readings cached by the exporter, as
+// JSON and as an HTML status page.
+type API struct {
+	exp    *exporter.AirMonitorLite
+	logger log.Logger
+}
+
+func NewAPI(exp *exporter.AirMonitorLite, logger log.Logger) *API {
+	return &API{exp: exp, logger: log.With(logger, "component", "api")}
+}
+
+// Register adds the API endpoints and the status page to mux:
+//
+//	GET /api/v1/devices
+//	GET /api/v1/devices/{mac}/history?from=2024-09-19T00:00:00Z&to=1726790400
+//	GET /
+func (a *API) Register(mux Mux) {
+	mux.Handle("GET "+DevicesPath, http.HandlerFunc(a.devices))
+	mux.Handle("GET "+DevicesPath+"/{mac}/history", http.HandlerFunc(a.history))
+	mux.Handle("GET /{$}", http.HandlerFunc(a.status))
+}
+
+func (a *API) devices(w http.ResponseWriter, _ *http.Request) {
+	a.writeJSON(w, DevicesResponse{LastSync: a.exp.LastSync(), Devices: a.exp.Devices()})
+}
+
+func (a *API) history(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	to, err := exporter.ParseTime(q.Get("to"), time.Now())
+	if err != nil {
+		http.Error(w, "invalid to parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, err := exporter.ParseTime(q.Get("from"), to.Add(-defaultHistoryRange))
+	if err != nil {
+		http.Error(w, "invalid from parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if from.After(to) {
+		http.Error(w, "from is after to", http.StatusBadRequest)
+		return
+	}
+
+	mac := r.PathValue("mac")
+	history, ok := a.exp.History(mac, from, to)
+	if !ok {
+		http.Error(w, "unknown device "+mac, http.StatusNotFound)
+		return
+	}
+	a.writeJSON(w, HistoryResponse{MAC: mac, From: from.UTC(), To: to.UTC(), History: history})
+}
+
+func (a *API) writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		level.Warn(a.logger).Log("msg", "failed to write response", "err", err)
+	}
+}
@@ -0,0 +1,99 @@
+package web_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/web"
+)
+
+func newAPIServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	exp := exporter.NewAirMonitorLiteExporter(nil, prometheus.NewRegistry(), log.NewNopLogger())
+	office := client.DeviceInfo{MAC: "34CE00000000", Name: "Office", Product: client.ProductInfo{Code: exporter.DeviceModel}}
+	exp.UpdateDeviceInfo(office)
+	exp.Observe(exporter.SourcePoll, office, []client.DeviceData{
+		{Timestamp: client.ValueData{Value: 1726704000}, CO2: client.ValueData{Value: 600}, Temperature: client.ValueData{Value: 21.5}},
+		{Timestamp: client.ValueData{Value: 1726707600}, CO2: client.ValueData{Value: 1500}, Temperature: client.ValueData{Value: 22}},
+	})
+
+	mux := http.NewServeMux()
+	web.NewAPI(exp, log.NewNopLogger()).Register(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func get(t *testing.T, url string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+func TestAPI_Devices(t *testing.T) {
+	srv := newAPIServer(t)
+
+	code, body := get(t, srv.URL+web.DevicesPath)
+	require.Equal(t, http.StatusOK, code)
+	var resp web.DevicesResponse
+	require.NoError(t, json.Unmarshal([]byte(body), &resp))
+	require.Len(t, resp.Devices, 1)
+	d := resp.Devices[0]
+	assert.Equal(t, "Office", d.Info.Name)
+	assert.Equal(t, exporter.SourcePoll, d.Source)
+	require.NotNil(t, d.Last)
+	assert.Equal(t, time.Unix(1726707600, 0).UTC(), d.Last.Timestamp)
+	assert.Equal(t, 1500.0, d.Last.Values["co2"])
+}
+
+func TestAPI_History(t *testing.T) {
+	srv := newAPIServer(t)
+	url := srv.URL + web.DevicesPath + "/34CE00000000/history"
+
+	code, body := get(t, url+"?from=2024-09-19T00:00:00Z&to=1726790400")
+	require.Equal(t, http.StatusOK, code)
+	var resp web.HistoryResponse
+	require.NoError(t, json.Unmarshal([]byte(body), &resp))
+	require.Len(t, resp.History, 2)
+	assert.Equal(t, 600.0, resp.History[0].Values["co2"])
+
+	code, body = get(t, url+"?from=1726705000&to=1726790400")
+	require.Equal(t, http.StatusOK, code)
+	require.NoError(t, json.Unmarshal([]byte(body), &resp))
+	assert.Len(t, resp.History, 1)
+
+	code, _ = get(t, url+"?from=yesterday")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = get(t, url+"?from=1726790400&to=1726704000")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = get(t, srv.URL+web.DevicesPath+"/34CE00000001/history")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestAPI_StatusPage(t *testing.T) {
+	srv := newAPIServer(t)
+
+	code, body := get(t, srv.URL+"/")
+	require.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "Office")
+	assert.Contains(t, body, `<td class="poor">1500</td>`)
+	assert.Contains(t, body, `<td class="good">22</td>`)
+
+	code, _ = get(t, srv.URL+"/unknown")
+	assert.Equal(t, http.StatusNotFound, code)
+}
@@ -0,0 +1,122 @@
+package web
+
+import (
+	"bytes"
+	_ "embed"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+)
+
+// Levels of a reading on the status page.
+const (
+	levelGood     = "good"
+	levelModerate = "moderate"
+	levelPoor     = "poor"
+)
+
+// threshold classifies the readings of a field: values within [good.lo,
+// good.hi] are good, within [moderate.lo, moderate.hi] moderate, others poor.
+type threshold struct {
+	good, moderate [2]float64
+}
+
+func (t threshold) level(v float64) string {
+	switch {
+	case v >= t.good[0] && v <= t.good[1]:
+		return levelGood
+	case v >= t.moderate[0] && v <= t.moderate[1]:
+		return levelModerate
+	default:
+		return levelPoor
+	}
+}
+
+// column is a field shown on the status page.
+type column struct {
+	Field     string
+	Title     string
+	Unit      string
+	threshold *threshold
+}
+
+var statusColumns = []column{
+	{Field: "temperature", Title: "Temperature", Unit: "°C", threshold: &threshold{good: [2]float64{18, 26}, moderate: [2]float64{15, 29}}},
+	{Field: "humidity", Title: "Humidity", Unit: "%", threshold: &threshold{good: [2]float64{30, 60}, moderate: [2]float64{20, 70}}},
+	{Field: "co2", Title: "CO₂", Unit: "ppm", threshold: &threshold{good: [2]float64{0, 800}, moderate: [2]float64{0, 1200}}},
+	{Field: "pm25", Title: "PM2.5", Unit: "µg/m³", threshold: &threshold{good: [2]float64{0, 12}, moderate: [2]float64{0, 35}}},
+	{Field: "pm10", Title: "PM10", Unit: "µg/m³", threshold: &threshold{good: [2]float64{0, 54}, moderate: [2]float64{0, 154}}},
+	{Field: "battery", Title: "Battery", Unit: "%", threshold: &threshold{good: [2]float64{21, 100}, moderate: [2]float64{11, 100}}},
+}
+
+type statusCell struct {
+	Value string
+	Level string
+}
+
+type statusRow struct {
+	Name, MAC  string
+	Offline    bool
+	LastReport string
+	Age        string
+	Source     string
+	Error      string
+	Cells      []statusCell
+}
+
+type statusPage struct {
+	Columns  []column
+	Rows     []statusRow
+	LastSync *exporter.SyncStatus
+	Now      string
+}
+
+//go:embed status.html
+var statusHTML string
+
+var statusTemplate = template.Must(template.New("status").Parse(statusHTML))
+
+func (a *API) status(w http.ResponseWriter, _ *http.Request) {
+	now := time.Now()
+	page := statusPage{Columns: statusColumns, LastSync: a.exp.LastSync(), Now: now.UTC().Format(time.RFC3339)}
+	for _, d := range a.exp.Devices() {
+		row := statusRow{Name: d.Info.Name, MAC: d.Info.MAC, Offline: d.Info.Status.Offline, Source: d.Source}
+		if d.LastSync != nil {
+			row.Error = d.LastSync.Error
+		}
+		for _, c := range statusColumns {
+			var cell statusCell
+			if d.Last != nil {
+				if v, ok := d.Last.Values[c.Field]; ok {
+					cell.Value = strconv.FormatFloat(v, 'f', -1, 64)
+					if c.threshold != nil {
+						cell.Level = c.threshold.level(v)
+					}
+				}
+			}
+			row.Cells = append(row.Cells, cell)
+		}
+		if d.Last != nil {
+			row.LastReport = d.Last.Timestamp.Format(time.RFC3339)
+			row.Age = now.Sub(d.Last.Timestamp).Truncate(time.Second).String()
+		}
+		page.Rows = append(page.Rows, row)
+	}
+
+	// Render first, so a template error does not leave a half written page.
+	var b bytes.Buffer
+	if err := statusTemplate.Execute(&b, page); err != nil {
+		level.Error(a.logger).Log("msg", "failed to render status page", "err", err)
+		http.Error(w, "failed to render status page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := b.WriteTo(w); err != nil {
+		level.Warn(a.logger).Log("msg", "failed to write status page", "err", err)
+	}
+}
@@ -0,0 +1,214 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+)
+
+// StreamPath is the path of the Server-Sent Events stream of new readings.
+const StreamPath = "/api/v1/stream"
+
+// streamBufferSize is the number of events buffered per client. Clients
+// falling further behind are disconnected, and are expected to reconnect.
+const streamBufferSize = 64
+
+// defaultStreamHeartbeat is the heartbeat interval of a stream created without one.
+const defaultStreamHeartbeat = 15 * time.Second
+
+// StreamEvent is the data of the events sent when a device reports readings
+// newer than any seen before.
+type StreamEvent struct {
+	MAC       string             `json:"mac"`
+	Name      string             `json:"name,omitempty"`
+	Timestamp time.Time          `json:"timestamp"`
+	Values    map[string]float64 `json:"values"`
+}
+
+type streamClient struct {
+	// macs holds the upper-cased MACs the client wants, or is empty for all.
+	macs   map[string]struct{}
+	events chan []byte
+	// slow is closed when the client is disconnected for falling behind.
+	slow   chan struct{}
+	closed bool
+}
+
+func (c *streamClient) wants(mac string) bool {
+	if len(c.macs) == 0 {
+		return true
+	}
+	_, ok := c.macs[strings.ToUpper(mac)]
+	return ok
+}
+
+// Stream is a sink sending the new readings to the clients of an SSE endpoint,
+// e.g. GET /api/v1/stream?mac=34CE00000000. Every client gets an event per
+// device report, and a comment as heartbeat when idle, so proxies keep the
+// connection open. A client that does not keep up is disconnected, never
+// blocking the exporter.
+type Stream struct {
+	maxClients int
+	heartbeat  time.Duration
+	logger     log.Logger
+
+	mtx     sync.Mutex
+	clients map[*streamClient]struct{}
+
+	connected prometheus.Gauge
+	rejected  prometheus.Counter
+	slow      prometheus.Counter
+}
+
+func NewStream(maxClients int, heartbeat time.Duration, reg prometheus.Registerer, logger log.Logger) *Stream {
+	if heartbeat <= 0 {
+		heartbeat = defaultStreamHeartbeat
+	}
+	return &Stream{
+		maxClients: maxClients,
+		heartbeat:  heartbeat,
+		logger:     log.With(logger, "component", "stream"),
+		clients:    make(map[*streamClient]struct{}),
+		connected: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "qingping_stream_clients",
+			Help: "Number of clients connected to the stream of readings",
+		}),
+		rejected: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "qingping_stream_rejected_clients_total",
+			Help: "Number of clients rejected because the maximum number of stream clients was reached",
+		}),
+		slow: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "qingping_stream_slow_clients_total",
+			Help: "Number of stream clients disconnected because they did not keep up with the events",
+		}),
+	}
+}
+
+func (s *Stream) Name() string {
+	return "stream"
+}
+
+// Write sends an event per device report to the clients interested in the device.
+func (s *Stream) Write(_ context.Context, readings []exporter.Reading) error {
+	for _, row := range exporter.Rows(readings) {
+		event := StreamEvent{
+			MAC:       row.Device.MAC,
+			Name:      row.Device.Name,
+			Timestamp: row.Timestamp.UTC(),
+			Values:    make(map[string]float64, len(row.Readings)),
+		}
+		for _, r := range row.Readings {
+			event.Values[r.Field] = r.Value
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			return errors.Wrap(err, "encode event")
+		}
+		s.broadcast(row.Device.MAC, data)
+	}
+	return nil
+}
+
+func (s *Stream) broadcast(mac string, data []byte) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for c := range s.clients {
+		if c.closed || !c.wants(mac) {
+			continue
+		}
+		select {
+		case c.events <- data:
+		default:
+			c.closed = true
+			close(c.slow)
+			s.slow.Inc()
+		}
+	}
+}
+
+func (s *Stream) add(c *streamClient) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.maxClients > 0 && len(s.clients) >= s.maxClients {
+		return false
+	}
+	s.clients[c] = struct{}{}
+	s.connected.Inc()
+	return true
+}
+
+func (s *Stream) remove(c *streamClient) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.clients, c)
+	s.connected.Dec()
+}
+
+func (s *Stream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	c := &streamClient{
+		macs:   make(map[string]struct{}),
+		events: make(chan []byte, streamBufferSize),
+		slow:   make(chan struct{}),
+	}
+	for _, value := range r.URL.Query()["mac"] {
+		for _, mac := range strings.Split(value, ",") {
+			if mac = strings.TrimSpace(mac); mac != "" {
+				c.macs[strings.ToUpper(mac)] = struct{}{}
+			}
+		}
+	}
+	if !s.add(c) {
+		s.rejected.Inc()
+		http.Error(w, "too many stream clients", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.remove(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Disable response buffering in nginx.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(s.heartbeat)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-c.slow:
+			level.Debug(s.logger).Log("msg", "disconnecting slow stream client", "remote", r.RemoteAddr)
+			return
+		case data := <-c.events:
+			_, err = fmt.Fprintf(w, "event: reading\ndata: %s\n\n", data)
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		}
+		if err != nil {
+			level.Debug(s.logger).Log("msg", "failed to write to stream client", "remote", r.RemoteAddr, "err", err)
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,136 @@
+package web_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/exporter"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/web"
+)
+
+func readings(mac string, ts, co2 float64) []exporter.Reading {
+	info := client.DeviceInfo{MAC: mac, Name: "Office", Product: client.ProductInfo{Code: exporter.DeviceModel}}
+	return exporter.NewReadings(info, []client.DeviceData{{Timestamp: client.ValueData{Value: ts}, CO2: client.ValueData{Value: co2}}})
+}
+
+// value returns the value of a metric with a single series.
+func value(t *testing.T, reg *prometheus.Registry, name string) float64 {
+	t.Helper()
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() == name {
+			m := f.GetMetric()[0]
+			return m.GetGauge().GetValue() + m.GetCounter().GetValue()
+		}
+	}
+	t.Fatalf("metric %s not found", name)
+	return 0
+}
+
+// waitClients waits until the stream has the given number of clients.
+func waitClients(t *testing.T, reg *prometheus.Registry, n int) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		return value(t, reg, "qingping_stream_clients") == float64(n)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestStream(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	stream := web.NewStream(1, 20*time.Millisecond, reg, log.NewNopLogger())
+	srv := httptest.NewServer(stream)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "?mac=34ce00000000,34CE00000002")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	waitClients(t, reg, 1)
+
+	// Further clients are rejected.
+	rejected, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	rejected.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, rejected.StatusCode)
+	assert.Equal(t, 1.0, value(t, reg, "qingping_stream_rejected_clients_total"))
+
+	require.NoError(t, stream.Write(context.Background(), readings("34CE00000001", 100, 400)))
+	require.NoError(t, stream.Write(context.Background(), readings("34CE00000000", 200, 500)))
+
+	// Only the events of the selected devices are sent, between heartbeats.
+	lines := bufio.NewScanner(resp.Body)
+	var event web.StreamEvent
+	heartbeats := 0
+	for lines.Scan() {
+		line := lines.Text()
+		if line == ": heartbeat" {
+			heartbeats++
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			require.NoError(t, json.Unmarshal([]byte(data), &event))
+		}
+		if event.MAC != "" && heartbeats > 0 {
+			break
+		}
+	}
+	require.NoError(t, lines.Err())
+	assert.Equal(t, "34CE00000000", event.MAC)
+	assert.Equal(t, time.Unix(200, 0).UTC(), event.Timestamp)
+	assert.Equal(t, 500.0, event.Values["co2"])
+}
+
+// blockingWriter is a response writer whose body writes block until released.
+type blockingWriter struct {
+	header  http.Header
+	release chan struct{}
+}
+
+func (w *blockingWriter) Header() http.Header { return w.header }
+func (w *blockingWriter) WriteHeader(int)     {}
+func (w *blockingWriter) Flush()              {}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	<-w.release
+	return len(b), nil
+}
+
+func TestStream_SlowClient(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	// No heartbeat interval, the default one is used.
+	stream := web.NewStream(0, 0, reg, log.NewNopLogger())
+
+	w := &blockingWriter{header: http.Header{}, release: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		stream.ServeHTTP(w, httptest.NewRequest(http.MethodGet, web.StreamPath, nil))
+	}()
+	waitClients(t, reg, 1)
+
+	// Writing never blocks, and the client falling behind is disconnected.
+	for i := 0; i < 100; i++ {
+		require.NoError(t, stream.Write(context.Background(), readings("34CE00000000", float64(i), 400)))
+	}
+	close(w.release)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow client was not disconnected")
+	}
+	waitClients(t, reg, 0)
+	assert.Equal(t, 1.0, value(t, reg, "qingping_stream_slow_clients_total"))
+}
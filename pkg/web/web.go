@@ -0,0 +1,97 @@
+// Package web sets up the HTTP server of the run command, and serves the state
+// of the devices as JSON and as an HTML status page. TLS and basic auth are
+// configured with a web config file in the exporter-toolkit format, see
+// https://github.com/prometheus/exporter-toolkit/blob/master/docs/web-configuration.md.
+package web
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	toolkit_web "github.com/prometheus/exporter-toolkit/web"
+	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/prober"
+	thanoshttp "github.com/thanos-io/thanos/pkg/server/http"
+)
+
+// MetricsPath is the path metrics are served on.
+const MetricsPath = "/metrics"
+
+// Config holds the HTTP server settings.
+type Config struct {
+	ListenAddress string
+	ConfigFile    string
+	MaxRequests   int
+
+	StreamMaxClients int
+	StreamHeartbeat  time.Duration
+}
+
+func (c *Config) BindFlags(cmd *kingpin.CmdClause) {
+	cmd.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").
+		Default(":10803").
+		StringVar(&c.ListenAddress)
+
+	cmd.Flag("web.config.file", "Path to a web config file enabling TLS, client certificate verification and basic auth, in the exporter-toolkit format.").
+		StringVar(&c.ConfigFile)
+
+	cmd.Flag("web.max-requests", "Maximum number of concurrent "+MetricsPath+" requests. Further requests get a 503 response. 0 disables the limit.").
+		Default("0").
+		IntVar(&c.MaxRequests)
+
+	cmd.Flag("web.stream.max-clients", "Maximum number of concurrent clients of the "+StreamPath+" stream of readings. 0 disables the limit.").
+		Default("10").
+		IntVar(&c.StreamMaxClients)
+
+	cmd.Flag("web.stream.heartbeat", "Interval at which a heartbeat is sent to idle clients of the "+StreamPath+" stream. 0 uses the default.").
+		Default("15s").
+		DurationVar(&c.StreamHeartbeat)
+}
+
+// Validate checks the limits and loads the web config file, including its
+// certificates, so mistakes are reported on startup rather than on the first
+// request.
+func (c *Config) Validate() error {
+	if c.MaxRequests < 0 {
+		return errors.New("--web.max-requests must not be negative")
+	}
+	if c.StreamMaxClients < 0 {
+		return errors.New("--web.stream.max-clients must not be negative")
+	}
+	if err := toolkit_web.Validate(c.ConfigFile); err != nil {
+		return errors.Wrapf(err, "web config file %s", c.ConfigFile)
+	}
+	return nil
+}
+
+// NewServer creates the HTTP server exposing the metrics of reg and the probe
+// endpoints. The web config file is read again on every request, so basic auth
+// users and certificates can be changed without a restart.
+func NewServer(c Config, reg *prometheus.Registry, probe *prober.HTTPProbe, logger log.Logger) *thanoshttp.Server {
+	srv := thanoshttp.New(logger, reg, component.Debug, probe,
+		thanoshttp.WithListen(c.ListenAddress),
+		thanoshttp.WithTLSConfig(c.ConfigFile),
+	)
+	if c.MaxRequests > 0 {
+		// The server already handles MetricsPath for all methods; the method
+		// pattern is more specific, so it takes precedence for scrapes.
+		srv.Handle(http.MethodGet+" "+MetricsPath, MetricsHandler(reg, c.MaxRequests))
+	}
+	return srv
+}
+
+// MetricsHandler serves the metrics of reg, rejecting requests beyond
+// maxRequests concurrent ones with a 503. It also exposes the
+// promhttp_metric_handler_* metrics tracking the scrapes.
+func MetricsHandler(reg *prometheus.Registry, maxRequests int) http.Handler {
+	return promhttp.InstrumentMetricHandler(reg, promhttp.HandlerFor(reg, promhttp.HandlerOpts{
+		EnableOpenMetrics:   true,
+		MaxRequestsInFlight: maxRequests,
+		Registry:            reg,
+	}))
+}
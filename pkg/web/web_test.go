@@ -0,0 +1,251 @@
+package web_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/thanos/pkg/prober"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/web"
+)
+
+// certificate generates a key pair signed by parent, or self-signed when
+// parent is nil, and writes them as PEM files into dir.
+func certificate(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, ca bool) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if ca {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return cert, key
+}
+
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// serve starts the server with the web config and waits for it to accept
+// connections.
+func serve(t *testing.T, webConfig string) string {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "web.yml")
+	require.NoError(t, os.WriteFile(path, []byte(webConfig), 0o600))
+
+	c := web.Config{ListenAddress: freeAddress(t), ConfigFile: path}
+	require.NoError(t, c.Validate())
+	srv := web.NewServer(c, prometheus.NewRegistry(), prober.NewHTTP(), log.NewNopLogger())
+	go func() { _ = srv.ListenAndServe() }()
+	t.Cleanup(func() { srv.Shutdown(nil) })
+
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", c.ListenAddress)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	return c.ListenAddress
+}
+
+func TestServer_TLSAndBasicAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := certificate(t, dir, "ca", nil, nil, true)
+	certificate(t, dir, "server", ca, caKey, false)
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cr3t"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	addr := serve(t, fmt.Sprintf(`
+tls_server_config:
+  cert_file: %s
+  key_file: %s
+basic_auth_users:
+  prometheus: %s
+`, filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), hash))
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+
+	get := func(user, password string) int {
+		req, err := http.NewRequest(http.MethodGet, "https://"+addr+web.MetricsPath, nil)
+		require.NoError(t, err)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusUnauthorized, get("", ""))
+	assert.Equal(t, http.StatusUnauthorized, get("prometheus", "wrong"))
+	assert.Equal(t, http.StatusOK, get("prometheus", "s3cr3t"))
+
+	// Plaintext requests are refused.
+	resp, err := http.Get("http://" + addr + web.MetricsPath)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestServer_ClientCA(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := certificate(t, dir, "ca", nil, nil, true)
+	certificate(t, dir, "server", ca, caKey, false)
+	certificate(t, dir, "client", ca, caKey, false)
+	// A self-signed client certificate is not trusted.
+	certificate(t, dir, "other", nil, nil, false)
+
+	addr := serve(t, fmt.Sprintf(`
+tls_server_config:
+  cert_file: %s
+  key_file: %s
+  client_auth_type: RequireAndVerifyClientCert
+  client_ca_file: %s
+`, filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.crt")))
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	get := func(cert string) error {
+		config := &tls.Config{RootCAs: pool}
+		if cert != "" {
+			pair, err := tls.LoadX509KeyPair(filepath.Join(dir, cert+".crt"), filepath.Join(dir, cert+".key"))
+			require.NoError(t, err)
+			config.Certificates = []tls.Certificate{pair}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		resp, err := client.Get("https://" + addr + web.MetricsPath)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("status %d", resp.StatusCode)
+		}
+		return nil
+	}
+	assert.NoError(t, get("client"))
+	assert.Error(t, get(""))
+	assert.Error(t, get("other"))
+}
+
+func TestConfig_Validate(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"missing cert": "tls_server_config: {cert_file: missing.crt, key_file: missing.key}",
+		"missing key":  "tls_server_config: {cert_file: server.crt}",
+		"plain hash":   "basic_auth_users: {prometheus: s3cr3t}",
+		"unknown key":  "tls_config: {}",
+	} {
+		path := filepath.Join(dir, strings.ReplaceAll(name, " ", "_")+".yml")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		assert.Error(t, (&web.Config{ConfigFile: path}).Validate(), name)
+	}
+	assert.Error(t, (&web.Config{ConfigFile: filepath.Join(dir, "missing.yml")}).Validate())
+	assert.Error(t, (&web.Config{MaxRequests: -1}).Validate())
+	assert.Error(t, (&web.Config{StreamMaxClients: -1}).Validate())
+	assert.NoError(t, (&web.Config{}).Validate())
+}
+
+// blockingCollector blocks collection until released.
+type blockingCollector struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (c *blockingCollector) Collect(chan<- prometheus.Metric) {
+	c.started <- struct{}{}
+	<-c.release
+}
+
+func TestServer_MaxRequests(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	blocking := &blockingCollector{started: make(chan struct{}), release: make(chan struct{})}
+	reg.MustRegister(blocking)
+
+	c := web.Config{ListenAddress: freeAddress(t), MaxRequests: 1}
+	require.NoError(t, c.Validate())
+	srv := web.NewServer(c, reg, prober.NewHTTP(), log.NewNopLogger())
+	go func() { _ = srv.ListenAndServe() }()
+	defer srv.Shutdown(nil)
+	require.Eventually(t, func() bool {
+		resp, err := http.Get("http://" + c.ListenAddress + "/-/healthy")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		resp, err := http.Get("http://" + c.ListenAddress + web.MetricsPath)
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+	}()
+	<-blocking.started
+
+	// The first scrape is still collecting.
+	resp, err := http.Get("http://" + c.ListenAddress + web.MetricsPath)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	close(blocking.release)
+	wg.Wait()
+}
@@ -0,0 +1,183 @@
+// Package webhook receives device data pushed by the Qingping cloud to a
+// developer webhook URL.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+)
+
+// Path is where the webhook handler is registered.
+const Path = "/webhook/qingping"
+
+// maxBodySize bounds the size of an accepted push message.
+const maxBodySize = 1 << 20
+
+// maxClockSkew bounds the difference between the timestamp of a signature and
+// the current time, so that captured messages cannot be replayed later.
+const maxClockSkew = 5 * time.Minute
+
+// Message is the body of a push request.
+type Message struct {
+	Signature Signature `json:"signature"`
+	Payload   Payload   `json:"payload"`
+}
+
+// Signature authenticates a push message. It is the hex encoded HMAC-SHA256
+// of the timestamp followed by the token, keyed with the app secret.
+type Signature struct {
+	Signature string `json:"signature"`
+	Timestamp int64  `json:"timestamp"`
+	Token     string `json:"token"`
+}
+
+// Payload holds the device the data was pushed for and its readings.
+type Payload struct {
+	Info client.DeviceInfo   `json:"info"`
+	Data []client.DeviceData `json:"data"`
+}
+
+func (p *Payload) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Info client.DeviceInfo `json:"info"`
+		Data json.RawMessage   `json:"data"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	p.Info = raw.Info
+	p.Data = nil
+
+	// Realtime pushes carry a single reading, history pushes a list.
+	data := bytes.TrimSpace(raw.Data)
+	switch {
+	case len(data) == 0 || bytes.Equal(data, []byte("null")):
+		return nil
+	case data[0] == '[':
+		return json.Unmarshal(data, &p.Data)
+	default:
+		var d client.DeviceData
+		if err := json.Unmarshal(data, &d); err != nil {
+			return err
+		}
+		p.Data = []client.DeviceData{d}
+		return nil
+	}
+}
+
+// Sign computes the signature of a push message for the given app secret.
+func Sign(secret string, timestamp int64, token string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(strconv.FormatInt(timestamp, 10) + token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether the signature is valid for the given app secret and
+// its timestamp is within a few minutes of the current time.
+func (s Signature) Verify(secret string) bool {
+	if skew := time.Since(time.Unix(s.Timestamp, 0)); skew > maxClockSkew || skew < -maxClockSkew {
+		return false
+	}
+	expected, err := hex.DecodeString(Sign(secret, s.Timestamp, s.Token))
+	if err != nil {
+		return false
+	}
+	got, err := hex.DecodeString(s.Signature)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(expected, got)
+}
+
+// ObserveFunc is called with the readings of every authenticated push.
+type ObserveFunc func(info client.DeviceInfo, data []client.DeviceData)
+
+// Handler is an HTTP handler for Qingping push messages.
+type Handler struct {
+	mtx      sync.Mutex
+	secret   string
+	observe  ObserveFunc
+	logger   log.Logger
+	requests *prometheus.CounterVec
+}
+
+func NewHandler(secret string, observe ObserveFunc, reg prometheus.Registerer, logger log.Logger) *Handler {
+	return &Handler{
+		secret:  secret,
+		observe: observe,
+		logger:  logger,
+		requests: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "qingping_webhook_requests_total",
+			Help: "Number of push requests received on the webhook, by result",
+		}, []string{"result"}),
+	}
+}
+
+// SetSecret replaces the app secret push messages are verified with, e.g. on a
+// config reload.
+func (h *Handler) SetSecret(secret string) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.secret = secret
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.requests.WithLabelValues("bad_method").Inc()
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	msg, err := decode(r.Body)
+	if err != nil {
+		h.requests.WithLabelValues("bad_request").Inc()
+		level.Warn(h.logger).Log("msg", "failed to decode push message", "err", err)
+		http.Error(w, "invalid message", http.StatusBadRequest)
+		return
+	}
+
+	h.mtx.Lock()
+	secret := h.secret
+	h.mtx.Unlock()
+	if !msg.Signature.Verify(secret) {
+		h.requests.WithLabelValues("unauthorized").Inc()
+		level.Warn(h.logger).Log("msg", "rejected push message with invalid signature", "mac", msg.Payload.Info.MAC)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	if msg.Payload.Info.MAC == "" {
+		h.requests.WithLabelValues("bad_request").Inc()
+		http.Error(w, "missing device mac", http.StatusBadRequest)
+		return
+	}
+
+	h.requests.WithLabelValues("accepted").Inc()
+	h.observe(msg.Payload.Info, msg.Payload.Data)
+	w.WriteHeader(http.StatusOK)
+}
+
+func decode(body io.Reader) (*Message, error) {
+	var msg Message
+	if err := json.NewDecoder(io.LimitReader(body, maxBodySize)).Decode(&msg); err != nil {
+		return nil, errors.Wrap(err, "decode push message")
+	}
+	return &msg, nil
+}
@@ -0,0 +1,117 @@
+package webhook_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pedro-stanaka/qingping_exporter/pkg/client"
+	"github.com/pedro-stanaka/qingping_exporter/pkg/webhook"
+)
+
+func TestHandler(t *testing.T) {
+	const secret = "app-secret"
+
+	var (
+		gotInfo client.DeviceInfo
+		gotData []client.DeviceData
+	)
+	h := webhook.NewHandler(secret, func(info client.DeviceInfo, data []client.DeviceData) {
+		gotInfo, gotData = info, data
+	}, prometheus.NewRegistry(), log.NewNopLogger())
+
+	now := time.Now().Unix()
+	body := func(signature string, timestamp int64, data string) string {
+		return `{
+			"signature": {"signature": "` + signature + `", "timestamp": ` + strconv.FormatInt(timestamp, 10) + `, "token": "abc"},
+			"payload": {
+				"info": {"mac": "34CE00000000", "name": "Office Air Monitor", "product": {"code": "CGDN1"}},
+				"data": ` + data + `
+			}
+		}`
+	}
+	validSignature := webhook.Sign(secret, now, "abc")
+	// Signed 4 minutes ago, within the tolerated clock skew.
+	late := now - 4*60
+	// Signed 10 minutes ago or ahead, e.g. a replayed message.
+	stale, ahead := now-10*60, now+10*60
+
+	for _, tc := range []struct {
+		name         string
+		method       string
+		body         string
+		expectedCode int
+		expectedData []client.DeviceData
+	}{
+		{
+			name:         "history push",
+			body:         body(validSignature, now, `[{"timestamp": {"value": 1726750800}, "co2": {"value": 452}}]`),
+			expectedCode: http.StatusOK,
+			expectedData: []client.DeviceData{{Timestamp: client.ValueData{Value: 1726750800}, CO2: client.ValueData{Value: 452}}},
+		},
+		{
+			name:         "realtime push",
+			body:         body(validSignature, now, `{"timestamp": {"value": 1726750900}, "temperature": {"value": 26.1}}`),
+			expectedCode: http.StatusOK,
+			expectedData: []client.DeviceData{{Timestamp: client.ValueData{Value: 1726750900}, Temperature: client.ValueData{Value: 26.1}}},
+		},
+		{
+			name:         "late signature",
+			body:         body(webhook.Sign(secret, late, "abc"), late, `[]`),
+			expectedCode: http.StatusOK,
+			expectedData: []client.DeviceData{},
+		},
+		{
+			name:         "invalid signature",
+			body:         body(webhook.Sign("other-secret", now, "abc"), now, `[]`),
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "stale signature",
+			body:         body(webhook.Sign(secret, stale, "abc"), stale, `[]`),
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "signature ahead of the clock",
+			body:         body(webhook.Sign(secret, ahead, "abc"), ahead, `[]`),
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "malformed body",
+			body:         `{"signature": `,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "wrong method",
+			method:       http.MethodGet,
+			expectedCode: http.StatusMethodNotAllowed,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gotInfo, gotData = client.DeviceInfo{}, nil
+
+			method := tc.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(method, webhook.Path, strings.NewReader(tc.body)))
+
+			require.Equal(t, tc.expectedCode, rec.Code)
+			if tc.expectedCode != http.StatusOK {
+				assert.Empty(t, gotInfo.MAC)
+				return
+			}
+			assert.Equal(t, "34CE00000000", gotInfo.MAC)
+			assert.Equal(t, tc.expectedData, gotData)
+		})
+	}
+}